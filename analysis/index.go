@@ -0,0 +1,135 @@
+package analysis
+
+import (
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/lex"
+	"sort"
+)
+
+// Kind says how a Definition was introduced.
+type Kind int
+
+const (
+	KindVar Kind = iota
+	KindFun
+	KindClass
+	KindParam
+	KindModule // import "path" as name;
+	KindImport // from "path" import name;
+)
+
+// Definition is a name declared in a program, together with every reference to it
+// that the resolver found.
+type Definition struct {
+	Name string
+	Kind Kind
+	Loc  ast.Span    // of the name where it is declared
+	Fun  *ast.FunDef // for a KindFun
+	Path string      // of the module, for a KindModule or KindImport
+	Refs []ast.Span
+
+	global bool
+}
+
+// Index records the declaration and the uses of every name bound in a program.
+// Builtins and other predefined globals have no Definition.
+type Index struct {
+	Defs []*Definition
+}
+
+// Resolve analyses stmt as Analyse does, and also returns an Index of its names.
+// The Index is built even when there are errors.
+func Resolve(stmt ast.Stmt, predefined ...string) (*Index, error) {
+	a := &analyser{
+		globals: make(map[string]bool),
+		index:   &Index{},
+		pending: make(map[string][]ast.Span),
+	}
+	err := a.analyse(stmt, predefined)
+	// Globals may be referred to before they're declared, so resolve those uses last.
+	for name, refs := range a.pending {
+		for _, d := range a.index.Defs {
+			if d.Name == name && d.global {
+				d.Refs = append(d.Refs, refs...)
+				break
+			}
+		}
+	}
+	for _, d := range a.index.Defs {
+		sort.Slice(d.Refs, func(i, j int) bool { return before(d.Refs[i].Start, d.Refs[j].Start) })
+	}
+	return a.index, err
+}
+
+// At returns the Definition whose declaration or one of whose references covers pos.
+func (ix *Index) At(pos lex.Pos) *Definition {
+	for _, d := range ix.Defs {
+		if covers(d.Loc, pos) {
+			return d
+		}
+		for _, r := range d.Refs {
+			if covers(r, pos) {
+				return d
+			}
+		}
+	}
+	return nil
+}
+
+// covers includes the position just after a span, where a cursor at the end of a name sits.
+func covers(s ast.Span, pos lex.Pos) bool {
+	return !before(pos, s.Start) && !before(s.End, pos)
+}
+
+func before(a, b lex.Pos) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Col < b.Col
+}
+
+func (a *analyser) declare(e *env, name string, loc ast.Span, kind Kind, f *ast.FunDef) *Definition {
+	if a.index == nil {
+		return nil
+	}
+	if d, ok := e.defs[name]; ok && d.Loc == loc {
+		// Already declared by the first pass over a block
+		return d
+	}
+	if e.global() {
+		// Redeclaring a global refers to the same variable
+		for _, d := range a.index.Defs {
+			if d.Name == name && d.global {
+				d.Refs = append(d.Refs, loc)
+				return d
+			}
+		}
+	}
+	d := &Definition{Name: name, Kind: kind, Loc: loc, Fun: f, global: e.global()}
+	if e.defs == nil {
+		e.defs = make(map[string]*Definition)
+	}
+	e.defs[name] = d
+	a.index.Defs = append(a.index.Defs, d)
+	return d
+}
+
+// imported notes the module that an imported name came from.
+func (a *analyser) imported(d *Definition, path string) {
+	if d != nil {
+		d.Path = path
+	}
+}
+
+func (a *analyser) refer(e *env, v ast.Var) {
+	if a.index == nil {
+		return
+	}
+	name := v.VarName()
+	for ; !e.global(); e = e.parent {
+		if _, ok := e.vars[name]; ok {
+			if d := e.defs[name]; d != nil {
+				d.Refs = append(d.Refs, v.Span())
+			}
+			return
+		}
+	}
+	a.pending[name] = append(a.pending[name], v.Span())
+}
@@ -9,13 +9,14 @@ type env struct {
 	function *ast.FunDef
 	class    ast.ClassDef
 	parent   *env
-	vars     map[string]struct{}
+	vars     map[string]int
+	defs     map[string]*Definition // only when building an Index
 }
 
 func makeEnv(parent *env) *env {
 	e := &env{
 		parent: parent,
-		vars:   make(map[string]struct{}),
+		vars:   make(map[string]int),
 	}
 	if parent != nil {
 		e.class = parent.class
@@ -24,204 +25,313 @@ func makeEnv(parent *env) *env {
 	return e
 }
 
-func (e *env) depth(v string) int {
+// The global scope is the outermost env. Its names are looked up by name at runtime,
+// as are any names that are not bound at all (such as builtins).
+func (e *env) global() bool {
+	return e.parent == nil
+}
+
+// resolve returns the number of scopes outwards that v is bound in, and its slot there.
+func (e *env) resolve(v string) (int, int) {
 	d := 0
-	for e != nil {
-		if _, ok := e.vars[v]; ok {
-			// we found it
-			return d
-		}
-		// look deeper
-		e = e.parent
-		if e == nil {
-			break
+	for ; !e.global(); e = e.parent {
+		if slot, ok := e.vars[v]; ok {
+			return d, slot
 		}
 		d += 1
 	}
-	return d
+	return ast.Global, 0
+}
+
+// bind declares v in this scope and returns its slot. Redeclaring a name reuses its slot.
+func (e *env) bind(v string) int {
+	if e.global() {
+		return ast.Global
+	}
+	if slot, ok := e.vars[v]; ok {
+		return slot
+	}
+	slot := len(e.vars)
+	e.vars[v] = slot
+	return slot
+}
+
+func (e *env) bindVar(v ast.Var) {
+	v.Depth = 0
+	v.Slot = e.bind(v.VarName())
+	if v.Slot == ast.Global {
+		v.Depth = ast.Global
+	}
+}
+
+// analyser accumulates the problems found while walking the program.
+type analyser struct {
+	diags   ast.Diagnostics
+	globals map[string]bool       // names that may be referred to in the global scope
+	loops   int                   // the number of loops enclosing the current statement, within its function
+	index   *Index                // built if requested
+	pending map[string][]ast.Span // references to globals, for the index
+}
+
+func (a *analyser) errorf(at ast.Span, msg string, xs ...interface{}) {
+	a.diags = append(a.diags, &ast.Diagnostic{Loc: at, Message: fmt.Sprintf(msg, xs...)})
 }
 
-func (e *env) bind(v string) {
-	e.vars[v] = struct{}{}
+// Analyse resolves every variable reference in stmt. Any semantic errors are all
+// returned together as ast.Diagnostics.
+//
+// A reference to a name that is bound neither locally nor at the top level of stmt
+// is an error, unless the name is one of the predefined globals - such as those
+// supplied by builtin.InitEnv, or declared by earlier input to a REPL.
+func Analyse(stmt ast.Stmt, predefined ...string) error {
+	a := &analyser{globals: make(map[string]bool)}
+	return a.analyse(stmt, predefined)
 }
 
-func Analyse(stmt ast.Stmt) error {
+func (a *analyser) analyse(stmt ast.Stmt, predefined []string) error {
+	for _, name := range predefined {
+		a.globals[name] = true
+	}
+	for _, name := range Globals(stmt) {
+		a.globals[name] = true
+	}
 	// Walk down a set of statements and analyse them
-	return visitStmt(nil, stmt)
+	a.visitStmt(makeEnv(nil), stmt)
+	return a.diags.Err()
+}
+
+// Globals returns the names declared at the top level of a program.
+func Globals(stmt ast.Stmt) []string {
+	var names []string
+	add := func(s ast.Stmt) {
+		switch s := s.(type) {
+		case *ast.VarDecl:
+			names = append(names, s.VarName)
+		case *ast.FunDef:
+			names = append(names, s.Name.VarName())
+		case ast.ClassDef:
+			names = append(names, s.Name.VarName())
+		case *ast.Import:
+			if s.As != nil {
+				names = append(names, s.As.VarName())
+			}
+			for _, n := range s.Names {
+				names = append(names, n.VarName())
+			}
+		}
+	}
+	if p, ok := stmt.(ast.Program); ok {
+		for _, s := range p.Stmts {
+			add(s)
+		}
+	} else {
+		add(stmt)
+	}
+	return names
 }
 
-func visitStmt(e *env, s ast.Stmt) error {
+func (a *analyser) visitStmt(e *env, s ast.Stmt) {
 	switch s := s.(type) {
 	case ast.Program:
-		e2 := makeEnv(e)
-		for _, i := range s {
-			if err := visitStmt(e2, i); err != nil {
-				return err
-			}
+		for _, i := range s.Stmts {
+			a.visitStmt(e, i)
 		}
-		return nil
 	case ast.Block:
 		e2 := makeEnv(e)
 		// We take two passes. The first includes any function definitions at this level.
 		// That's to permit nested recursion in blocks.
-		for _, i := range s {
+		for _, i := range s.Stmts {
 			switch i := i.(type) {
 			case *ast.FunDef:
 				e2.bind(i.Name.VarName())
+				a.declare(e2, i.Name.VarName(), i.Name.Span(), KindFun, i)
 			}
 		}
-		for _, i := range s {
-			if err := visitStmt(e2, i); err != nil {
-				return err
-			}
+		for _, i := range s.Stmts {
+			a.visitStmt(e2, i)
 		}
-		return nil
 	case *ast.Print:
-		return visitExpr(e, s.Expr)
+		a.visitExpr(e, s.Expr)
 	case *ast.Expression:
-		return visitExpr(e, s.Expr)
+		a.visitExpr(e, s.Expr)
 	case *ast.VarDecl:
 		// We resolve the expression first, then add the binding
-		if err := visitExpr(e, s.Expr); err != nil {
-			return err
-		}
-		e.bind(s.VarName)
-		return nil
+		a.visitExpr(e, s.Expr)
+		s.Slot = e.bind(s.VarName)
+		a.declare(e, s.VarName, s.NameLoc, KindVar, nil)
 	case *ast.FunDef:
-		e.bind(s.Name.VarName())
-		e2 := makeEnv(e)
-		e2.function = s
-		for _, i := range s.Params {
-			e2.bind(i.VarName())
-		}
-		return visitStmt(e2, s.Body)
+		e.bindVar(s.Name)
+		a.declare(e, s.Name.VarName(), s.Name.Span(), KindFun, s)
+		a.visitFunction(e, s)
 	case *ast.If:
-		if err := visitExpr(e, s.Cond); err != nil {
-			return err
-		}
-		if err := visitStmt(e, s.Then); err != nil {
-			return err
-		}
+		a.visitExpr(e, s.Cond)
+		a.visitStmt(e, s.Then)
 		if s.Else != nil {
-			return visitStmt(e, s.Else)
+			a.visitStmt(e, s.Else)
 		}
-		return nil
 	case *ast.While:
-		if err := visitExpr(e, s.Cond); err != nil {
-			return err
+		a.visitExpr(e, s.Cond)
+		a.loops++
+		a.visitStmt(e, s.Body)
+		a.loops--
+		if s.Incr != nil {
+			a.visitExpr(e, s.Incr)
+		}
+	case *ast.Throw:
+		a.visitExpr(e, s.Expr)
+	case *ast.Try:
+		a.visitStmt(e, s.Body)
+		if s.Catch != nil {
+			// The caught value is bound in a scope of its own, around the catch block
+			e2 := makeEnv(e)
+			e2.bindVar(s.CatchVar)
+			a.declare(e2, s.CatchVar.VarName(), s.CatchVar.Span(), KindVar, nil)
+			a.visitStmt(e2, s.Catch)
+		}
+		if s.Finally != nil {
+			a.visitStmt(e, s.Finally)
+		}
+	case *ast.Import:
+		if s.As != nil {
+			e.bindVar(s.As)
+			a.imported(a.declare(e, s.As.VarName(), s.As.Span(), KindModule, nil), s.Path)
+		}
+		for _, n := range s.Names {
+			e.bindVar(n)
+			a.imported(a.declare(e, n.VarName(), n.Span(), KindImport, nil), s.Path)
+		}
+	case ast.Break:
+		if a.loops == 0 {
+			a.errorf(s.Span(), "break not enclosed by loop")
+		}
+	case ast.Continue:
+		if a.loops == 0 {
+			a.errorf(s.Span(), "continue not enclosed by loop")
 		}
-		return visitStmt(e, s.Body)
 	case *ast.Return:
 		if e.function == nil {
-			return fmt.Errorf("return not enclosed by function")
-		}
-		if s.Expr == nil {
-			return nil
+			a.errorf(s.Span(), "return not enclosed by function")
+		} else if s.Expr != nil && e.class != nil && e.function.Name != nil && e.function.Name.VarName() == "init" {
+			a.errorf(s.Span(), "nonempty return not permitted in initialiser")
 		}
-		if e.class != nil && e.function.Name.VarName() == "init" {
-			return fmt.Errorf("nonempty return not permitted in initialiser")
+		if s.Expr != nil {
+			a.visitExpr(e, s.Expr)
 		}
-		return visitExpr(e, s.Expr)
 	case ast.ClassDef:
 		if s.Superclass != nil {
-			if err := visitExpr(e, s.Superclass); err != nil {
-				return err
-			}
+			a.visitExpr(e, s.Superclass)
 		}
-		e.bind(s.Name.VarName())
+		e.bindVar(s.Name)
+		a.declare(e, s.Name.VarName(), s.Name.Span(), KindClass, nil)
+		// Mirror the runtime: a subclass's methods close over a scope holding "super",
+		// and each bound method over a scope holding "this".
 		e2 := e
 		if s.Superclass != nil {
+			e2 = makeEnv(e)
 			e2.bind("super")
 		}
 		e3 := makeEnv(e2)
 		e3.bind("this")
 		e3.class = s
 		for _, m := range s.Methods {
-			if err := visitStmt(e3, m); err != nil {
-				return err
-			}
+			a.visitFunction(e3, m)
 		}
-		return nil
 
 	default:
-		return fmt.Errorf("don't know how to visit stmt %s", s)
+		a.errorf(s.Span(), "don't know how to visit stmt %s", s)
 	}
 }
 
-func visitExpr(e *env, x ast.Expr) error {
+func (a *analyser) visitFunction(e *env, f *ast.FunDef) {
+	// Loops don't extend into function bodies
+	loops := a.loops
+	a.loops = 0
+	defer func() { a.loops = loops }()
+	e2 := makeEnv(e)
+	e2.function = f
+	for _, i := range f.Params {
+		e2.bindVar(i)
+		a.declare(e2, i.VarName(), i.Span(), KindParam, nil)
+	}
+	a.visitStmt(e2, f.Body)
+}
+
+func (a *analyser) visitExpr(e *env, x ast.Expr) {
 	switch x := x.(type) {
 	case ast.StrLit:
-		return nil
 	case ast.NLit:
-		return nil
 	case *ast.UnOp:
-		return visitExpr(e, x.Arg)
+		a.visitExpr(e, x.Arg)
 	case *ast.BinOp:
-		if err := visitExpr(e, x.Left); err != nil {
-			return nil
-		}
-		return visitExpr(e, x.Right)
+		a.visitExpr(e, x.Left)
+		a.visitExpr(e, x.Right)
 	case *ast.LogOp:
-		if err := visitExpr(e, x.First); err != nil {
-			return nil
-		}
-		return visitExpr(e, x.Second)
+		a.visitExpr(e, x.First)
+		a.visitExpr(e, x.Second)
 	case ast.NilT:
-		return nil
 	case ast.Bool:
-		return nil
 	case ast.Var:
-		x.Depth = e.depth(x.VarName())
-		return nil
+		x.Depth, x.Slot = e.resolve(x.VarName())
+		if x.Depth == ast.Global && !a.globals[x.VarName()] {
+			a.errorf(x.Span(), "undefined variable: %s", x.VarName())
+		}
+		a.refer(e, x)
 	case ast.ThisT:
-		if e.class != nil {
-			x.Depth = e.depth(x.VarName())
-			return nil
+		if e.class == nil {
+			a.errorf(x.Span(), "'this' keyword not in class scope")
+			return
 		}
-		return fmt.Errorf("'this' keyword not in class scope")
+		x.Depth, x.Slot = e.resolve(x.VarName())
 	case *ast.Super:
-		if e.class != nil && e.class.Superclass != nil {
-			x.S.Depth = e.depth(x.S.VarName())
-			return nil
+		if e.class == nil || e.class.Superclass == nil {
+			a.errorf(x.S.Span(), "'super' keyword not in subclass scope")
+			return
 		}
-		return fmt.Errorf("'super' keyword not in subclass scope")
+		x.S.Depth, x.S.Slot = e.resolve(x.S.VarName())
 
 	case *ast.Assign:
-		if err := visitExpr(e, x.Rhs); err != nil {
-			return err
-		}
-		return visitExpr(e, x.Lhs)
+		a.visitExpr(e, x.Rhs)
+		a.visitExpr(e, x.Lhs)
 	case *ast.Call:
-		if err := visitExpr(e, x.Callee); err != nil {
-			return err
-		}
+		a.visitExpr(e, x.Callee)
 		for _, i := range x.Args {
-			if err := visitExpr(e, i); err != nil {
-				return err
-			}
+			a.visitExpr(e, i)
 		}
-		return nil
 	case *ast.Get:
-		return visitExpr(e, x.Object)
+		a.visitExpr(e, x.Object)
 	case *ast.Set:
-		if err := visitExpr(e, x.Object); err != nil {
-			return err
+		a.visitExpr(e, x.Object)
+		a.visitExpr(e, x.Rhs)
+	case *ast.Interp:
+		for _, i := range x.Parts {
+			a.visitExpr(e, i)
+		}
+	case *ast.ListLit:
+		for _, i := range x.Elems {
+			a.visitExpr(e, i)
 		}
-		return visitExpr(e, x.Rhs)
+	case *ast.MapLit:
+		for i, k := range x.Keys {
+			a.visitExpr(e, k)
+			a.visitExpr(e, x.Values[i])
+		}
+	case *ast.Index:
+		a.visitExpr(e, x.Object)
+		a.visitExpr(e, x.Index)
+	case *ast.SetIndex:
+		a.visitExpr(e, x.Object)
+		a.visitExpr(e, x.Index)
+		a.visitExpr(e, x.Rhs)
 	case *ast.FunLit:
 		e2 := e
 		if x.Name != nil {
 			e2 = makeEnv(e)
-			e2.bind(x.Name.VarName())
-		}
-		e3 := makeEnv(e2)
-		e3.function = (*ast.FunDef)(x)
-		for _, i := range x.Params {
-			e3.bind(i.VarName())
+			e2.bindVar(x.Name)
+			a.declare(e2, x.Name.VarName(), x.Name.Span(), KindFun, (*ast.FunDef)(x))
 		}
-		return visitStmt(e3, x.Body)
+		a.visitFunction(e2, (*ast.FunDef)(x))
 
 	default:
-		return fmt.Errorf("don't know how to visit expr %s", x)
+		a.errorf(x.Span(), "don't know how to visit expr %s", x)
 	}
 }
@@ -0,0 +1,38 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Diagnostic is a problem with the source that is found before the program runs.
+type Diagnostic struct {
+	Loc     Span
+	Message string
+}
+
+func (d *Diagnostic) Error() string {
+	return fmt.Sprintf("%s %s", d.Message, d.Loc.Start)
+}
+
+// Diagnostics collects every problem found in a single pass over the source.
+type Diagnostics []*Diagnostic
+
+func (ds Diagnostics) Error() string {
+	buf := strings.Builder{}
+	for i, d := range ds {
+		if i > 0 {
+			buf.WriteRune('\n')
+		}
+		buf.WriteString(d.Error())
+	}
+	return buf.String()
+}
+
+// Err returns the diagnostics as an error, or nil if there are none.
+func (ds Diagnostics) Err() error {
+	if len(ds) == 0 {
+		return nil
+	}
+	return ds
+}
@@ -2,91 +2,131 @@ package ast
 
 import (
 	"fmt"
+	"github.com/jan-g/lox/lex"
 	"strings"
 )
 
 type Expr interface {
 	String() string
+	Span() Span
 }
 
-type StrLit string
+type StrLit struct {
+	Node
+	Value string
+	Raw   bool // whether it was written in backquotes, and so Value is its source text
+}
 
 func (s StrLit) String() string {
-	return fmt.Sprintf("%q", string(s))
+	return fmt.Sprintf("%q", s.Value)
+}
+
+func Str(loc Span, s string) Expr {
+	return StrLit{Node: At(loc), Value: s}
 }
 
-func Str(s string) Expr {
-	return StrLit(s)
+func RawStr(loc Span, s string) Expr {
+	return StrLit{Node: At(loc), Value: s, Raw: true}
 }
 
-type NLit float64
+type NLit struct {
+	Node
+	Value  float64
+	Lexeme string // as it was written in the source, such as 0xFF or 1_000
+}
 
 func (n NLit) String() string {
-	return fmt.Sprintf("%g", n)
+	return fmt.Sprintf("%g", n.Value)
 }
 
-func Num(n float64) Expr {
-	return NLit(n)
+func Num(loc Span, n float64, lexeme string) Expr {
+	return NLit{Node: At(loc), Value: n, Lexeme: lexeme}
 }
 
 type BinOp struct {
+	Node
 	Left  Expr
 	Op    string
 	Right Expr
+	Pos   lex.Pos // of the operator
 }
 
 func (b BinOp) String() string {
 	return fmt.Sprintf("(%s %s %s)", b.Left, b.Op, b.Right)
 }
 
-func Bin(l Expr, op string, r Expr) Expr {
+func Bin(loc Span, l Expr, op string, r Expr, at lex.Pos) Expr {
 	return &BinOp{
+		Node:  At(loc),
 		Left:  l,
 		Op:    op,
 		Right: r,
+		Pos:   at,
 	}
 }
 
 type UnOp struct {
+	Node
 	Op  string
 	Arg Expr
+	Pos lex.Pos // of the operator
 }
 
 func (u UnOp) String() string {
 	return fmt.Sprintf("%s%s", u.Op, u.Arg)
 }
 
-func Un(op string, arg Expr) Expr {
+func Un(loc Span, op string, arg Expr, at lex.Pos) Expr {
 	return &UnOp{
-		Op:  op,
-		Arg: arg,
+		Node: At(loc),
+		Op:   op,
+		Arg:  arg,
+		Pos:  at,
 	}
 }
 
-type NilT struct{}
+type NilT struct {
+	Node
+}
 
-var Nil = NilT{}
+func Nil(loc Span) Expr {
+	return NilT{Node: At(loc)}
+}
 
 func (NilT) String() string {
 	return "nil"
 }
 
-type Bool bool
+type Bool struct {
+	Node
+	Value bool
+}
 
 func (b Bool) String() string {
-	if b {
+	if b.Value {
 		return "true"
 	} else {
 		return "false"
 	}
 }
 
-var True = Bool(true)
-var False = Bool(false)
+func True(loc Span) Expr {
+	return Bool{Node: At(loc), Value: true}
+}
+
+func False(loc Span) Expr {
+	return Bool{Node: At(loc), Value: false}
+}
+
+// Global is the Depth given to variables that the resolver leaves to be looked up
+// by name in the global scope.
+const Global = -1
 
 type _Var struct {
+	Node
 	Name  string
-	Depth int
+	Depth int // number of scopes outwards from the reference, or Global
+	Slot  int // index of the variable within that scope
 }
 
 func (v *_Var) String() string {
@@ -97,8 +137,9 @@ func (v *_Var) VarName() string {
 	return v.Name
 }
 
-func Id(name string) *_Var {
+func Id(loc Span, name string) *_Var {
 	return &_Var{
+		Node: At(loc),
 		Name: name,
 	}
 }
@@ -106,6 +147,7 @@ func Id(name string) *_Var {
 type Var = *_Var
 
 type Assign struct {
+	Node
 	Lhs   Var
 	Rhs   Expr
 	Depth int // For closures
@@ -115,14 +157,16 @@ func (a *Assign) String() string {
 	return fmt.Sprintf("(%s = %s)", a.Lhs, a.Rhs)
 }
 
-func Assignment(lhs Var, rhs Expr) Expr {
+func Assignment(loc Span, lhs Var, rhs Expr) Expr {
 	return &Assign{
-		Lhs: lhs,
-		Rhs: rhs,
+		Node: At(loc),
+		Lhs:  lhs,
+		Rhs:  rhs,
 	}
 }
 
 type LogOp struct {
+	Node
 	First  Expr
 	Op     string
 	Second Expr
@@ -132,8 +176,9 @@ func (b LogOp) String() string {
 	return fmt.Sprintf("(%s %s %s)", b.First, b.Op, b.Second)
 }
 
-func Log(a Expr, op string, b Expr) Expr {
+func Log(loc Span, a Expr, op string, b Expr) Expr {
 	return &LogOp{
+		Node:   At(loc),
 		First:  a,
 		Op:     op,
 		Second: b,
@@ -141,8 +186,10 @@ func Log(a Expr, op string, b Expr) Expr {
 }
 
 type Call struct {
+	Node
 	Callee Expr
 	Args   []Expr
+	Pos    lex.Pos // of the opening parenthesis
 }
 
 func (c *Call) String() string {
@@ -159,44 +206,54 @@ func (c *Call) String() string {
 	return buf.String()
 }
 
-func CallExpr(c Expr, as ...Expr) Expr {
+func CallExpr(loc Span, at lex.Pos, c Expr, as ...Expr) Expr {
 	return &Call{
+		Node:   At(loc),
 		Callee: c,
 		Args:   as,
+		Pos:    at,
 	}
 }
 
 type Get struct {
+	Node
 	Object    Expr
 	Attribute string
+	Pos       lex.Pos // of the attribute name
 }
 
 func (g *Get) String() string {
 	return fmt.Sprintf("%s.%s", g.Object, g.Attribute)
 }
 
-func GetAttr(obj Expr, attr string) Expr {
+func GetAttr(loc Span, obj Expr, attr string, at lex.Pos) Expr {
 	return &Get{
+		Node:      At(loc),
 		Object:    obj,
 		Attribute: attr,
+		Pos:       at,
 	}
 }
 
 type Set struct {
+	Node
 	Object    Expr
 	Attribute string
 	Rhs       Expr
+	Pos       lex.Pos // of the attribute name
 }
 
 func (s *Set) String() string {
 	return fmt.Sprintf("%s.%s = %s", s.Object, s.Attribute, s.Rhs)
 }
 
-func SetAttr(obj Expr, attr string, expr Expr) Expr {
+func SetAttr(loc Span, obj Expr, attr string, expr Expr, at lex.Pos) Expr {
 	return &Set{
+		Node:      At(loc),
 		Object:    obj,
 		Attribute: attr,
 		Rhs:       expr,
+		Pos:       at,
 	}
 }
 
@@ -208,14 +265,15 @@ func (t ThisT) String() string {
 	return t.Var.String()
 }
 
-func This(v string) Expr {
+func This(loc Span, v string) Expr {
 	return ThisT{
-		Var: Id(v),
+		Var: Id(loc, v),
 	}
 }
 
 type Super struct {
-	S         Var
+	Node
+	S         Var // the super keyword
 	Attribute string
 }
 
@@ -223,9 +281,129 @@ func (s *Super) String() string {
 	return fmt.Sprintf("super@%d.%s", s.S.Depth, s.Attribute)
 }
 
-func Supercall(attr string) *Super {
+func Supercall(loc Span, kw Span, attr string) *Super {
 	return &Super{
-		S:         Id("super"),
+		Node:      At(loc),
+		S:         Id(kw, "super"),
 		Attribute: attr,
 	}
 }
+
+// Interp is a string with interpolated expressions. Its Parts alternate between the
+// StrLits of the text and the expressions, starting and ending with text.
+type Interp struct {
+	Node
+	Parts []Expr
+}
+
+func (i *Interp) String() string {
+	buf := strings.Builder{}
+	for j, p := range i.Parts {
+		if j > 0 {
+			buf.WriteString(" .. ")
+		}
+		buf.WriteString(p.String())
+	}
+	return "(" + buf.String() + ")"
+}
+
+func Interpolate(loc Span, parts ...Expr) Expr {
+	return &Interp{
+		Node:  At(loc),
+		Parts: parts,
+	}
+}
+
+type ListLit struct {
+	Node
+	Elems []Expr
+}
+
+func (l *ListLit) String() string {
+	buf := strings.Builder{}
+	buf.WriteRune('[')
+	for i, e := range l.Elems {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(e.String())
+	}
+	buf.WriteRune(']')
+	return buf.String()
+}
+
+func List(loc Span, elems ...Expr) Expr {
+	return &ListLit{
+		Node:  At(loc),
+		Elems: elems,
+	}
+}
+
+type Index struct {
+	Node
+	Object Expr
+	Index  Expr
+	Pos    lex.Pos // of the opening bracket
+}
+
+func (i *Index) String() string {
+	return fmt.Sprintf("%s[%s]", i.Object, i.Index)
+}
+
+func IndexExpr(loc Span, obj Expr, idx Expr, at lex.Pos) Expr {
+	return &Index{
+		Node:   At(loc),
+		Object: obj,
+		Index:  idx,
+		Pos:    at,
+	}
+}
+
+type SetIndex struct {
+	Node
+	Object Expr
+	Index  Expr
+	Rhs    Expr
+	Pos    lex.Pos // of the opening bracket
+}
+
+func (s *SetIndex) String() string {
+	return fmt.Sprintf("%s[%s] = %s", s.Object, s.Index, s.Rhs)
+}
+
+func SetIndexExpr(loc Span, obj Expr, idx Expr, expr Expr, at lex.Pos) Expr {
+	return &SetIndex{
+		Node:   At(loc),
+		Object: obj,
+		Index:  idx,
+		Rhs:    expr,
+		Pos:    at,
+	}
+}
+
+type MapLit struct {
+	Node
+	Keys   []Expr
+	Values []Expr
+}
+
+func (m *MapLit) String() string {
+	buf := strings.Builder{}
+	buf.WriteRune('{')
+	for i, k := range m.Keys {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(fmt.Sprintf("%s: %s", k, m.Values[i]))
+	}
+	buf.WriteRune('}')
+	return buf.String()
+}
+
+func Map(loc Span, keys []Expr, values []Expr) Expr {
+	return &MapLit{
+		Node:   At(loc),
+		Keys:   keys,
+		Values: values,
+	}
+}
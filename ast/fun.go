@@ -3,6 +3,7 @@ package ast
 import "strings"
 
 type FunDef struct {
+	Node
 	Name   Var
 	Params []Var
 	Body   Stmt
@@ -30,8 +31,9 @@ func (f *FunDef) _String(prefix string) string {
 	return buf.String()
 }
 
-func FunStmt(name Var, params []Var, body Stmt) Stmt {
+func FunStmt(loc Span, name Var, params []Var, body Stmt) Stmt {
 	return &FunDef{
+		Node:   At(loc),
 		Name:   name,
 		Params: params,
 		Body:   body,
@@ -44,8 +46,9 @@ func (f *FunLit) String() string {
 	return (*FunDef)(f).String()
 }
 
-func FunExpr(name Var, params []Var, body Stmt) *FunLit {
+func FunExpr(loc Span, name Var, params []Var, body Stmt) *FunLit {
 	f := FunLit(FunDef{
+		Node:   At(loc),
 		Name:   name,
 		Params: params,
 		Body:   body,
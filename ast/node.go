@@ -0,0 +1,33 @@
+package ast
+
+import (
+	"fmt"
+	"github.com/jan-g/lox/lex"
+)
+
+// Span is the extent of a node in its source file. End is exclusive.
+type Span struct {
+	File  string
+	Start lex.Pos
+	End   lex.Pos
+}
+
+func (s Span) String() string {
+	if s.File == "" {
+		return fmt.Sprintf("%s-%s", s.Start, s.End)
+	}
+	return fmt.Sprintf("%s:%s-%s", s.File, s.Start, s.End)
+}
+
+// Node is embedded in every Expr and Stmt to record where it was parsed from.
+type Node struct {
+	Loc Span
+}
+
+func (n Node) Span() Span {
+	return n.Loc
+}
+
+func At(loc Span) Node {
+	return Node{Loc: loc}
+}
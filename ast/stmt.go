@@ -2,84 +2,101 @@ package ast
 
 import (
 	"fmt"
+	"github.com/jan-g/lox/lex"
 	"strings"
 )
 
 type Stmt interface {
 	String() string
+	Span() Span
 }
 
 type Expression struct {
-	Expr
+	Node
+	Expr Expr
 }
 
 func (e *Expression) String() string {
 	return fmt.Sprintf("%s;\n", e.Expr)
 }
 
-func ExprStmt(e Expr) Stmt {
-	return &Expression{e}
+func ExprStmt(loc Span, e Expr) Stmt {
+	return &Expression{Node: At(loc), Expr: e}
 }
 
 type Print struct {
-	Expr
+	Node
+	Expr Expr
 }
 
 func (p *Print) String() string {
 	return fmt.Sprintf("print %s;\n", p.Expr)
 }
 
-func PrintStmt(e Expr) Stmt {
-	return &Print{e}
+func PrintStmt(loc Span, e Expr) Stmt {
+	return &Print{Node: At(loc), Expr: e}
 }
 
-type Program []Stmt
+type Program struct {
+	Node
+	Stmts    []Stmt
+	Comments []lex.Comment // every comment in the source, in order
+}
 
 func (p Program) String() string {
 	buf := strings.Builder{}
-	for _, s := range p {
+	for _, s := range p.Stmts {
 		_, _ = buf.WriteString(s.String())
 	}
 	return buf.String()
 }
 
-func ProgStmt(stmts ...Stmt) Stmt {
-	return Program(stmts)
+func ProgStmt(loc Span, stmts ...Stmt) Stmt {
+	return Program{Node: At(loc), Stmts: stmts}
 }
 
 type VarDecl struct {
+	Node
 	VarName string
-	Expr
+	NameLoc Span // of the variable name; an implicit nil initialiser has the same span
+	Slot    int  // in the enclosing scope, or Global
+	Expr    Expr
 }
 
 func (d *VarDecl) String() string {
 	return fmt.Sprintf("var %s = %s;\n", d.VarName, d.Expr)
 }
 
-func Decl(id string, e Expr) Stmt {
+func Decl(loc Span, name Span, id string, e Expr) Stmt {
 	return &VarDecl{
+		Node:    At(loc),
 		VarName: id,
+		NameLoc: name,
 		Expr:    e,
 	}
 }
 
-type Block []Stmt
+type Block struct {
+	Node
+	Stmts []Stmt
+}
 
 func (b Block) String() string {
 	buf := strings.Builder{}
 	buf.WriteString("{\n")
-	for _, s := range b {
+	for _, s := range b.Stmts {
 		_, _ = buf.WriteString(s.String())
 	}
 	buf.WriteString("}\n")
 	return buf.String()
 }
 
-func BlockStmt(sts ...Stmt) Stmt {
-	return Block(sts)
+func BlockStmt(loc Span, sts ...Stmt) Stmt {
+	return Block{Node: At(loc), Stmts: sts}
 }
 
 type If struct {
+	Node
 	Cond Expr
 	Then Stmt
 	Else Stmt
@@ -96,8 +113,9 @@ func (i *If) String() string {
 	return buf.String()
 }
 
-func IfStmt(cond Expr, then Stmt, otherwise Stmt) Stmt {
+func IfStmt(loc Span, cond Expr, then Stmt, otherwise Stmt) Stmt {
 	return &If{
+		Node: At(loc),
 		Cond: cond,
 		Then: then,
 		Else: otherwise,
@@ -105,26 +123,120 @@ func IfStmt(cond Expr, then Stmt, otherwise Stmt) Stmt {
 }
 
 type While struct {
+	Node
 	Cond Expr
 	Body Stmt
+	Incr Expr // for a desugared for loop, run after the body and on continue; may be nil
+	For  bool // desugared from a for loop
 }
 
 func (w *While) String() string {
 	buf := strings.Builder{}
-	buf.WriteString(fmt.Sprintf("while (%s)\n\t", w.Cond))
+	if w.Incr != nil {
+		buf.WriteString(fmt.Sprintf("for (; %s; %s)\n\t", w.Cond, w.Incr))
+	} else {
+		buf.WriteString(fmt.Sprintf("while (%s)\n\t", w.Cond))
+	}
 	buf.WriteString(w.Body.String())
 	return buf.String()
 }
 
-func WhileStmt(cond Expr, body Stmt) Stmt {
+func WhileStmt(loc Span, cond Expr, body Stmt) Stmt {
 	return &While{
+		Node: At(loc),
 		Cond: cond,
 		Body: body,
 	}
 }
 
+// LoopStmt is the while loop that a for loop desugars to.
+func LoopStmt(loc Span, cond Expr, body Stmt, incr Expr) Stmt {
+	return &While{
+		Node: At(loc),
+		Cond: cond,
+		Body: body,
+		Incr: incr,
+		For:  true,
+	}
+}
+
+type Break struct {
+	Node
+}
+
+func (Break) String() string {
+	return "break;\n"
+}
+
+func BreakStmt(loc Span) Stmt {
+	return Break{Node: At(loc)}
+}
+
+type Continue struct {
+	Node
+}
+
+func (Continue) String() string {
+	return "continue;\n"
+}
+
+func ContinueStmt(loc Span) Stmt {
+	return Continue{Node: At(loc)}
+}
+
+type Throw struct {
+	Node
+	Expr Expr
+}
+
+func (t *Throw) String() string {
+	return fmt.Sprintf("throw %s;\n", t.Expr)
+}
+
+func ThrowStmt(loc Span, e Expr) Stmt {
+	return &Throw{
+		Node: At(loc),
+		Expr: e,
+	}
+}
+
+// Try has a Catch block, a Finally block, or both.
+type Try struct {
+	Node
+	Body     Stmt
+	CatchVar Var
+	Catch    Stmt
+	Finally  Stmt
+}
+
+func (t *Try) String() string {
+	buf := strings.Builder{}
+	buf.WriteString("try ")
+	buf.WriteString(t.Body.String())
+	if t.Catch != nil {
+		buf.WriteString(fmt.Sprintf("catch (%s) ", t.CatchVar))
+		buf.WriteString(t.Catch.String())
+	}
+	if t.Finally != nil {
+		buf.WriteString("finally ")
+		buf.WriteString(t.Finally.String())
+	}
+	return buf.String()
+}
+
+func TryStmt(loc Span, body Stmt, v Var, catch Stmt, finally Stmt) Stmt {
+	return &Try{
+		Node:     At(loc),
+		Body:     body,
+		CatchVar: v,
+		Catch:    catch,
+		Finally:  finally,
+	}
+}
+
 type Return struct {
-	Expr
+	Node
+	Expr Expr
 }
 
 func (r *Return) String() string {
@@ -134,13 +246,15 @@ func (r *Return) String() string {
 	return fmt.Sprintf("return %s;", r.Expr)
 }
 
-func ReturnStmt(e Expr) Stmt {
+func ReturnStmt(loc Span, e Expr) Stmt {
 	return &Return{
+		Node: At(loc),
 		Expr: e,
 	}
 }
 
 type _ClassDef struct {
+	Node
 	Name       Var
 	Methods    []*FunDef
 	Superclass Var
@@ -167,10 +281,50 @@ func (c *_ClassDef) String() string {
 	return buf.String()
 }
 
-func ClassStmt(name Var, superclass Var, methods ...*FunDef) Stmt {
+func ClassStmt(loc Span, name Var, superclass Var, methods ...*FunDef) Stmt {
 	return &_ClassDef{
+		Node:       At(loc),
 		Name:       name,
 		Methods:    methods,
 		Superclass: superclass,
 	}
 }
+
+// Import runs a module, if it has not been run already, and binds either the module
+// itself or some of its top-level names.
+type Import struct {
+	Node
+	Path    string
+	PathLoc Span
+	As      Var   // import "path" as m;
+	Names   []Var // from "path" import a, b;
+}
+
+func (i *Import) String() string {
+	if i.As != nil {
+		return fmt.Sprintf("import %q as %s;\n", i.Path, i.As)
+	}
+	names := make([]string, len(i.Names))
+	for j, n := range i.Names {
+		names[j] = n.String()
+	}
+	return fmt.Sprintf("from %q import %s;\n", i.Path, strings.Join(names, ", "))
+}
+
+func ImportStmt(loc Span, path string, pathLoc Span, as Var) Stmt {
+	return &Import{
+		Node:    At(loc),
+		Path:    path,
+		PathLoc: pathLoc,
+		As:      as,
+	}
+}
+
+func FromImportStmt(loc Span, path string, pathLoc Span, names ...Var) Stmt {
+	return &Import{
+		Node:    At(loc),
+		Path:    path,
+		PathLoc: pathLoc,
+		Names:   names,
+	}
+}
@@ -8,7 +8,7 @@ import (
 type Builtin struct {
 	Name    string
 	NArgs   int
-	Builtin func(env value.Env, ps ...value.Value) value.Value
+	Builtin func(env value.Env, ps ...value.Value) (value.Value, error)
 }
 
 var _ value.Callable = &Builtin{}
@@ -25,13 +25,27 @@ var builtins = []*Builtin{
 	{
 		Name:  "clock",
 		NArgs: 0,
-		Builtin: func(env value.Env, ps ...value.Value) value.Value {
+		Builtin: func(env value.Env, ps ...value.Value) (value.Value, error) {
 			sec := time.Now().Unix()
-			return value.Num(sec)
+			return value.Num(sec), nil
 		},
 	},
 }
 
+func init() {
+	builtins = append(builtins, listBuiltins...)
+	builtins = append(builtins, mapBuiltins...)
+}
+
+// Names returns the names that InitEnv binds.
+func Names() []string {
+	var names []string
+	for _, b := range builtins {
+		names = append(names, b.Name)
+	}
+	return names
+}
+
 func InitEnv(e value.Env) value.Env {
 	for _, b := range builtins {
 		e.Bind(b.Name, b)
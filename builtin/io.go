@@ -0,0 +1,41 @@
+package builtin
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jan-g/lox/value"
+	"io"
+	"strings"
+)
+
+// Stdio returns builtins for a program's standard input and error streams. They are not
+// bound by InitEnv, since they depend on the host:
+//
+//	readline() returns the next line of input without its line ending, or nil at the end
+//	eprint(v)  writes a value and a newline to the error stream
+func Stdio(in io.Reader, errs io.Writer) []*Builtin {
+	r := bufio.NewReader(in)
+	return []*Builtin{
+		{
+			Name:  "readline",
+			NArgs: 0,
+			Builtin: func(env value.Env, ps ...value.Value) (value.Value, error) {
+				l, err := r.ReadString('\n')
+				if err == io.EOF && l == "" {
+					return value.Nil, nil
+				} else if err != nil && err != io.EOF {
+					return nil, err
+				}
+				return value.Str(strings.TrimSuffix(strings.TrimSuffix(l, "\n"), "\r")), nil
+			},
+		},
+		{
+			Name:  "eprint",
+			NArgs: 1,
+			Builtin: func(env value.Env, ps ...value.Value) (value.Value, error) {
+				_, _ = fmt.Fprintln(errs, ps[0])
+				return value.Nil, nil
+			},
+		},
+	}
+}
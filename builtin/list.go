@@ -0,0 +1,85 @@
+package builtin
+
+import (
+	"fmt"
+	"github.com/jan-g/lox/value"
+	"unicode/utf8"
+)
+
+func list(name string, v value.Value) (*value.List, error) {
+	l, ok := v.(*value.List)
+	if !ok {
+		return nil, fmt.Errorf("%s requires a list, not %s", name, v)
+	}
+	return l, nil
+}
+
+var listBuiltins = []*Builtin{
+	{
+		Name:  "len",
+		NArgs: 1,
+		Builtin: func(env value.Env, ps ...value.Value) (value.Value, error) {
+			switch v := ps[0].(type) {
+			case *value.List:
+				return value.Num(len(v.Elems)), nil
+			case *value.Map:
+				return value.Num(v.Len()), nil
+			case value.Str:
+				return value.Num(utf8.RuneCountInString(string(v))), nil
+			}
+			return nil, fmt.Errorf("len requires a list, map or string, not %s", ps[0])
+		},
+	},
+	{
+		Name:  "push",
+		NArgs: 2,
+		Builtin: func(env value.Env, ps ...value.Value) (value.Value, error) {
+			l, err := list("push", ps[0])
+			if err != nil {
+				return nil, err
+			}
+			l.Elems = append(l.Elems, ps[1])
+			return value.Nil, nil
+		},
+	},
+	{
+		Name:  "pop",
+		NArgs: 1,
+		Builtin: func(env value.Env, ps ...value.Value) (value.Value, error) {
+			l, err := list("pop", ps[0])
+			if err != nil {
+				return nil, err
+			}
+			if len(l.Elems) == 0 {
+				return nil, fmt.Errorf("pop from empty list")
+			}
+			v := l.Elems[len(l.Elems)-1]
+			l.Elems[len(l.Elems)-1] = nil
+			l.Elems = l.Elems[:len(l.Elems)-1]
+			return v, nil
+		},
+	},
+	{
+		// slice(xs, start, end) returns a new list of the elements from start up to, but not including, end.
+		Name:  "slice",
+		NArgs: 3,
+		Builtin: func(env value.Env, ps ...value.Value) (value.Value, error) {
+			l, err := list("slice", ps[0])
+			if err != nil {
+				return nil, err
+			}
+			start, err := value.Integer(ps[1])
+			if err != nil {
+				return nil, fmt.Errorf("slice start %s", err)
+			}
+			end, err := value.Integer(ps[2])
+			if err != nil {
+				return nil, fmt.Errorf("slice end %s", err)
+			}
+			if start < 0 || start > end || end > len(l.Elems) {
+				return nil, fmt.Errorf("slice [%d:%d] out of range for length %d", start, end, len(l.Elems))
+			}
+			return value.NewList(append([]value.Value{}, l.Elems[start:end]...)...), nil
+		},
+	},
+}
@@ -0,0 +1,21 @@
+package builtin
+
+import (
+	"github.com/jan-g/lox/value"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLen(t *testing.T) {
+	var length *Builtin
+	for _, b := range listBuiltins {
+		if b.Name == "len" {
+			length = b
+		}
+	}
+	for s, n := range map[string]float64{"": 0, "hello": 5, "\u00e9": 1, "😀!": 2} {
+		v, err := length.Builtin(nil, value.Str(s))
+		assert.NoError(t, err)
+		assert.Equal(t, value.Num(n), v, s)
+	}
+}
@@ -0,0 +1,63 @@
+package builtin
+
+import (
+	"fmt"
+	"github.com/jan-g/lox/value"
+)
+
+func dict(name string, v value.Value) (*value.Map, error) {
+	m, ok := v.(*value.Map)
+	if !ok {
+		return nil, fmt.Errorf("%s requires a map, not %s", name, v)
+	}
+	return m, nil
+}
+
+var mapBuiltins = []*Builtin{
+	{
+		Name:  "keys",
+		NArgs: 1,
+		Builtin: func(env value.Env, ps ...value.Value) (value.Value, error) {
+			m, err := dict("keys", ps[0])
+			if err != nil {
+				return nil, err
+			}
+			return value.NewList(m.Keys()...), nil
+		},
+	},
+	{
+		Name:  "values",
+		NArgs: 1,
+		Builtin: func(env value.Env, ps ...value.Value) (value.Value, error) {
+			m, err := dict("values", ps[0])
+			if err != nil {
+				return nil, err
+			}
+			return value.NewList(m.Values()...), nil
+		},
+	},
+	{
+		Name:  "has",
+		NArgs: 2,
+		Builtin: func(env value.Env, ps ...value.Value) (value.Value, error) {
+			m, err := dict("has", ps[0])
+			if err != nil {
+				return nil, err
+			}
+			_, ok := m.Get(ps[1])
+			return value.Bool(ok), nil
+		},
+	},
+	{
+		// delete(m, k) removes k from m, returning whether it was present.
+		Name:  "delete",
+		NArgs: 2,
+		Builtin: func(env value.Env, ps ...value.Value) (value.Value, error) {
+			m, err := dict("delete", ps[0])
+			if err != nil {
+				return nil, err
+			}
+			return value.Bool(m.Delete(ps[1])), nil
+		},
+	},
+}
@@ -0,0 +1,368 @@
+package builtin
+
+import (
+	"fmt"
+	"github.com/jan-g/lox/value"
+	"math"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var (
+	envType   = reflect.TypeOf((*value.Env)(nil)).Elem()
+	valueType = reflect.TypeOf((*value.Value)(nil)).Elem()
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Native makes a Builtin from a Go function, converting its arguments from Lox values
+// and its result back again.
+//
+// Parameters may be strings, bools, any of Go's numeric types (integers must be given
+// whole numbers that fit), slices (from lists), maps with string keys (from maps),
+// structs or pointers to them (from a Struct), or value.Value and its implementations,
+// which are passed through as they are. An interface{} parameter gets the Go equivalent
+// of a string, number or boolean, nil for nil, the pointer that a Struct wraps, and any
+// other value as it is. Nil may also be given for a pointer, slice, map or
+// interface parameter. A first parameter of type value.Env receives the calling
+// environment, and is not one of the function's Lox arguments.
+//
+// The function may return nothing, a value, an error, or a value and an error; a
+// non-nil error, or a panic, becomes a Lox runtime error. Structs and pointers to them that it returns
+// are wrapped as Structs.
+func Native(name string, fn interface{}) (*Builtin, error) {
+	f := reflect.ValueOf(fn)
+	t := f.Type()
+	if t.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%s: %s is not a function", name, t)
+	}
+	if t.IsVariadic() {
+		return nil, fmt.Errorf("%s: variadic functions are not supported", name)
+	}
+	withEnv := t.NumIn() > 0 && t.In(0) == envType
+	first := 0
+	if withEnv {
+		first = 1
+	}
+	for i := first; i < t.NumIn(); i++ {
+		if err := convertible(t.In(i)); err != nil {
+			return nil, fmt.Errorf("%s: parameter %d: %s", name, i-first+1, err)
+		}
+	}
+	hasErr := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+	results := t.NumOut()
+	if hasErr {
+		results--
+	}
+	if results > 1 {
+		return nil, fmt.Errorf("%s: functions may return at most one value, and an error", name)
+	}
+	if results == 1 {
+		if err := convertible(t.Out(0)); err != nil {
+			return nil, fmt.Errorf("%s: result: %s", name, err)
+		}
+	}
+
+	return &Builtin{
+		Name:  name,
+		NArgs: t.NumIn() - first,
+		Builtin: func(env value.Env, ps ...value.Value) (value.Value, error) {
+			args := make([]reflect.Value, t.NumIn())
+			if withEnv {
+				args[0] = reflect.ValueOf(&env).Elem()
+			}
+			for i, p := range ps {
+				a, err := toGo(p, t.In(i+first))
+				if err != nil {
+					return nil, fmt.Errorf("%s requires %s for argument %d, not %s", name, describe(t.In(i+first)), i+1, p)
+				}
+				args[i+first] = a
+			}
+			out, err := call(name, f, args)
+			if err != nil {
+				return nil, err
+			}
+			if hasErr {
+				if err, _ := out[len(out)-1].Interface().(error); err != nil {
+					return nil, err
+				}
+			}
+			if results == 0 {
+				return value.Nil, nil
+			}
+			return fromGo(out[0])
+		},
+	}, nil
+}
+
+// call calls a Go function, returning any panic as an error, so that it becomes a Lox
+// runtime error rather than escaping to the host.
+func call(name string, f reflect.Value, args []reflect.Value) (out []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%s panicked: %v", name, r)
+			}
+		}
+	}()
+	return f.Call(args), nil
+}
+
+// convertible checks that a type can be converted to or from Lox.
+func convertible(t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return nil
+	case reflect.Slice:
+		return convertible(t.Elem())
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return fmt.Errorf("map keys must be strings in %s", t)
+		}
+		return convertible(t.Elem())
+	case reflect.Interface:
+		if t.NumMethod() == 0 || valueType.Implements(t) || t.Implements(valueType) {
+			return nil
+		}
+	case reflect.Struct:
+		return nil
+	case reflect.Ptr:
+		if t.Elem().Kind() == reflect.Struct {
+			return nil
+		}
+	}
+	if t.Implements(valueType) {
+		return nil
+	}
+	return fmt.Errorf("cannot convert %s", t)
+}
+
+// describe names a Go type in Lox terms, for errors.
+func describe(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice:
+		return "a list"
+	case reflect.Map:
+		return "a map"
+	case reflect.Struct, reflect.Ptr:
+		return "a Go " + t.String()
+	}
+	if isInteger(t) {
+		return "an integer"
+	}
+	return "a value of type " + t.String()
+}
+
+// loxValue reports whether a Go type holds Lox's own values. Since anything with a String
+// method is a value.Value, other types are told apart by the package that declares them.
+func loxValue(t reflect.Type) bool {
+	if !t.Implements(valueType) {
+		return false
+	}
+	if t.Kind() == reflect.Interface {
+		return true
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return strings.HasPrefix(t.PkgPath(), path.Dir(valueType.PkgPath())+"/")
+}
+
+func isInteger(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+var errConvert = fmt.Errorf("cannot convert")
+
+// toGo converts a Lox value to a Go type.
+func toGo(v value.Value, t reflect.Type) (reflect.Value, error) {
+	if reflect.TypeOf(v).AssignableTo(t) && (t.Kind() != reflect.Interface || t.NumMethod() > 0) {
+		// value.Value, or one of its implementations
+		x := reflect.New(t).Elem()
+		x.Set(reflect.ValueOf(v))
+		return x, nil
+	}
+	if v == value.Nil {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+			return reflect.Zero(t), nil
+		}
+		return reflect.Value{}, errConvert
+	}
+	switch t.Kind() {
+	case reflect.String:
+		if s, ok := v.(value.Str); ok {
+			return reflect.ValueOf(string(s)).Convert(t), nil
+		}
+	case reflect.Bool:
+		if b, ok := v.(value.Bool); ok {
+			return reflect.ValueOf(bool(b)).Convert(t), nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if n, ok := v.(value.Num); ok {
+			return reflect.ValueOf(float64(n)).Convert(t), nil
+		}
+	case reflect.Slice:
+		if l, ok := v.(*value.List); ok {
+			s := reflect.MakeSlice(t, len(l.Elems), len(l.Elems))
+			for i, e := range l.Elems {
+				x, err := toGo(e, t.Elem())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				s.Index(i).Set(x)
+			}
+			return s, nil
+		}
+	case reflect.Map:
+		if m, ok := v.(*value.Map); ok {
+			x := reflect.MakeMapWithSize(t, m.Len())
+			for _, k := range m.Keys() {
+				ks, ok := k.(value.Str)
+				if !ok {
+					return reflect.Value{}, errConvert
+				}
+				e, _ := m.Get(k)
+				ev, err := toGo(e, t.Elem())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				x.SetMapIndex(reflect.ValueOf(string(ks)).Convert(t.Key()), ev)
+			}
+			return x, nil
+		}
+	case reflect.Struct, reflect.Ptr:
+		if s, ok := v.(Struct); ok {
+			p := reflect.ValueOf(s.p)
+			if p.Type().AssignableTo(t) {
+				return p, nil
+			}
+			if p.Type().Elem().AssignableTo(t) {
+				return p.Elem(), nil
+			}
+		}
+	case reflect.Interface:
+		// interface{}
+		var x interface{} = v
+		switch v := v.(type) {
+		case Struct:
+			x = v.p
+		case value.Str:
+			x = string(v)
+		case value.Num:
+			x = float64(v)
+		case value.Bool:
+			x = bool(v)
+		}
+		return reflect.ValueOf(&x).Elem(), nil
+	}
+	if isInteger(t) {
+		// The number is checked against the range of the type before it is converted,
+		// since converting a float that is out of range gives an arbitrary integer
+		num, ok := v.(value.Num)
+		n := float64(num)
+		if !ok || n != math.Trunc(n) {
+			return reflect.Value{}, errConvert
+		}
+		x := reflect.New(t).Elem()
+		if t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uintptr {
+			if n < 0 || n >= math.Ldexp(1, t.Bits()) {
+				return reflect.Value{}, errConvert
+			}
+			x.SetUint(uint64(n))
+		} else {
+			if limit := math.Ldexp(1, t.Bits()-1); n < -limit || n >= limit {
+				return reflect.Value{}, errConvert
+			}
+			x.SetInt(int64(n))
+		}
+		return x, nil
+	}
+	return reflect.Value{}, errConvert
+}
+
+// fromGo converts a Go value to a Lox one.
+func fromGo(x reflect.Value) (value.Value, error) {
+	switch x.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if x.IsNil() {
+			return value.Nil, nil
+		}
+	case reflect.Slice, reflect.Map:
+		if x.IsNil() && !x.Type().Implements(valueType) {
+			return value.Nil, nil
+		}
+	}
+	if loxValue(x.Type()) {
+		return x.Interface().(value.Value), nil
+	}
+	switch x.Kind() {
+	case reflect.Interface:
+		return fromGo(x.Elem())
+	case reflect.String:
+		return value.Str(x.String()), nil
+	case reflect.Bool:
+		return value.Bool(x.Bool()), nil
+	case reflect.Float32, reflect.Float64:
+		return value.Num(x.Float()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Num(x.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return value.Num(x.Uint()), nil
+	case reflect.Slice:
+		l := value.NewList()
+		for i := 0; i < x.Len(); i++ {
+			e, err := fromGo(x.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			l.Elems = append(l.Elems, e)
+		}
+		return l, nil
+	case reflect.Ptr:
+		if x.Type().Elem().Kind() == reflect.Struct {
+			return Struct{p: x.Interface()}, nil
+		}
+	case reflect.Struct:
+		if !x.CanAddr() {
+			// A copy, since the value returned is not otherwise addressable
+			p := reflect.New(x.Type())
+			p.Elem().Set(x)
+			x = p.Elem()
+		}
+		return Struct{p: x.Addr().Interface()}, nil
+	case reflect.Map:
+		if x.Type().Key().Kind() != reflect.String {
+			break
+		}
+		// In key order, since Go maps have none of their own
+		keys := x.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		m := value.NewMap()
+		for _, k := range keys {
+			e, err := fromGo(x.MapIndex(k))
+			if err != nil {
+				return nil, err
+			}
+			_ = m.Set(value.Str(k.String()), e)
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("cannot convert %s to a Lox value", x.Type())
+}
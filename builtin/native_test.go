@@ -0,0 +1,75 @@
+package builtin
+
+import (
+	"github.com/jan-g/lox/value"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestNative(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		fn     interface{}
+		args   []value.Value
+		result value.Value
+		err    string
+	}{
+		{name: "nothing", fn: func() {}, result: value.Nil},
+		{name: "sum", fn: func(xs []float64) float64 {
+			t := 0.
+			for _, x := range xs {
+				t += x
+			}
+			return t
+		}, args: []value.Value{value.NewList(value.Num(1), value.Num(2))}, result: value.Num(3)},
+		{name: "byte", fn: func(b uint8) uint8 { return b }, args: []value.Value{value.Num(256)},
+			err: "byte requires an integer for argument 1, not 256"},
+		{name: "words", fn: func(s string) []string { return []string{s, s} }, args: []value.Value{value.Str("a")},
+			result: value.NewList(value.Str("a"), value.Str("a"))},
+		{name: "keys", fn: func(m map[string]interface{}) int { return len(m) }, args: []value.Value{value.Nil}, result: value.Num(0)},
+		{name: "same", fn: func(v value.Value) value.Value { return v }, args: []value.Value{value.Nil}, result: value.Nil},
+		{name: "any", fn: func(v interface{}) interface{} { return v }, args: []value.Value{value.Bool(true)}, result: value.Bool(true)},
+		{name: "show", fn: func(n int64) int64 { return n }, args: []value.Value{value.Num(-1 << 63)}, result: value.Num(-1 << 63)},
+		{name: "show", fn: func(n int64) int64 { return n }, args: []value.Value{value.Num(1e30)},
+			err: "show requires an integer for argument 1, not 1e+30"},
+		{name: "show", fn: func(n int64) int64 { return n }, args: []value.Value{value.Num(-1e30)},
+			err: "show requires an integer for argument 1, not -1e+30"},
+		{name: "show", fn: func(n int64) int64 { return n }, args: []value.Value{value.Num(math.Inf(1))},
+			err: "show requires an integer for argument 1, not +Inf"},
+		{name: "show", fn: func(n int64) int64 { return n }, args: []value.Value{value.Num(9223372036854775807)},
+			err: "show requires an integer for argument 1, not 9.223372036854776e+18"},
+		{name: "showu", fn: func(n uint64) bool { return n == 1e19 }, args: []value.Value{value.Num(1e19)}, result: value.Bool(true)},
+		{name: "showu", fn: func(n uint64) uint64 { return n }, args: []value.Value{value.Num(math.Ldexp(1, 64))},
+			err: "showu requires an integer for argument 1, not 1.8446744073709552e+19"},
+		{name: "panics", fn: func() { panic("boom") }, err: "panics panicked: boom"},
+		{name: "env", fn: func(env value.Env, n int) int { return n * 2 }, args: []value.Value{value.Num(4)}, result: value.Num(8)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := Native(tc.name, tc.fn)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, len(tc.args), b.NArgs)
+			v, err := b.Builtin(nil, tc.args...)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.result, v)
+			}
+		})
+	}
+}
+
+func TestNativeRejects(t *testing.T) {
+	for name, fn := range map[string]interface{}{
+		"notFunc":  42,
+		"variadic": func(xs ...int) {},
+		"channel":  func(c chan int) {},
+		"twoInts":  func() (int, int) { return 0, 0 },
+		"intKeys":  func() map[int]string { return nil },
+	} {
+		_, err := Native(name, fn)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,97 @@
+package builtin
+
+import (
+	"fmt"
+	"github.com/jan-g/lox/value"
+	"reflect"
+)
+
+// Struct presents a pointer to a Go struct as a Lox object. Its exported fields can be
+// read and assigned, converting between Lox and Go as Native does, and its exported
+// methods can be called.
+//
+// Two Structs are equal if they wrap the same pointer.
+type Struct struct {
+	p interface{}
+}
+
+var _ value.Object = Struct{}
+
+// Wrap makes a Struct from a non-nil pointer to a struct.
+func Wrap(p interface{}) (Struct, error) {
+	v := reflect.ValueOf(p)
+	if v.Kind() != reflect.Ptr || v.Type().Elem().Kind() != reflect.Struct {
+		return Struct{}, fmt.Errorf("%T is not a pointer to a struct", p)
+	}
+	if v.IsNil() {
+		return Struct{}, fmt.Errorf("cannot wrap a nil %T", p)
+	}
+	return Struct{p: p}, nil
+}
+
+// Pointer returns the wrapped pointer.
+func (s Struct) Pointer() interface{} {
+	return s.p
+}
+
+func (s Struct) String() string {
+	return fmt.Sprintf("<go %s>", reflect.TypeOf(s.p).Elem())
+}
+
+func (s Struct) Get(attr string) (value.Value, error) {
+	v := reflect.ValueOf(s.p)
+	f, err := s.field(attr)
+	if err != nil {
+		return nil, err
+	}
+	if f.IsValid() {
+		x, err := fromGo(f)
+		if err != nil {
+			return nil, fmt.Errorf("field %s of %s: %s", attr, s, err)
+		}
+		return x, nil
+	}
+	if m := v.MethodByName(attr); m.IsValid() {
+		return Native(v.Type().Elem().Name()+"."+attr, m.Interface())
+	}
+	return nil, fmt.Errorf("Undefined property '%s' on %s", attr, s)
+}
+
+func (s Struct) Set(attr string, x value.Value) error {
+	f, err := s.field(attr)
+	if err != nil {
+		return err
+	}
+	if !f.IsValid() {
+		if reflect.ValueOf(s.p).MethodByName(attr).IsValid() {
+			return fmt.Errorf("cannot assign to method %s of %s", attr, s)
+		}
+		return fmt.Errorf("Undefined property '%s' on %s", attr, s)
+	}
+	if err := convertible(f.Type()); err != nil {
+		return fmt.Errorf("field %s of %s: %s", attr, s, err)
+	}
+	v, err := toGo(x, f.Type())
+	if err != nil {
+		return fmt.Errorf("field %s of %s requires %s, not %s", attr, s, describe(f.Type()), x)
+	}
+	f.Set(v)
+	return nil
+}
+
+// field finds an exported field. It returns the zero Value if there is no such field.
+func (s Struct) field(attr string) (reflect.Value, error) {
+	v := reflect.ValueOf(s.p).Elem()
+	sf, ok := v.Type().FieldByName(attr)
+	if !ok {
+		return reflect.Value{}, nil
+	}
+	if !sf.IsExported() {
+		return reflect.Value{}, fmt.Errorf("field %s of %s is not exported", attr, s)
+	}
+	f, err := v.FieldByIndexErr(sf.Index)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("field %s of %s: %s", attr, s, err)
+	}
+	return f, nil
+}
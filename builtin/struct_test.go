@@ -0,0 +1,76 @@
+package builtin
+
+import (
+	"errors"
+	"github.com/jan-g/lox/value"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type point struct {
+	X, Y   float64
+	Label  string
+	Next   *point
+	hidden int
+}
+
+func (p *point) Move(dx, dy float64) *point {
+	p.X += dx
+	p.Y += dy
+	return p
+}
+
+func (p point) Check() error {
+	if p.X < 0 {
+		return errors.New("negative")
+	}
+	return nil
+}
+
+func TestStruct(t *testing.T) {
+	p := &point{X: 1, Y: 2, Label: "p"}
+	s, err := Wrap(p)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "<go builtin.point>", s.String())
+
+	v, err := s.Get("X")
+	assert.NoError(t, err)
+	assert.Equal(t, value.Num(1), v)
+	v, err = s.Get("Next")
+	assert.NoError(t, err)
+	assert.Equal(t, value.Nil, v)
+
+	assert.NoError(t, s.Set("Label", value.Str("q")))
+	assert.Equal(t, "q", p.Label)
+	assert.EqualError(t, s.Set("Label", value.Num(3)), "field Label of <go builtin.point> requires a string, not 3")
+	assert.NoError(t, s.Set("Next", s))
+	assert.Same(t, p, p.Next)
+
+	assert.EqualError(t, s.Set("hidden", value.Num(1)), "field hidden of <go builtin.point> is not exported")
+	_, err = s.Get("hidden")
+	assert.EqualError(t, err, "field hidden of <go builtin.point> is not exported")
+	_, err = s.Get("Z")
+	assert.EqualError(t, err, "Undefined property 'Z' on <go builtin.point>")
+	assert.EqualError(t, s.Set("Move", value.Nil), "cannot assign to method Move of <go builtin.point>")
+
+	m, err := s.Get("Move")
+	if assert.NoError(t, err) {
+		b := m.(*Builtin)
+		assert.Equal(t, "point.Move", b.Name)
+		assert.Equal(t, 2, b.Arity())
+		v, err = b.Builtin(nil, value.Num(-2), value.Num(1))
+		assert.NoError(t, err)
+		assert.Equal(t, s, v)
+		assert.Equal(t, point{X: -1, Y: 3, Label: "q", Next: p}, *p)
+	}
+	m, _ = s.Get("Check")
+	_, err = m.(*Builtin).Builtin(nil)
+	assert.EqualError(t, err, "negative")
+
+	_, err = Wrap(point{})
+	assert.Error(t, err)
+	_, err = Wrap((*point)(nil))
+	assert.Error(t, err)
+}
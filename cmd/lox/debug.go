@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/builtin"
+	"github.com/jan-g/lox/debug"
+	"github.com/jan-g/lox/eval"
+	"github.com/jan-g/lox/module"
+	"github.com/jan-g/lox/value"
+	"os"
+	"path/filepath"
+)
+
+// debugCmd implements `lox debug file.lox`, which runs a program on the
+// tree-walker under the interactive debugger.
+func debugCmd(args []string) {
+	fs := flag.NewFlagSet("debug", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		_, _ = fmt.Fprintln(os.Stderr, "usage: lox debug file.lox")
+		os.Exit(2)
+	}
+	if *useVM {
+		_, _ = fmt.Fprintln(os.Stderr, "the debugger only runs on the tree-walker")
+		os.Exit(2)
+	}
+
+	env := eval.New(os.Stdout)
+	env.SetHook(debug.New(os.Stdin, os.Stdout))
+	// Imported modules run without the debugger
+	l := module.NewLoader(func(l *module.Loader) value.Env {
+		e := eval.New(os.Stdout)
+		e.SetImporter(l)
+		return builtin.InitEnv(e)
+	}, builtin.Names(), filepath.SplitList(*modPath)...)
+	env.SetImporter(l)
+	s := &session{env: builtin.InitEnv(env), globals: builtin.Names(), loader: l}
+
+	fn := fs.Arg(0)
+	f, err := os.Open(fn)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err := s.run1(fn, f, false); err == debug.ErrQuit {
+		return
+	} else if err != nil {
+		report(err)
+		if _, ok := err.(ast.Diagnostics); ok {
+			os.Exit(65)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"github.com/jan-g/lox/printer"
+	"io"
+	"os"
+)
+
+// fmtCmd implements `lox fmt [-w] files...`: each file is printed in canonical form,
+// or rewritten in place. With no files, standard input is formatted.
+func fmtCmd(args []string) {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := fs.Bool("w", false, "write the result back to each file instead of to stdout")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		out, err := printer.Format("", os.Stdin)
+		if err != nil {
+			report(err)
+			os.Exit(65)
+		}
+		_, _ = os.Stdout.Write(out)
+		return
+	}
+
+	failed := false
+	for _, fn := range fs.Args() {
+		if err := fmt1(fn, *write, os.Stdout); err != nil {
+			report(err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(65)
+	}
+}
+
+func fmt1(fn string, write bool, w io.Writer) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	out, err := printer.Format(fn, f)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	if write {
+		return os.WriteFile(fn, out, 0644)
+	}
+	_, err = w.Write(out)
+	return err
+}
@@ -6,16 +6,25 @@ import (
 	"flag"
 	"fmt"
 	"github.com/jan-g/lox/analysis"
+	"github.com/jan-g/lox/ast"
 	"github.com/jan-g/lox/builtin"
+	"github.com/jan-g/lox/compile"
+	"github.com/jan-g/lox/dap"
 	"github.com/jan-g/lox/eval"
+	"github.com/jan-g/lox/lsp"
+	"github.com/jan-g/lox/module"
 	"github.com/jan-g/lox/parse"
 	"github.com/jan-g/lox/value"
+	"github.com/jan-g/lox/vm"
 	"io"
 	"os"
+	"path/filepath"
 )
 
 var (
 	listAst = flag.Bool("list", false, "show syntax")
+	useVM   = flag.Bool("vm", false, "run on the bytecode VM rather than the tree-walker")
+	modPath = flag.String("path", "", "directories to search for imported modules, separated by '"+string(os.PathListSeparator)+"'")
 )
 
 func main() {
@@ -23,14 +32,63 @@ func main() {
 
 	if len(flag.Args()) == 0 {
 		repl()
+	} else if flag.Arg(0) == "fmt" {
+		fmtCmd(flag.Args()[1:])
+	} else if flag.Arg(0) == "debug" {
+		debugCmd(flag.Args()[1:])
+	} else if flag.Arg(0) == "dap" {
+		if err := dap.NewAdapter(os.Stdin, os.Stdout).Serve(); err != nil {
+			report(err)
+			os.Exit(1)
+		}
+	} else if flag.Arg(0) == "lsp" {
+		if err := lsp.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+			report(err)
+			os.Exit(1)
+		}
 	} else {
 		run(flag.Args()...)
 	}
 }
 
+// session is an environment together with the global names declared in it so far,
+// so that the resolver accepts references to them from later input.
+type session struct {
+	env     value.Env
+	globals []string
+	loader  *module.Loader
+}
+
+// newSession starts a session on the chosen engine. The builtins, and any extra ones,
+// are bound both in the session and in each module that it imports.
+func newSession(extra ...*builtin.Builtin) *session {
+	names := builtin.Names()
+	for _, b := range extra {
+		names = append(names, b.Name)
+	}
+	l := module.NewLoader(func(l *module.Loader) value.Env {
+		var env value.Env
+		if *useVM {
+			v := vm.New(os.Stdout)
+			v.SetImporter(l)
+			env = v
+		} else {
+			e := eval.New(os.Stdout)
+			e.SetImporter(l)
+			env = e
+		}
+		builtin.InitEnv(env)
+		for _, b := range extra {
+			env.Bind(b.Name, b)
+		}
+		return env
+	}, names, filepath.SplitList(*modPath)...)
+	return &session{env: l.New(), globals: names, loader: l}
+}
+
 func repl() {
 	r := bufio.NewReader(os.Stdin)
-	env := builtin.InitEnv(eval.New(os.Stdout))
+	s := newSession()
 
 	for {
 		l, err := r.ReadBytes('\n')
@@ -40,8 +98,8 @@ func repl() {
 		if err != nil {
 			panic(err)
 		}
-		if err := run1(env, bytes.NewReader(l[:len(l)-1]), true); err != nil {
-			_, _ = fmt.Fprintln(os.Stderr, err.Error())
+		if err := s.run1("", bytes.NewReader(l[:len(l)-1]), true); err != nil {
+			report(err)
 		} /* else {
 			fmt.Println(v)
 		}*/
@@ -49,38 +107,68 @@ func repl() {
 }
 
 func run(in ...string) {
-	env := builtin.InitEnv(eval.New(os.Stdout))
+	s := newSession(builtin.Stdio(os.Stdin, os.Stderr)...)
+	failed := false
 	for _, fn := range in {
 		f, err := os.Open(fn)
 		if err != nil {
 			panic(err)
 		}
-		if err := run1(env, f, false); err != nil {
-			_, _ = fmt.Fprintln(os.Stderr, err.Error())
+		if err := s.run1(fn, f, false); err != nil {
+			report(err)
+			if _, ok := err.(ast.Diagnostics); ok {
+				failed = true
+			}
 		}
 		_ = f.Close()
 	}
+	if failed {
+		os.Exit(65)
+	}
 }
 
-func run1(env value.Env, in io.Reader, printAst bool) error {
-	p := parse.New(in)
-	ast, err := p.Parse()
-	if err != nil {
+// report prints an error; each diagnostic is given with the file and position it refers to.
+func report(err error) {
+	ds, ok := err.(ast.Diagnostics)
+	if !ok {
 		_, _ = fmt.Fprintln(os.Stderr, err.Error())
-		return err
+		return
 	}
-	if ast == nil {
-		return nil
+	for _, d := range ds {
+		if d.Loc.File != "" {
+			_, _ = fmt.Fprintf(os.Stderr, "%s: ", d.Loc.File)
+		}
+		_, _ = fmt.Fprintln(os.Stderr, d.Error())
+	}
+}
+
+func (s *session) run1(file string, in io.Reader, printAst bool) error {
+	p := parse.NewFile(file, in)
+	prog, err := p.Parse()
+	if err != nil {
+		return err
 	}
-	if err := analysis.Analyse(ast); err != nil {
+	if err := analysis.Analyse(prog, s.globals...); err != nil {
 		return err
 	}
+	s.globals = append(s.globals, analysis.Globals(prog)...)
 	if printAst || *listAst {
-		_, _ = fmt.Fprintf(os.Stderr, "%s\n", ast)
+		if *useVM {
+			fn, err := compile.Compile(prog, compile.NewGlobals())
+			if err != nil {
+				return err
+			}
+			fn.Disassemble(os.Stderr)
+		} else {
+			_, _ = fmt.Fprintf(os.Stderr, "%s\n", prog)
+		}
 		if *listAst {
 			return nil
 		}
 	}
 
-	return env.Run(ast)
+	if file != "" {
+		defer s.loader.Enter(file)()
+	}
+	return s.env.Run(prog)
 }
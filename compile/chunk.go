@@ -0,0 +1,264 @@
+package compile
+
+import (
+	"fmt"
+	"github.com/jan-g/lox/lex"
+	"github.com/jan-g/lox/value"
+	"io"
+	"strconv"
+)
+
+type OpCode byte
+
+const (
+	OpConstant OpCode = iota
+	OpNil
+	OpTrue
+	OpFalse
+	OpPop
+	OpGetLocal
+	OpSetLocal
+	OpGetGlobal
+	OpDefineGlobal
+	OpSetGlobal
+	OpGetUpvalue
+	OpSetUpvalue
+	OpGetProperty
+	OpSetProperty
+	OpGetSuper
+	OpEqual
+	OpNotEqual
+	OpGreater
+	OpGreaterEqual
+	OpLess
+	OpLessEqual
+	OpAdd
+	OpSubtract
+	OpMultiply
+	OpDivide
+	OpModulo
+	OpIntDivide
+	OpNot
+	OpNegate
+	OpPrint
+	OpJump
+	OpJumpIfFalse
+	OpLoop
+	OpCall
+	OpClosure
+	OpCloseUpvalue
+	OpReturn
+	OpClass
+	OpInherit
+	OpMethod
+	OpList
+	OpMap
+	OpGetIndex
+	OpSetIndex
+	OpThrow
+	OpTry
+	OpPopTry
+	OpCaught
+	OpRethrow
+	OpImport
+	OpInterpolate
+)
+
+var opNames = [...]string{
+	OpConstant:     "CONSTANT",
+	OpNil:          "NIL",
+	OpTrue:         "TRUE",
+	OpFalse:        "FALSE",
+	OpPop:          "POP",
+	OpGetLocal:     "GET_LOCAL",
+	OpSetLocal:     "SET_LOCAL",
+	OpGetGlobal:    "GET_GLOBAL",
+	OpDefineGlobal: "DEFINE_GLOBAL",
+	OpSetGlobal:    "SET_GLOBAL",
+	OpGetUpvalue:   "GET_UPVALUE",
+	OpSetUpvalue:   "SET_UPVALUE",
+	OpGetProperty:  "GET_PROPERTY",
+	OpSetProperty:  "SET_PROPERTY",
+	OpGetSuper:     "GET_SUPER",
+	OpEqual:        "EQUAL",
+	OpNotEqual:     "NOT_EQUAL",
+	OpGreater:      "GREATER",
+	OpGreaterEqual: "GREATER_EQUAL",
+	OpLess:         "LESS",
+	OpLessEqual:    "LESS_EQUAL",
+	OpAdd:          "ADD",
+	OpSubtract:     "SUBTRACT",
+	OpMultiply:     "MULTIPLY",
+	OpDivide:       "DIVIDE",
+	OpModulo:       "MODULO",
+	OpIntDivide:    "INT_DIVIDE",
+	OpNot:          "NOT",
+	OpNegate:       "NEGATE",
+	OpPrint:        "PRINT",
+	OpJump:         "JUMP",
+	OpJumpIfFalse:  "JUMP_IF_FALSE",
+	OpLoop:         "LOOP",
+	OpCall:         "CALL",
+	OpClosure:      "CLOSURE",
+	OpCloseUpvalue: "CLOSE_UPVALUE",
+	OpReturn:       "RETURN",
+	OpClass:        "CLASS",
+	OpInherit:      "INHERIT",
+	OpMethod:       "METHOD",
+	OpList:         "LIST",
+	OpMap:          "MAP",
+	OpGetIndex:     "GET_INDEX",
+	OpSetIndex:     "SET_INDEX",
+	OpThrow:        "THROW",
+	OpTry:          "TRY",
+	OpPopTry:       "POP_TRY",
+	OpCaught:       "CAUGHT",
+	OpRethrow:      "RETHROW",
+	OpImport:       "IMPORT",
+	OpInterpolate:  "INTERPOLATE",
+}
+
+func (op OpCode) String() string {
+	if int(op) < len(opNames) && opNames[op] != "" {
+		return opNames[op]
+	}
+	return fmt.Sprintf("?%d", op)
+}
+
+// A Chunk is a sequence of bytecode together with the constants it refers to.
+// Multi-byte operands are stored big-endian.
+type Chunk struct {
+	Code      []byte
+	Pos       []lex.Pos // source position of each byte in Code
+	Constants []value.Value
+	Globals   *Globals
+}
+
+// Globals assigns a stable index to each global name so that the VM can address
+// global variables directly rather than by name. A single table is shared by every
+// chunk that runs against the same set of globals.
+type Globals struct {
+	index map[string]int
+	Names []string
+}
+
+func NewGlobals() *Globals {
+	return &Globals{index: make(map[string]int)}
+}
+
+func (g *Globals) Slot(name string) int {
+	if i, ok := g.index[name]; ok {
+		return i
+	}
+	g.index[name] = len(g.Names)
+	g.Names = append(g.Names, name)
+	return len(g.Names) - 1
+}
+
+func (c *Chunk) write(b byte, at lex.Pos) {
+	c.Code = append(c.Code, b)
+	c.Pos = append(c.Pos, at)
+}
+
+func (c *Chunk) addConstant(v value.Value) int {
+	for i, k := range c.Constants {
+		if k == v {
+			return i
+		}
+	}
+	c.Constants = append(c.Constants, v)
+	return len(c.Constants) - 1
+}
+
+// ReadU16 decodes the two-byte operand at offset.
+func (c *Chunk) ReadU16(offset int) int {
+	return int(c.Code[offset])<<8 | int(c.Code[offset+1])
+}
+
+// Module is the constant operand of OpImport: a module path, and the file that imports it.
+type Module struct {
+	File string
+	Path string
+}
+
+func (m Module) String() string {
+	return strconv.Quote(m.Path)
+}
+
+// Function is the compiled form of a function body. The runtime wraps it in a closure.
+type Function struct {
+	Name          string
+	Arity         int
+	UpvalueCount  int
+	IsInitialiser bool
+	Chunk         Chunk
+}
+
+func (f *Function) String() string {
+	if f.Name == "" {
+		return "<fn>"
+	}
+	return fmt.Sprintf("<fn %s>", f.Name)
+}
+
+var _ value.Value = &Function{}
+
+// Disassemble writes a human-readable listing of the function and any functions nested within it.
+func (f *Function) Disassemble(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "== %s ==\n", f)
+	c := &f.Chunk
+	for offset := 0; offset < len(c.Code); {
+		offset = c.disassembleInstruction(w, offset)
+	}
+	for _, k := range c.Constants {
+		if fn, ok := k.(*Function); ok {
+			_, _ = fmt.Fprintln(w)
+			fn.Disassemble(w)
+		}
+	}
+}
+
+func (c *Chunk) disassembleInstruction(w io.Writer, offset int) int {
+	op := OpCode(c.Code[offset])
+	_, _ = fmt.Fprintf(w, "%04d %-14s", offset, op)
+	switch op {
+	case OpGetGlobal, OpDefineGlobal, OpSetGlobal:
+		g := c.ReadU16(offset + 1)
+		_, _ = fmt.Fprintf(w, " %4d %s\n", g, c.Globals.Names[g])
+		return offset + 3
+	case OpConstant,
+		OpGetProperty, OpSetProperty, OpGetSuper, OpClass, OpMethod, OpImport:
+		k := c.ReadU16(offset + 1)
+		_, _ = fmt.Fprintf(w, " %4d %s\n", k, c.Constants[k])
+		return offset + 3
+	case OpGetLocal, OpSetLocal, OpGetUpvalue, OpSetUpvalue, OpCall:
+		_, _ = fmt.Fprintf(w, " %4d\n", c.Code[offset+1])
+		return offset + 2
+	case OpList, OpMap, OpInterpolate:
+		_, _ = fmt.Fprintf(w, " %4d\n", c.ReadU16(offset+1))
+		return offset + 3
+	case OpJump, OpJumpIfFalse, OpTry:
+		_, _ = fmt.Fprintf(w, " %4d -> %d\n", offset, offset+3+c.ReadU16(offset+1))
+		return offset + 3
+	case OpLoop:
+		_, _ = fmt.Fprintf(w, " %4d -> %d\n", offset, offset+3-c.ReadU16(offset+1))
+		return offset + 3
+	case OpClosure:
+		k := c.ReadU16(offset + 1)
+		fn := c.Constants[k].(*Function)
+		_, _ = fmt.Fprintf(w, " %4d %s\n", k, fn)
+		offset += 3
+		for i := 0; i < fn.UpvalueCount; i++ {
+			kind := "upvalue"
+			if c.Code[offset] == 1 {
+				kind = "local"
+			}
+			_, _ = fmt.Fprintf(w, "%04d    |           %s %d\n", offset, kind, c.Code[offset+1])
+			offset += 2
+		}
+		return offset
+	default:
+		_, _ = fmt.Fprintln(w)
+		return offset + 1
+	}
+}
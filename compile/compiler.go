@@ -0,0 +1,713 @@
+package compile
+
+import (
+	"fmt"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/lex"
+	"github.com/jan-g/lox/value"
+	"math"
+)
+
+type funKind int
+
+const (
+	kindScript funKind = iota
+	kindFunction
+	kindMethod
+	kindInitialiser
+)
+
+type local struct {
+	name     string
+	depth    int
+	captured bool
+}
+
+// loop records the jumps that break and continue statements need patching to.
+type loop struct {
+	enclosing  *loop
+	scopeDepth int   // locals deeper than this belong to the loop body
+	breaks     []int // jumps to the end of the loop
+	continues  []int // jumps to the increment, or the loop condition
+}
+
+// tryBlock is a try statement whose handler is in force over the code being compiled.
+type tryBlock struct {
+	finally ast.Stmt // nil if there is none
+	locals  int      // the number of locals when the try statement began
+	loop    *loop    // the loop enclosing the try statement
+}
+
+type upvalue struct {
+	index   byte
+	isLocal bool
+}
+
+type compiler struct {
+	globals    *Globals
+	enclosing  *compiler
+	function   *Function
+	kind       funKind
+	locals     []local
+	upvalues   []upvalue
+	scopeDepth int
+	loop       *loop
+	tries      []*tryBlock
+	pos        lex.Pos // attributed to emitted code, for runtime errors
+}
+
+// Compile lowers an analysed program to bytecode. The result is the top-level script function.
+// Global names are allocated from g.
+func Compile(s ast.Stmt, g *Globals) (f *Function, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = e.(error)
+		}
+	}()
+	c := newCompiler(nil, g, kindScript, "", "")
+	c.stmt(s)
+	c.emitReturn()
+	return c.function, nil
+}
+
+func newCompiler(enclosing *compiler, g *Globals, kind funKind, name string, slot0 string) *compiler {
+	c := &compiler{
+		globals:   g,
+		enclosing: enclosing,
+		function:  &Function{Name: name, Chunk: Chunk{Globals: g}},
+		kind:      kind,
+	}
+	// Slot zero holds the callee: the receiver for methods, otherwise the closure itself.
+	c.locals = append(c.locals, local{name: slot0})
+	return c
+}
+
+func (c *compiler) chunk() *Chunk {
+	return &c.function.Chunk
+}
+
+func (c *compiler) emit(bs ...byte) {
+	for _, b := range bs {
+		c.chunk().write(b, c.pos)
+	}
+}
+
+func (c *compiler) emitOp(op OpCode) {
+	c.emit(byte(op))
+}
+
+func (c *compiler) emitU16(op OpCode, n int) {
+	c.emit(byte(op), byte(n>>8), byte(n))
+}
+
+func (c *compiler) emitConstant(v value.Value) {
+	c.emitU16(OpConstant, c.constant(v))
+}
+
+func (c *compiler) constant(v value.Value) int {
+	k := c.chunk().addConstant(v)
+	if k > math.MaxUint16 {
+		panic(fmt.Errorf("too many constants in one chunk"))
+	}
+	return k
+}
+
+func (c *compiler) name(n string) int {
+	return c.constant(value.Str(n))
+}
+
+func (c *compiler) global(n string) int {
+	g := c.globals.Slot(n)
+	if g > math.MaxUint16 {
+		panic(fmt.Errorf("too many global variables"))
+	}
+	return g
+}
+
+func (c *compiler) emitJump(op OpCode) int {
+	c.emit(byte(op), 0xff, 0xff)
+	return len(c.chunk().Code) - 2
+}
+
+func (c *compiler) patchJump(at int) {
+	jump := len(c.chunk().Code) - at - 2
+	if jump > math.MaxUint16 {
+		panic(fmt.Errorf("too much code to jump over"))
+	}
+	c.chunk().Code[at] = byte(jump >> 8)
+	c.chunk().Code[at+1] = byte(jump)
+}
+
+func (c *compiler) emitLoop(start int) {
+	jump := len(c.chunk().Code) - start + 3
+	if jump > math.MaxUint16 {
+		panic(fmt.Errorf("loop body too large"))
+	}
+	c.emitU16(OpLoop, jump)
+}
+
+func (c *compiler) emitReturn() {
+	c.emitReturnValue()
+	c.emitOp(OpReturn)
+}
+
+// emitReturnValue pushes the value of a bare return.
+func (c *compiler) emitReturnValue() {
+	if c.kind == kindInitialiser {
+		c.emit(byte(OpGetLocal), 0)
+	} else {
+		c.emitOp(OpNil)
+	}
+}
+
+func (c *compiler) beginScope() {
+	c.scopeDepth++
+}
+
+func (c *compiler) endScope() {
+	c.scopeDepth--
+	for len(c.locals) > 0 && c.locals[len(c.locals)-1].depth > c.scopeDepth {
+		if c.locals[len(c.locals)-1].captured {
+			c.emitOp(OpCloseUpvalue)
+		} else {
+			c.emitOp(OpPop)
+		}
+		c.locals = c.locals[:len(c.locals)-1]
+	}
+}
+
+// exitLoopScopes discards the locals of the loop body ahead of a break or continue.
+// The compiler's view of the scope is unchanged, since code after the jump may still use them.
+func (c *compiler) exitLoopScopes() {
+	for i := len(c.locals) - 1; i >= 0 && c.locals[i].depth > c.loop.scopeDepth; i-- {
+		if c.locals[i].captured {
+			c.emitOp(OpCloseUpvalue)
+		} else {
+			c.emitOp(OpPop)
+		}
+	}
+}
+
+// try compiles a try statement. A try handler is pushed by OpTry; if an error is raised
+// while it is in force, the VM unwinds to the handler's code with the error on the stack.
+// A finally block is compiled in several places: after the statement completes normally,
+// in the handler that rethrows an error, and ahead of any break, continue or return
+// that leaves the statement.
+func (c *compiler) try(s *ast.Try) {
+	var finallyHandler int
+	if s.Finally != nil {
+		finallyHandler = c.emitJump(OpTry)
+		c.tries = append(c.tries, &tryBlock{finally: s.Finally, locals: len(c.locals), loop: c.loop})
+	}
+	if s.Catch != nil {
+		catchHandler := c.emitJump(OpTry)
+		c.tries = append(c.tries, &tryBlock{locals: len(c.locals), loop: c.loop})
+		c.stmt(s.Body)
+		c.tries = c.tries[:len(c.tries)-1]
+		c.emitOp(OpPopTry)
+		done := c.emitJump(OpJump)
+
+		c.patchJump(catchHandler)
+		c.beginScope()
+		c.emitOp(OpCaught)
+		c.addLocal(s.CatchVar.VarName())
+		c.stmt(s.Catch)
+		c.endScope()
+		c.patchJump(done)
+	} else {
+		c.stmt(s.Body)
+	}
+	if s.Finally != nil {
+		c.tries = c.tries[:len(c.tries)-1]
+		c.emitOp(OpPopTry)
+		c.stmt(s.Finally)
+		done := c.emitJump(OpJump)
+
+		c.patchJump(finallyHandler)
+		// The error is held as an anonymous local, to be rethrown after the finally block
+		c.addLocal("")
+		c.stmt(s.Finally)
+		c.emitOp(OpRethrow)
+		c.locals = c.locals[:len(c.locals)-1]
+		c.patchJump(done)
+	}
+}
+
+// loopTries returns the index of the first try statement within the innermost loop.
+func (c *compiler) loopTries() int {
+	n := len(c.tries)
+	for n > 0 && c.tries[n-1].loop == c.loop {
+		n--
+	}
+	return n
+}
+
+// exitTries emits the code to leave the try statements from tries[n] inwards: each
+// handler is removed, and any finally block run, innermost first.
+func (c *compiler) exitTries(n int) {
+	tries, l := c.tries, c.loop
+	for i := len(tries) - 1; i >= n; i-- {
+		c.emitOp(OpPopTry)
+		if tries[i].finally == nil {
+			continue
+		}
+		// The finally block is compiled as if it followed the try statement: it can't
+		// see locals declared within the try, and break or continue apply to the loop
+		// around the statement.
+		hidden := make([]string, len(c.locals)-tries[i].locals)
+		for j := range hidden {
+			hidden[j] = c.locals[tries[i].locals+j].name
+			c.locals[tries[i].locals+j].name = ""
+		}
+		c.tries, c.loop = tries[:i], tries[i].loop
+		c.stmt(tries[i].finally)
+		for j, name := range hidden {
+			c.locals[tries[i].locals+j].name = name
+		}
+	}
+	c.tries, c.loop = tries, l
+}
+
+func (c *compiler) addLocal(name string) {
+	if len(c.locals) > math.MaxUint8 {
+		panic(fmt.Errorf("too many local variables in function"))
+	}
+	c.locals = append(c.locals, local{name: name, depth: c.scopeDepth})
+}
+
+// scopeLocal finds a local declared in the innermost scope. Lox permits redeclaration
+// within a scope; the new declaration reuses the existing slot so that closures
+// which captured the earlier binding observe the update.
+func (c *compiler) scopeLocal(name string) (int, bool) {
+	for i := len(c.locals) - 1; i >= 0 && c.locals[i].depth == c.scopeDepth; i-- {
+		if c.locals[i].name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (c *compiler) resolveLocal(name string) (int, bool) {
+	for i := len(c.locals) - 1; i >= 0; i-- {
+		if c.locals[i].name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (c *compiler) resolveUpvalue(name string) (int, bool) {
+	if c.enclosing == nil {
+		return 0, false
+	}
+	if i, ok := c.enclosing.resolveLocal(name); ok {
+		c.enclosing.locals[i].captured = true
+		return c.addUpvalue(byte(i), true), true
+	}
+	if i, ok := c.enclosing.resolveUpvalue(name); ok {
+		return c.addUpvalue(byte(i), false), true
+	}
+	return 0, false
+}
+
+func (c *compiler) addUpvalue(index byte, isLocal bool) int {
+	for i, u := range c.upvalues {
+		if u.index == index && u.isLocal == isLocal {
+			return i
+		}
+	}
+	if len(c.upvalues) > math.MaxUint8 {
+		panic(fmt.Errorf("too many closure variables in function"))
+	}
+	c.upvalues = append(c.upvalues, upvalue{index: index, isLocal: isLocal})
+	c.function.UpvalueCount = len(c.upvalues)
+	return len(c.upvalues) - 1
+}
+
+func (c *compiler) getVariable(name string) {
+	if i, ok := c.resolveLocal(name); ok {
+		c.emit(byte(OpGetLocal), byte(i))
+	} else if i, ok := c.resolveUpvalue(name); ok {
+		c.emit(byte(OpGetUpvalue), byte(i))
+	} else {
+		c.emitU16(OpGetGlobal, c.global(name))
+	}
+}
+
+func (c *compiler) setVariable(name string) {
+	if i, ok := c.resolveLocal(name); ok {
+		c.emit(byte(OpSetLocal), byte(i))
+	} else if i, ok := c.resolveUpvalue(name); ok {
+		c.emit(byte(OpSetUpvalue), byte(i))
+	} else {
+		c.emitU16(OpSetGlobal, c.global(name))
+	}
+}
+
+// defineVariable binds the value on top of the stack to name in the current scope.
+func (c *compiler) defineVariable(name string) {
+	if c.scopeDepth == 0 {
+		c.emitU16(OpDefineGlobal, c.global(name))
+		return
+	}
+	if i, ok := c.scopeLocal(name); ok {
+		c.emit(byte(OpSetLocal), byte(i))
+		c.emitOp(OpPop)
+		return
+	}
+	c.addLocal(name)
+}
+
+// declareSlot reserves a local for name ahead of its definition; it is a no-op for globals
+// and for names that already have a slot in the current scope.
+func (c *compiler) declareSlot(name string) {
+	if c.scopeDepth == 0 {
+		return
+	}
+	if _, ok := c.scopeLocal(name); ok {
+		return
+	}
+	c.emitOp(OpNil)
+	c.addLocal(name)
+}
+
+func (c *compiler) stmt(s ast.Stmt) {
+	switch s := s.(type) {
+	case ast.Program:
+		for _, ss := range s.Stmts {
+			c.stmt(ss)
+		}
+	case *ast.Print:
+		c.expr(s.Expr)
+		c.emitOp(OpPrint)
+	case *ast.Expression:
+		c.expr(s.Expr)
+		c.emitOp(OpPop)
+	case *ast.VarDecl:
+		// The initialiser is resolved before the new binding is visible.
+		c.expr(s.Expr)
+		c.defineVariable(s.VarName)
+	case *ast.FunDef:
+		name := s.Name.VarName()
+		c.declareSlot(name)
+		c.function_(kindFunction, name, "", s.Params, s.Body)
+		c.defineVariable(name)
+	case ast.ClassDef:
+		c.class(s)
+	case ast.Block:
+		c.beginScope()
+		// Function definitions are hoisted to permit mutual recursion within a block.
+		for _, ss := range s.Stmts {
+			if f, ok := ss.(*ast.FunDef); ok {
+				c.declareSlot(f.Name.VarName())
+			}
+		}
+		for _, ss := range s.Stmts {
+			c.stmt(ss)
+		}
+		c.endScope()
+	case *ast.If:
+		c.expr(s.Cond)
+		elseJump := c.emitJump(OpJumpIfFalse)
+		c.emitOp(OpPop)
+		c.stmt(s.Then)
+		endJump := c.emitJump(OpJump)
+		c.patchJump(elseJump)
+		c.emitOp(OpPop)
+		if s.Else != nil {
+			c.stmt(s.Else)
+		}
+		c.patchJump(endJump)
+	case *ast.While:
+		l := &loop{enclosing: c.loop, scopeDepth: c.scopeDepth}
+		c.loop = l
+		start := len(c.chunk().Code)
+		c.expr(s.Cond)
+		exitJump := c.emitJump(OpJumpIfFalse)
+		c.emitOp(OpPop)
+		c.stmt(s.Body)
+		for _, j := range l.continues {
+			c.patchJump(j)
+		}
+		if s.Incr != nil {
+			c.expr(s.Incr)
+			c.emitOp(OpPop)
+		}
+		c.emitLoop(start)
+		c.patchJump(exitJump)
+		c.emitOp(OpPop)
+		for _, j := range l.breaks {
+			c.patchJump(j)
+		}
+		c.loop = l.enclosing
+	case ast.Break:
+		c.exitTries(c.loopTries())
+		c.exitLoopScopes()
+		c.loop.breaks = append(c.loop.breaks, c.emitJump(OpJump))
+	case ast.Continue:
+		c.exitTries(c.loopTries())
+		c.exitLoopScopes()
+		c.loop.continues = append(c.loop.continues, c.emitJump(OpJump))
+	case *ast.Return:
+		if c.kind == kindInitialiser || s.Expr == nil {
+			c.emitReturnValue()
+		} else {
+			c.expr(s.Expr)
+		}
+		if len(c.tries) > 0 {
+			// The return value is held as an anonymous local while any finally blocks run
+			c.addLocal("")
+			c.exitTries(0)
+			c.locals = c.locals[:len(c.locals)-1]
+		}
+		c.emitOp(OpReturn)
+	case *ast.Throw:
+		c.expr(s.Expr)
+		c.pos = s.Span().Start
+		c.emitOp(OpThrow)
+	case *ast.Try:
+		c.try(s)
+	case *ast.Import:
+		c.import_(s)
+	default:
+		panic(fmt.Errorf("don't know how to compile stmt %s", s))
+	}
+}
+
+// import_ binds the module, or each of the names taken from it. The module is only run
+// by the first OpImport to name it.
+func (c *compiler) import_(s *ast.Import) {
+	c.pos = s.Span().Start
+	k := c.constant(Module{File: s.Span().File, Path: s.Path})
+	if s.As != nil {
+		c.emitU16(OpImport, k)
+		c.defineVariable(s.As.VarName())
+	}
+	for _, n := range s.Names {
+		c.pos = s.Span().Start
+		c.emitU16(OpImport, k)
+		c.pos = n.Span().Start
+		c.emitU16(OpGetProperty, c.name(n.VarName()))
+		c.defineVariable(n.VarName())
+	}
+}
+
+func (c *compiler) class(s ast.ClassDef) {
+	name := s.Name.VarName()
+	var slot int
+	isLocal := c.scopeDepth > 0
+	if isLocal {
+		var ok bool
+		if slot, ok = c.scopeLocal(name); !ok {
+			// The superclass expression must not see the new name, so the slot is
+			// reserved here but only named once that has been compiled.
+			slot = len(c.locals)
+			c.emitOp(OpNil)
+		}
+	}
+	if s.Superclass != nil {
+		c.pos = s.Superclass.Span().Start
+		c.getVariable(s.Superclass.VarName())
+	}
+	if isLocal && slot == len(c.locals) {
+		c.addLocal(name)
+	}
+	if s.Superclass != nil {
+		c.beginScope()
+		c.addLocal("super")
+	}
+	c.emitU16(OpClass, c.name(name))
+	if s.Superclass != nil {
+		c.pos = s.Superclass.Span().Start
+		c.emitOp(OpInherit)
+	}
+	for _, m := range s.Methods {
+		kind := kindMethod
+		if m.Name.VarName() == "init" {
+			kind = kindInitialiser
+		}
+		c.function_(kind, name+"."+m.Name.VarName(), "this", m.Params, m.Body)
+		c.emitU16(OpMethod, c.name(m.Name.VarName()))
+	}
+	if isLocal {
+		c.emit(byte(OpSetLocal), byte(slot))
+		c.emitOp(OpPop)
+	} else {
+		c.emitU16(OpDefineGlobal, c.global(name))
+	}
+	if s.Superclass != nil {
+		c.endScope()
+	}
+}
+
+func (c *compiler) function_(kind funKind, name string, slot0 string, params []ast.Var, body ast.Stmt) {
+	fc := newCompiler(c, c.globals, kind, name, slot0)
+	fc.function.Arity = len(params)
+	fc.function.IsInitialiser = kind == kindInitialiser
+	fc.beginScope()
+	for _, p := range params {
+		fc.addLocal(p.VarName())
+	}
+	fc.stmt(body)
+	fc.emitReturn()
+
+	c.emitU16(OpClosure, c.constant(fc.function))
+	for _, u := range fc.upvalues {
+		if u.isLocal {
+			c.emit(1, u.index)
+		} else {
+			c.emit(0, u.index)
+		}
+	}
+}
+
+var binOps = map[string]OpCode{
+	"+":   OpAdd,
+	"-":   OpSubtract,
+	"*":   OpMultiply,
+	"/":   OpDivide,
+	"%":   OpModulo,
+	"div": OpIntDivide,
+	"<":   OpLess,
+	"<=":  OpLessEqual,
+	">":   OpGreater,
+	">=":  OpGreaterEqual,
+	"==":  OpEqual,
+	"!=":  OpNotEqual,
+}
+
+func (c *compiler) expr(e ast.Expr) {
+	switch e := e.(type) {
+	case ast.StrLit:
+		c.emitConstant(value.Str(e.Value))
+	case ast.NLit:
+		c.emitConstant(value.Num(e.Value))
+	case ast.NilT:
+		c.emitOp(OpNil)
+	case ast.Bool:
+		if e.Value {
+			c.emitOp(OpTrue)
+		} else {
+			c.emitOp(OpFalse)
+		}
+	case *ast.UnOp:
+		c.expr(e.Arg)
+		c.pos = e.Pos
+		switch e.Op {
+		case "-":
+			c.emitOp(OpNegate)
+		case "!":
+			c.emitOp(OpNot)
+		default:
+			panic(fmt.Errorf("unhandled unary op %s", e))
+		}
+	case *ast.BinOp:
+		op, ok := binOps[e.Op]
+		if !ok {
+			panic(fmt.Errorf("unhandled binary op %s", e))
+		}
+		c.expr(e.Left)
+		c.expr(e.Right)
+		c.pos = e.Pos
+		c.emitOp(op)
+	case *ast.LogOp:
+		c.expr(e.First)
+		switch e.Op {
+		case "and":
+			end := c.emitJump(OpJumpIfFalse)
+			c.emitOp(OpPop)
+			c.expr(e.Second)
+			c.patchJump(end)
+		case "or":
+			elseJump := c.emitJump(OpJumpIfFalse)
+			end := c.emitJump(OpJump)
+			c.patchJump(elseJump)
+			c.emitOp(OpPop)
+			c.expr(e.Second)
+			c.patchJump(end)
+		default:
+			panic(fmt.Errorf("unhandled binary op %s", e))
+		}
+	case ast.Var:
+		c.pos = e.Span().Start
+		c.getVariable(e.VarName())
+	case ast.ThisT:
+		c.pos = e.Span().Start
+		c.getVariable(e.VarName())
+	case *ast.Assign:
+		c.expr(e.Rhs)
+		c.pos = e.Lhs.Span().Start
+		c.setVariable(e.Lhs.VarName())
+	case *ast.Call:
+		c.expr(e.Callee)
+		if len(e.Args) > math.MaxUint8 {
+			panic(fmt.Errorf("too many arguments in call"))
+		}
+		for _, a := range e.Args {
+			c.expr(a)
+		}
+		c.pos = e.Pos
+		c.emit(byte(OpCall), byte(len(e.Args)))
+	case *ast.Get:
+		c.expr(e.Object)
+		c.pos = e.Pos
+		c.emitU16(OpGetProperty, c.name(e.Attribute))
+	case *ast.Set:
+		c.expr(e.Object)
+		c.expr(e.Rhs)
+		c.pos = e.Pos
+		c.emitU16(OpSetProperty, c.name(e.Attribute))
+	case *ast.Interp:
+		if len(e.Parts) > math.MaxUint16 {
+			panic(fmt.Errorf("too many parts in interpolated string"))
+		}
+		for _, x := range e.Parts {
+			c.expr(x)
+		}
+		c.emitU16(OpInterpolate, len(e.Parts))
+	case *ast.ListLit:
+		if len(e.Elems) > math.MaxUint16 {
+			panic(fmt.Errorf("too many elements in list literal"))
+		}
+		for _, x := range e.Elems {
+			c.expr(x)
+		}
+		c.pos = e.Span().Start
+		c.emitU16(OpList, len(e.Elems))
+	case *ast.MapLit:
+		if len(e.Keys) > math.MaxUint16 {
+			panic(fmt.Errorf("too many entries in map literal"))
+		}
+		for i, k := range e.Keys {
+			c.expr(k)
+			c.expr(e.Values[i])
+		}
+		c.pos = e.Span().Start
+		c.emitU16(OpMap, len(e.Keys))
+	case *ast.Index:
+		c.expr(e.Object)
+		c.expr(e.Index)
+		c.pos = e.Pos
+		c.emitOp(OpGetIndex)
+	case *ast.SetIndex:
+		c.expr(e.Object)
+		c.expr(e.Index)
+		c.expr(e.Rhs)
+		c.pos = e.Pos
+		c.emitOp(OpSetIndex)
+	case *ast.Super:
+		c.pos = e.S.Span().Start
+		c.getVariable("this")
+		c.getVariable(e.S.VarName())
+		c.emitU16(OpGetSuper, c.name(e.Attribute))
+	case *ast.FunLit:
+		// A named literal can refer to itself: that name is given to slot zero.
+		name := ""
+		if e.Name != nil {
+			name = e.Name.VarName()
+		}
+		c.function_(kindFunction, name, name, e.Params, e.Body)
+	default:
+		panic(fmt.Errorf("unhandled expr %s", e))
+	}
+}
@@ -0,0 +1,547 @@
+// Package dap is a Debug Adapter Protocol server that runs a Lox program on the
+// tree-walking evaluator, controlling it through an eval.Hook.
+package dap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jan-g/lox/analysis"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/builtin"
+	"github.com/jan-g/lox/eval"
+	"github.com/jan-g/lox/module"
+	"github.com/jan-g/lox/parse"
+	"github.com/jan-g/lox/value"
+	"github.com/jan-g/lox/wire"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// errTerminated is raised through the program when the client disconnects.
+var errTerminated = errors.New("terminated")
+
+type mode int
+
+const (
+	modeStep     mode = iota // pause before the next statement
+	modeNext                 // pause before the next statement not in a deeper call
+	modeOut                  // pause once the current call has returned
+	modeContinue             // pause only at breakpoints
+	modeTerminate
+)
+
+// frame is the statement most recently started at a call depth, and its scope.
+type frame struct {
+	env  *eval.Env
+	stmt ast.Stmt
+}
+
+type Adapter struct {
+	in *bufio.Reader
+
+	mu  sync.Mutex // guards everything below, which the program's goroutine shares
+	out io.Writer
+	seq int
+
+	prog        ast.Program
+	file        string
+	stopOnEntry bool
+	noDebug     bool
+	running     bool
+	done        chan struct{} // closed when the program finishes
+
+	mode   mode
+	breaks map[string]map[int]bool // file to 1-based lines
+	frames []frame                 // indexed by call depth
+	last   frame                   // so that a breakpoint's line only pauses once
+	paused bool
+	stack  []value.Frame // at the pause
+	refs   []interface{} // what each variablesReference (less one) expands to, until resumed
+	resume chan mode
+}
+
+var _ eval.Hook = &Adapter{}
+
+func NewAdapter(in io.Reader, out io.Writer) *Adapter {
+	return &Adapter{
+		in:     bufio.NewReader(in),
+		out:    out,
+		breaks: make(map[string]map[int]bool),
+		resume: make(chan mode),
+		done:   make(chan struct{}),
+	}
+}
+
+// Serve handles requests until the client disconnects, or the input is closed.
+func (a *Adapter) Serve() error {
+	defer a.terminate()
+	for {
+		body, err := wire.ReadMessage(a.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var m message
+		if err := json.Unmarshal(body, &m); err != nil {
+			return err
+		}
+		if m.Type != "request" {
+			continue
+		}
+		result, err := a.handle(&m)
+		if err != nil {
+			a.respond(&m, false, err.Error(), nil)
+			continue
+		}
+		a.respond(&m, true, "", result)
+
+		// Some requests have effects that must follow their responses
+		switch m.Command {
+		case "initialize":
+			a.event("initialized", nil)
+		case "configurationDone":
+			a.start()
+		case "next":
+			a.proceed(modeNext)
+		case "stepIn":
+			a.proceed(modeStep)
+		case "stepOut":
+			a.proceed(modeOut)
+		case "continue":
+			a.proceed(modeContinue)
+		case "disconnect", "terminate":
+			return nil
+		}
+	}
+}
+
+func (a *Adapter) handle(m *message) (interface{}, error) {
+	switch m.Command {
+	case "initialize":
+		return Capabilities{SupportsConfigurationDoneRequest: true}, nil
+	case "launch":
+		var args LaunchArguments
+		if err := json.Unmarshal(m.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return nil, a.launch(args)
+	case "setBreakpoints":
+		var args SetBreakpointsArguments
+		if err := json.Unmarshal(m.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return a.setBreakpoints(args), nil
+	case "configurationDone":
+		if a.file == "" {
+			return nil, fmt.Errorf("no program has been launched")
+		}
+		return nil, nil
+	case "threads":
+		return ThreadsResponse{Threads: []Thread{{ID: threadID, Name: "main"}}}, nil
+	case "stackTrace":
+		return a.stackTrace()
+	case "scopes":
+		var args ScopesArguments
+		if err := json.Unmarshal(m.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return a.scopes(args.FrameID)
+	case "variables":
+		var args VariablesArguments
+		if err := json.Unmarshal(m.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return a.variables(args.VariablesReference)
+	case "next", "stepIn", "stepOut":
+		if !a.isPaused() {
+			return nil, fmt.Errorf("the program is not paused")
+		}
+		return nil, nil
+	case "continue":
+		if !a.isPaused() {
+			return nil, fmt.Errorf("the program is not paused")
+		}
+		return ContinueResponse{AllThreadsContinued: true}, nil
+	case "disconnect", "terminate":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request %s", m.Command)
+}
+
+func (a *Adapter) send(v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	// A client that has gone away will find out from the input
+	_ = wire.WriteMessage(a.out, body)
+}
+
+func (a *Adapter) respond(m *message, ok bool, msg string, result interface{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seq++
+	r := struct {
+		Seq        int             `json:"seq"`
+		Type       string          `json:"type"`
+		RequestSeq int             `json:"request_seq"`
+		Success    bool            `json:"success"`
+		Command    string          `json:"command"`
+		Message    string          `json:"message,omitempty"`
+		Body       json.RawMessage `json:"body,omitempty"`
+	}{Seq: a.seq, Type: "response", RequestSeq: m.Seq, Success: ok, Command: m.Command, Message: msg}
+	if result != nil {
+		r.Body, _ = json.Marshal(result)
+	}
+	a.send(r)
+}
+
+func (a *Adapter) event(name string, body interface{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.eventLocked(name, body)
+}
+
+func (a *Adapter) eventLocked(name string, body interface{}) {
+	a.seq++
+	e := struct {
+		Seq   int             `json:"seq"`
+		Type  string          `json:"type"`
+		Event string          `json:"event"`
+		Body  json.RawMessage `json:"body,omitempty"`
+	}{Seq: a.seq, Type: "event", Event: name}
+	if body != nil {
+		e.Body, _ = json.Marshal(body)
+	}
+	a.send(e)
+}
+
+// launch prepares the program; it starts once the client has finished configuration.
+func (a *Adapter) launch(args LaunchArguments) error {
+	src, err := os.ReadFile(args.Program)
+	if err != nil {
+		return err
+	}
+	file := filepath.Clean(args.Program)
+	prog, err := parse.NewFile(file, bytes.NewReader(src)).Parse()
+	if err == nil {
+		err = analysis.Analyse(prog, builtin.Names()...)
+	}
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prog = prog.(ast.Program)
+	a.file = file
+	a.stopOnEntry = args.StopOnEntry
+	a.noDebug = args.NoDebug
+	return nil
+}
+
+func (a *Adapter) setBreakpoints(args SetBreakpointsArguments) SetBreakpointsResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lines := make(map[int]bool)
+	r := SetBreakpointsResponse{Breakpoints: []Breakpoint{}}
+	for _, b := range args.Breakpoints {
+		lines[b.Line] = true
+		r.Breakpoints = append(r.Breakpoints, Breakpoint{Verified: true, Line: b.Line})
+	}
+	a.breaks[filepath.Clean(args.Source.Path)] = lines
+	return r
+}
+
+// output sends what the program prints to the client.
+type output struct {
+	a *Adapter
+}
+
+func (o output) Write(p []byte) (int, error) {
+	o.a.event("output", OutputEvent{Category: "stdout", Output: string(p)})
+	return len(p), nil
+}
+
+func (a *Adapter) start() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running {
+		return
+	}
+	a.running = true
+	env := eval.New(output{a})
+	if !a.noDebug {
+		env.SetHook(a)
+	}
+	// Imported modules run without breakpoints or stepping
+	l := module.NewLoader(func(l *module.Loader) value.Env {
+		e := eval.New(output{a})
+		e.SetImporter(l)
+		return builtin.InitEnv(e)
+	}, builtin.Names())
+	env.SetImporter(l)
+	if a.stopOnEntry {
+		a.mode = modeStep
+	} else {
+		a.mode = modeContinue
+	}
+	go func() {
+		defer close(a.done)
+		code := 0
+		defer l.Enter(a.file)()
+		err := builtin.InitEnv(env).Run(a.prog)
+		if err == errTerminated {
+			return
+		} else if err != nil {
+			a.event("output", OutputEvent{Category: "stderr", Output: err.Error() + "\n"})
+			code = 70
+		}
+		a.event("exited", ExitedEvent{ExitCode: code})
+		a.event("terminated", nil)
+	}()
+}
+
+// Before decides whether to pause the program before a statement, and if so, waits
+// for the client to resume it.
+func (a *Adapter) Before(env *eval.Env, s ast.Stmt) {
+	a.mu.Lock()
+	depth := env.Depth()
+	for len(a.frames) < depth {
+		// A call that has not yet started a statement of its own
+		a.frames = append(a.frames, a.frames[len(a.frames)-1])
+	}
+	here := frame{env: env, stmt: s}
+	a.frames = append(a.frames[:depth], here)
+	again := a.last.stmt != nil && a.last.env == env && line(a.last.stmt) == line(s)
+	a.last = here
+
+	reason := ""
+	atBreak := a.breaks[filepath.Clean(s.Span().File)][line(s)] && !again
+	switch {
+	case a.mode == modeTerminate:
+		a.mu.Unlock()
+		panic(errTerminated)
+	case a.mode == modeStep:
+		reason = "step"
+		if a.stack == nil && a.stopOnEntry {
+			reason = "entry"
+		}
+	case atBreak:
+		reason = "breakpoint"
+	case a.mode == modeNext && depth <= len(a.stack):
+		reason = "step"
+	case a.mode == modeOut && depth < len(a.stack):
+		reason = "step"
+	}
+	if reason == "" {
+		a.mu.Unlock()
+		return
+	}
+
+	a.paused = true
+	a.stack = env.Stack()
+	a.refs = nil
+	a.eventLocked("stopped", StoppedEvent{Reason: reason, ThreadID: threadID, AllThreadsStopped: true})
+	a.mu.Unlock()
+
+	m := <-a.resume
+	if m == modeTerminate {
+		panic(errTerminated)
+	}
+}
+
+func line(s ast.Stmt) int {
+	return s.Span().Start.Line + 1
+}
+
+func (a *Adapter) isPaused() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.paused
+}
+
+// proceed resumes a paused program.
+func (a *Adapter) proceed(m mode) {
+	a.mu.Lock()
+	if !a.paused {
+		a.mu.Unlock()
+		return
+	}
+	a.paused = false
+	a.mode = m
+	a.mu.Unlock()
+	a.resume <- m
+}
+
+// terminate stops the program, if it is running, and waits for it to finish. A program
+// run without debugging can't be stopped, and is left to itself.
+func (a *Adapter) terminate() {
+	a.mu.Lock()
+	running, paused, wait := a.running, a.paused, !a.noDebug
+	a.mode = modeTerminate
+	a.paused = false
+	a.mu.Unlock()
+	if !running {
+		return
+	}
+	if paused {
+		a.resume <- modeTerminate
+	}
+	if wait {
+		<-a.done
+	}
+}
+
+func (a *Adapter) stackTrace() (StackTraceResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.paused {
+		return StackTraceResponse{}, fmt.Errorf("the program is not paused")
+	}
+	r := StackTraceResponse{StackFrames: []StackFrame{}}
+	for i := 0; i <= len(a.stack); i++ {
+		f := a.frames[len(a.stack)-i]
+		name := "<main>"
+		if i < len(a.stack) {
+			name = a.stack[i].Function
+			if name == "" {
+				name = "<anonymous>"
+			}
+		}
+		loc := f.stmt.Span()
+		r.StackFrames = append(r.StackFrames, StackFrame{
+			ID:     i + 1,
+			Name:   name,
+			Source: &Source{Name: filepath.Base(loc.File), Path: loc.File},
+			Line:   loc.Start.Line + 1,
+			Column: loc.Start.Col + 1,
+		})
+	}
+	r.TotalFrames = len(r.StackFrames)
+	return r, nil
+}
+
+// The things that a variablesReference can expand to, besides values
+type (
+	locals  struct{ env *eval.Env }
+	globals struct{ env *eval.Env }
+)
+
+// ref allocates a variablesReference.
+func (a *Adapter) ref(x interface{}) int {
+	a.refs = append(a.refs, x)
+	return len(a.refs)
+}
+
+func (a *Adapter) scopes(id int) (ScopesResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.paused || id < 1 || id > len(a.stack)+1 {
+		return ScopesResponse{}, fmt.Errorf("no such frame %d", id)
+	}
+	env := a.frames[len(a.stack)-(id-1)].env
+	root := env
+	for root.Parent != nil {
+		root = root.Parent
+	}
+	return ScopesResponse{Scopes: []Scope{
+		{Name: "Locals", VariablesReference: a.ref(locals{env})},
+		{Name: "Globals", VariablesReference: a.ref(globals{root})},
+	}}, nil
+}
+
+func (a *Adapter) variables(ref int) (VariablesResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.paused || ref < 1 || ref > len(a.refs) {
+		return VariablesResponse{}, fmt.Errorf("no such variables reference %d", ref)
+	}
+	vs := []Variable{}
+	add := func(name string, v value.Value) {
+		vs = append(vs, Variable{Name: name, Value: show(v), VariablesReference: a.expand(v)})
+	}
+	switch x := a.refs[ref-1].(type) {
+	case locals:
+		// Innermost first, leaving out any that are shadowed
+		seen := make(map[string]bool)
+		for e := x.env; e.Parent != nil; e = e.Parent {
+			for _, v := range e.Variables() {
+				if !seen[v.Name] {
+					seen[v.Name] = true
+					add(v.Name, v.Value)
+				}
+			}
+		}
+	case globals:
+		for _, v := range x.env.Variables() {
+			if _, ok := v.Value.(*builtin.Builtin); !ok {
+				add(v.Name, v.Value)
+			}
+		}
+	case value.Instance:
+		names := make([]string, 0, len(x.Fields))
+		for name := range x.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			add(name, x.Fields[name])
+		}
+	case *value.Closure:
+		for e := x.ParentEnv.(*eval.Env); e.Parent != nil; e = e.Parent {
+			for _, v := range e.Variables() {
+				add(v.Name, v.Value)
+			}
+		}
+	case *value.List:
+		for i, v := range x.Elems {
+			add(strconv.Itoa(i), v)
+		}
+	case *value.Map:
+		for _, k := range x.Keys() {
+			v, _ := x.Get(k)
+			add(show(k), v)
+		}
+	}
+	return VariablesResponse{Variables: vs}, nil
+}
+
+// expand gives a variablesReference for a value with parts, or zero.
+func (a *Adapter) expand(v value.Value) int {
+	switch v := v.(type) {
+	case value.Instance:
+		if len(v.Fields) > 0 {
+			return a.ref(v)
+		}
+	case *value.Closure:
+		// A closure's environment is worth showing if it captures locals
+		if env, ok := v.ParentEnv.(*eval.Env); ok && env.Parent != nil {
+			return a.ref(v)
+		}
+	case *value.List:
+		if len(v.Elems) > 0 {
+			return a.ref(v)
+		}
+	case *value.Map:
+		if v.Len() > 0 {
+			return a.ref(v)
+		}
+	}
+	return 0
+}
+
+func show(v value.Value) string {
+	if s, ok := v.(value.Str); ok {
+		return strconv.Quote(string(s))
+	}
+	return v.String()
+}
@@ -0,0 +1,291 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/jan-g/lox/wire"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// client drives an Adapter in-process, as an editor would.
+type client struct {
+	t      *testing.T
+	w      io.WriteCloser
+	msgs   chan message // read in the background, so that the adapter never blocks writing
+	seq    int
+	events []message // received while waiting for a response
+	done   chan error
+}
+
+func newClient(t *testing.T) *client {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := &client{t: t, w: inW, msgs: make(chan message, 100), done: make(chan error, 1)}
+	go func() {
+		err := NewAdapter(inR, outW).Serve()
+		_ = outW.Close()
+		c.done <- err
+	}()
+	go func() {
+		defer close(c.msgs)
+		r := bufio.NewReader(outR)
+		for {
+			body, err := wire.ReadMessage(r)
+			if err != nil {
+				return
+			}
+			var m message
+			if err := json.Unmarshal(body, &m); err != nil {
+				t.Error(err)
+				return
+			}
+			c.msgs <- m
+		}
+	}()
+	return c
+}
+
+func (c *client) read() message {
+	m, ok := <-c.msgs
+	if !ok {
+		c.t.Fatal("the adapter has closed its output")
+	}
+	return m
+}
+
+// request sends a request, decodes the body of its response into result, and returns
+// the response.
+func (c *client) request(command string, args interface{}, result interface{}) message {
+	c.seq++
+	a, _ := json.Marshal(args)
+	body, _ := json.Marshal(message{Seq: c.seq, Type: "request", Command: command, Arguments: a})
+	if err := wire.WriteMessage(c.w, body); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		m := c.read()
+		if m.Type == "event" {
+			c.events = append(c.events, m)
+			continue
+		}
+		assert.Equal(c.t, c.seq, m.RequestSeq)
+		assert.Equal(c.t, command, m.Command)
+		if m.Success && result != nil {
+			if err := json.Unmarshal(m.Body, result); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return m
+	}
+}
+
+func (c *client) ok(command string, args interface{}, result interface{}) {
+	m := c.request(command, args, result)
+	assert.True(c.t, m.Success, "%s failed: %s", command, m.Message)
+}
+
+// event waits for the named event, and decodes its body into body.
+// Output events along the way are collected.
+func (c *client) event(name string, body interface{}) string {
+	out := ""
+	for {
+		var m message
+		if len(c.events) > 0 {
+			m, c.events = c.events[0], c.events[1:]
+		} else {
+			m = c.read()
+		}
+		if m.Event == name {
+			if body != nil {
+				if err := json.Unmarshal(m.Body, body); err != nil {
+					c.t.Fatal(err)
+				}
+			}
+			return out
+		}
+		if m.Event == "output" {
+			var o OutputEvent
+			_ = json.Unmarshal(m.Body, &o)
+			out += o.Output
+		}
+	}
+}
+
+const src = `class Point {
+  init(x, y) { this.x = x; this.y = y; }
+}
+fun scale(p, by) {
+  var q = Point(p.x * by, p.y * by);
+  return q;
+}
+var p = Point(1, 2);
+print p.x;
+var s = scale(p, 3);
+print s.y;
+`
+
+// launch starts src, with breakpoints at lines, and waits for it to stop.
+func launch(t *testing.T, c *client, stopOnEntry bool, lines ...int) string {
+	fn := filepath.Join(t.TempDir(), "test.lox")
+	if err := os.WriteFile(fn, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var caps Capabilities
+	c.ok("initialize", map[string]string{"adapterID": "lox"}, &caps)
+	assert.True(t, caps.SupportsConfigurationDoneRequest)
+	c.event("initialized", nil)
+	c.ok("launch", LaunchArguments{Program: fn, StopOnEntry: stopOnEntry}, nil)
+	bps := SetBreakpointsArguments{Source: Source{Path: fn}}
+	for _, l := range lines {
+		bps.Breakpoints = append(bps.Breakpoints, SourceBreakpoint{Line: l})
+	}
+	var r SetBreakpointsResponse
+	c.ok("setBreakpoints", bps, &r)
+	assert.Len(t, r.Breakpoints, len(lines))
+	c.ok("configurationDone", nil, nil)
+	return fn
+}
+
+func (c *client) stopped(reason string) string {
+	var e StoppedEvent
+	out := c.event("stopped", &e)
+	assert.Equal(c.t, reason, e.Reason)
+	return out
+}
+
+func (c *client) where() []StackFrame {
+	var st StackTraceResponse
+	c.ok("stackTrace", StackTraceArguments{ThreadID: threadID}, &st)
+	return st.StackFrames
+}
+
+func (c *client) variables(ref int) map[string]Variable {
+	var r VariablesResponse
+	c.ok("variables", VariablesArguments{VariablesReference: ref}, &r)
+	vs := make(map[string]Variable)
+	for _, v := range r.Variables {
+		vs[v.Name] = v
+	}
+	return vs
+}
+
+func TestBreakpointsAndVariables(t *testing.T) {
+	c := newClient(t)
+	launch(t, c, false, 6)
+	assert.Equal(t, "1\n", c.stopped("breakpoint"))
+
+	var threads ThreadsResponse
+	c.ok("threads", nil, &threads)
+	assert.Equal(t, []Thread{{ID: threadID, Name: "main"}}, threads.Threads)
+
+	frames := c.where()
+	if assert.Len(t, frames, 2) {
+		assert.Equal(t, "scale", frames[0].Name)
+		assert.Equal(t, 6, frames[0].Line)
+		assert.Equal(t, "<main>", frames[1].Name)
+		assert.Equal(t, 10, frames[1].Line)
+	}
+
+	var scopes ScopesResponse
+	c.ok("scopes", ScopesArguments{FrameID: frames[0].ID}, &scopes)
+	if !assert.Len(t, scopes.Scopes, 2) {
+		return
+	}
+	locals := c.variables(scopes.Scopes[0].VariablesReference)
+	assert.Equal(t, "3", locals["by"].Value)
+	assert.Equal(t, "<instance Point>", locals["q"].Value)
+
+	// Instances expand to their fields
+	q := c.variables(locals["q"].VariablesReference)
+	assert.Equal(t, "3", q["x"].Value)
+	assert.Equal(t, "6", q["y"].Value)
+
+	globals := c.variables(scopes.Scopes[1].VariablesReference)
+	assert.Contains(t, globals, "p")
+	assert.Contains(t, globals, "scale")
+	assert.NotContains(t, globals, "len")
+
+	c.ok("continue", nil, nil)
+	assert.Equal(t, "6\n", c.event("exited", nil))
+	c.event("terminated", nil)
+	c.ok("disconnect", nil, nil)
+	assert.NoError(t, <-c.done)
+}
+
+func TestStepping(t *testing.T) {
+	c := newClient(t)
+	launch(t, c, true)
+	c.stopped("entry")
+	assert.Equal(t, 1, c.where()[0].Line)
+
+	c.ok("next", nil, nil)
+	c.stopped("step")
+	assert.Equal(t, 4, c.where()[0].Line)
+	c.ok("next", nil, nil)
+	c.stopped("step")
+	assert.Equal(t, 8, c.where()[0].Line)
+
+	// Into the initialiser
+	c.ok("stepIn", nil, nil)
+	c.stopped("step")
+	frames := c.where()
+	assert.Equal(t, 2, frames[0].Line)
+	assert.Equal(t, "Point.init", frames[0].Name)
+
+	c.ok("stepOut", nil, nil)
+	c.stopped("step")
+	assert.Equal(t, 9, c.where()[0].Line)
+
+	c.ok("next", nil, nil)
+	assert.Equal(t, "1\n", c.stopped("step"))
+	assert.Equal(t, 10, c.where()[0].Line)
+
+	// Disconnecting stops the program where it is
+	c.ok("disconnect", nil, nil)
+	assert.NoError(t, <-c.done)
+}
+
+func TestClosureEnvironment(t *testing.T) {
+	c := newClient(t)
+	fn := filepath.Join(t.TempDir(), "closure.lox")
+	if err := os.WriteFile(fn, []byte("fun counter() {\n  var n = 0;\n  fun bump() { n = n + 1; return n; }\n  return bump;\n}\nvar c = counter();\nc();\nprint c();\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.ok("initialize", nil, nil)
+	c.ok("launch", LaunchArguments{Program: fn}, nil)
+	c.ok("setBreakpoints", SetBreakpointsArguments{Source: Source{Path: fn}, Breakpoints: []SourceBreakpoint{{Line: 8}}}, nil)
+	c.ok("configurationDone", nil, nil)
+	c.stopped("breakpoint")
+
+	var scopes ScopesResponse
+	c.ok("scopes", ScopesArguments{FrameID: 1}, &scopes)
+	globals := c.variables(scopes.Scopes[1].VariablesReference)
+	cl := globals["c"]
+	if assert.NotZero(t, cl.VariablesReference) {
+		env := c.variables(cl.VariablesReference)
+		assert.Equal(t, "1", env["n"].Value)
+	}
+
+	m := c.request("variables", VariablesArguments{VariablesReference: 99}, nil)
+	assert.False(t, m.Success)
+	c.ok("disconnect", nil, nil)
+	assert.NoError(t, <-c.done)
+}
+
+func TestLaunchErrors(t *testing.T) {
+	c := newClient(t)
+	fn := filepath.Join(t.TempDir(), "bad.lox")
+	if err := os.WriteFile(fn, []byte("print x;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.ok("initialize", nil, nil)
+	m := c.request("launch", LaunchArguments{Program: fn}, nil)
+	assert.False(t, m.Success)
+	assert.Equal(t, "undefined variable: x [0,6]", m.Message)
+	c.ok("disconnect", nil, nil)
+	assert.NoError(t, <-c.done)
+}
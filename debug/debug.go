@@ -0,0 +1,227 @@
+// Package debug is an interactive, line-oriented debugger for the tree-walking evaluator.
+package debug
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/eval"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrQuit is raised through the program when the user quits the debugger.
+var ErrQuit = errors.New("quit")
+
+type mode int
+
+const (
+	modeStep     mode = iota // pause before the next statement
+	modeNext                 // pause before the next statement not in a deeper call
+	modeFinish               // pause once the current call has returned
+	modeContinue             // pause only at breakpoints
+	modeDetached             // never pause again
+)
+
+type breakpoint struct {
+	file string
+	line int // 1-based, as shown to the user
+}
+
+type position struct {
+	file  string
+	line  int
+	depth int
+}
+
+// Debugger is an eval.Hook that pauses the program and reads commands.
+type Debugger struct {
+	in     *bufio.Scanner
+	out    io.Writer
+	mode   mode
+	depth  int // the call depth at the last pause, for next and finish
+	breaks map[breakpoint]bool
+	last   position // of the last statement seen, so that one line only breaks once
+	files  map[string][]string
+}
+
+var _ eval.Hook = &Debugger{}
+
+// New returns a Debugger that will pause before the first statement.
+func New(in io.Reader, out io.Writer) *Debugger {
+	return &Debugger{
+		in:     bufio.NewScanner(in),
+		out:    out,
+		mode:   modeStep,
+		breaks: make(map[breakpoint]bool),
+		files:  make(map[string][]string),
+	}
+}
+
+// Break sets a breakpoint before the statements that start on a line of a file.
+func (d *Debugger) Break(file string, line int) {
+	d.breaks[breakpoint{file: filepath.Clean(file), line: line}] = true
+}
+
+func (d *Debugger) Before(env *eval.Env, s ast.Stmt) {
+	loc := s.Span()
+	here := position{file: filepath.Clean(loc.File), line: loc.Start.Line + 1, depth: env.Depth()}
+	again := here == d.last
+	d.last = here
+
+	switch d.mode {
+	case modeDetached:
+		return
+	case modeNext:
+		if here.depth > d.depth && !d.breaks[breakpoint{here.file, here.line}] {
+			return
+		}
+	case modeFinish:
+		if here.depth >= d.depth && !d.breaks[breakpoint{here.file, here.line}] {
+			return
+		}
+	case modeContinue:
+		if again || !d.breaks[breakpoint{here.file, here.line}] {
+			return
+		}
+	}
+	d.pause(env, s, here)
+}
+
+func (d *Debugger) printf(msg string, xs ...interface{}) {
+	_, _ = fmt.Fprintf(d.out, msg, xs...)
+}
+
+func (d *Debugger) pause(env *eval.Env, s ast.Stmt, here position) {
+	d.depth = here.depth
+	d.show(s, here)
+	for {
+		d.printf("(lox) ")
+		if !d.in.Scan() {
+			// Without any more commands, let the program run to the end
+			d.printf("\n")
+			d.mode = modeDetached
+			return
+		}
+		words := strings.Fields(d.in.Text())
+		if len(words) == 0 {
+			continue
+		}
+		switch cmd, args := words[0], words[1:]; cmd {
+		case "s", "step":
+			d.mode = modeStep
+			return
+		case "n", "next":
+			d.mode = modeNext
+			return
+		case "f", "finish":
+			if here.depth == 0 {
+				d.printf("not in a function\n")
+				continue
+			}
+			d.mode = modeFinish
+			return
+		case "c", "continue":
+			d.mode = modeContinue
+			return
+		case "b", "break":
+			if bp, err := d.parseBreak(args, here.file); err != nil {
+				d.printf("%s\n", err)
+			} else {
+				d.breaks[bp] = true
+				d.printf("breakpoint at %s:%d\n", bp.file, bp.line)
+			}
+		case "clear":
+			if bp, err := d.parseBreak(args, here.file); err != nil {
+				d.printf("%s\n", err)
+			} else if !d.breaks[bp] {
+				d.printf("no breakpoint at %s:%d\n", bp.file, bp.line)
+			} else {
+				delete(d.breaks, bp)
+			}
+		case "bt", "stack":
+			d.printf("#0 %s:%d\n", here.file, here.line)
+			for i, f := range env.Stack() {
+				d.printf("#%d %s\n", i+1, f)
+			}
+		case "p", "print":
+			if len(args) != 1 {
+				d.printf("usage: print NAME\n")
+			} else if v, ok := env.Find(args[0]); ok {
+				d.printf("%s = %s\n", args[0], v)
+			} else {
+				d.printf("%s is not defined\n", args[0])
+			}
+		case "locals":
+			for e := env; e.Parent != nil; e = e.Parent {
+				for _, v := range e.Variables() {
+					d.printf("%s = %s\n", v.Name, v.Value)
+				}
+			}
+		case "l", "list":
+			d.show(s, here)
+		case "q", "quit":
+			d.mode = modeDetached
+			panic(ErrQuit)
+		case "h", "help":
+			d.printf("%s", help)
+		default:
+			d.printf("unknown command %q; try help\n", cmd)
+		}
+	}
+}
+
+const help = `break [FILE:]LINE  pause before line LINE
+clear [FILE:]LINE  remove a breakpoint
+step               run to the next statement
+next               run to the next statement, stepping over calls
+finish             run until the current function returns
+continue           run to the next breakpoint
+bt                 show the call stack
+print NAME         show a variable
+locals             show the local variables
+list               show the current line
+quit               stop the program
+`
+
+func (d *Debugger) parseBreak(args []string, file string) (breakpoint, error) {
+	if len(args) != 1 {
+		return breakpoint{}, fmt.Errorf("usage: break [FILE:]LINE")
+	}
+	spec := args[0]
+	if i := strings.LastIndexByte(spec, ':'); i >= 0 {
+		file, spec = filepath.Clean(spec[:i]), spec[i+1:]
+	}
+	line, err := strconv.Atoi(spec)
+	if err != nil || line < 1 {
+		return breakpoint{}, fmt.Errorf("bad line number %q", spec)
+	}
+	return breakpoint{file: file, line: line}, nil
+}
+
+// show prints the source line that the program is paused at.
+func (d *Debugger) show(s ast.Stmt, here position) {
+	text := strings.TrimSpace(s.String())
+	if lines, ok := d.source(here.file); ok && here.line <= len(lines) {
+		text = strings.TrimSpace(lines[here.line-1])
+	}
+	d.printf("%s:%d: %s\n", here.file, here.line, text)
+}
+
+func (d *Debugger) source(file string) ([]string, bool) {
+	if lines, ok := d.files[file]; ok {
+		return lines, lines != nil
+	}
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		d.files[file] = nil
+		return nil, false
+	}
+	lines := strings.Split(string(bs), "\n")
+	d.files[file] = lines
+	return lines, true
+}
@@ -0,0 +1,85 @@
+package debug
+
+import (
+	"bytes"
+	"github.com/jan-g/lox/analysis"
+	"github.com/jan-g/lox/builtin"
+	"github.com/jan-g/lox/eval"
+	"github.com/jan-g/lox/parse"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const src = `fun counter() {
+  var n = 0;
+  fun bump(by) {
+    n = n + by;
+    return n;
+  }
+  return bump;
+}
+var c = counter();
+c(1);
+print c(2);
+`
+
+// session runs src under the debugger, with commands as its input, and returns
+// the program's output interleaved with the debugger's.
+func session(t *testing.T, commands string) (string, error) {
+	fn := filepath.Join(t.TempDir(), "test.lox")
+	if err := os.WriteFile(fn, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prog, err := parse.NewFile(fn, strings.NewReader(src)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := analysis.Analyse(prog, builtin.Names()...); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	env := eval.New(out)
+	env.SetHook(New(strings.NewReader(commands), out))
+	err = builtin.InitEnv(env).Run(prog)
+	return strings.ReplaceAll(out.String(), fn, "test.lox"), err
+}
+
+func TestBreakpoints(t *testing.T) {
+	out, err := session(t, "break 4\ncontinue\nbt\nprint n\nprint by\nlocals\nclear 4\ncontinue\n")
+	assert.NoError(t, err)
+	assert.Equal(t, `test.lox:1: fun counter() {
+(lox) breakpoint at test.lox:4
+(lox) test.lox:4: n = n + by;
+(lox) #0 test.lox:4
+#1 in bump called at [9,1]
+(lox) n = 0
+(lox) by = 1
+(lox) by = 1
+bump = <closure of arity 1>
+n = 0
+(lox) (lox) 3
+`, out)
+}
+
+func TestStepping(t *testing.T) {
+	out, err := session(t, "next\nnext\nstep\nstep\nstep\nstep\nfinish\n")
+	assert.NoError(t, err)
+	assert.Equal(t, `test.lox:1: fun counter() {
+(lox) test.lox:9: var c = counter();
+(lox) test.lox:10: c(1);
+(lox) test.lox:4: n = n + by;
+(lox) test.lox:5: return n;
+(lox) test.lox:11: print c(2);
+(lox) test.lox:4: n = n + by;
+(lox) 3
+`, out)
+}
+
+func TestQuit(t *testing.T) {
+	out, err := session(t, "next\nquit\n")
+	assert.Equal(t, ErrQuit, err)
+	assert.Equal(t, "test.lox:1: fun counter() {\n(lox) test.lox:9: var c = counter();\n(lox) ", out)
+}
@@ -0,0 +1,78 @@
+package eval
+
+import (
+	"github.com/jan-g/lox/analysis"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/builtin"
+	"github.com/jan-g/lox/parse"
+	"io"
+	"strings"
+	"testing"
+)
+
+func prepare(b testing.TB, src string) ast.Stmt {
+	p := parse.New(strings.NewReader(src))
+	prog, err := p.Parse()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := analysis.Analyse(prog, builtin.Names()...); err != nil {
+		b.Fatal(err)
+	}
+	return prog
+}
+
+func bench(b *testing.B, src string) {
+	prog := prepare(b, src)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		env := builtin.InitEnv(New(io.Discard))
+		if err := env.Run(prog); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFibRecursive(b *testing.B) {
+	bench(b, `
+fun fib(n) {
+  if (n < 2) return n;
+  return fib(n - 1) + fib(n - 2);
+}
+print fib(20);
+`)
+}
+
+func BenchmarkFibLoop(b *testing.B) {
+	bench(b, `
+fun fib(n) {
+  var a = 0;
+  var b = 1;
+  for (var i = 0; i < n; i = i + 1) {
+    var t = a + b;
+    a = b;
+    b = t;
+  }
+  return a;
+}
+for (var i = 0; i < 1000; i = i + 1) fib(100);
+`)
+}
+
+func BenchmarkClosureCounter(b *testing.B) {
+	bench(b, `
+fun counter() {
+  var i = 0;
+  fun count() {
+    i = i + 1;
+    return i;
+  }
+  return count;
+}
+{
+  var c = counter();
+  var n = 0;
+  while (n < 100000) n = c();
+}
+`)
+}
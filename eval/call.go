@@ -3,6 +3,7 @@ package eval
 import (
 	"fmt"
 	"github.com/jan-g/lox/builtin"
+	"github.com/jan-g/lox/lex"
 	"github.com/jan-g/lox/value"
 )
 
@@ -14,22 +15,46 @@ func (WrappedReturn) Error() string {
 	return "return not from enclosing function"
 }
 
-func (e *Env) call(target value.Callable, initialising bool, args ...value.Value) value.Value {
+// loopControl is returned by Exec to unwind to the innermost enclosing loop.
+type loopControl string
+
+const (
+	errBreak    loopControl = "break"
+	errContinue loopControl = "continue"
+)
+
+func (l loopControl) Error() string {
+	return fmt.Sprintf("%s not enclosed by loop", string(l))
+}
+
+func (e *Env) call(at lex.Pos, target value.Callable, initialising bool, args ...value.Value) value.Value {
 	if target.Arity() != len(args) {
-		panic(fmt.Errorf("%s required %d args, %d given", target, target.Arity(), len(args)))
+		panic(e.errorAt(at, "%s required %d args, %d given", target, target.Arity(), len(args)))
 	}
 
 	switch target := target.(type) {
 	case *builtin.Builtin:
-		return target.Builtin(e, args...)
+		v, err := target.Builtin(e, args...)
+		if err != nil {
+			panic(e.errorAt(at, "%s", err))
+		}
+		return v
 
 	case *value.Closure:
 		if !initialising && target.IsInitialiser {
-			return target.ParentEnv.Lookup(0, "this")
+			return target.ParentEnv.Lookup(0, 0, "this")
 		}
+		if len(e.root.frames) >= e.root.maxDepth {
+			panic(e.errorAt(at, "stack overflow"))
+		}
+		e.root.frames = append(e.root.frames, value.Frame{Function: target.Name, Call: at})
+		defer func() {
+			e.root.frames = e.root.frames[:len(e.root.frames)-1]
+		}()
 		e2 := target.ParentEnv.Child()
 		for i, f := range target.Formals {
-			e2.Bind(f.VarName(), args[i])
+			e2.Define(f.Slot, args[i])
+			e2.(*Env).name(f.Slot, f.VarName())
 		}
 		err := e2.Run(target.Body)
 		if v, ok := err.(WrappedReturn); ok {
@@ -42,14 +67,28 @@ func (e *Env) call(target value.Callable, initialising bool, args ...value.Value
 	case value.Class:
 		inst, err := value.Instantiate(target)
 		if err != nil {
-			panic(err)
+			panic(e.errorAt(at, "%s", err))
 		}
 		if init, err := target.FindMethod("init"); err == nil {
-			e.call(value.Bind(inst, init), true, args...)
+			e.call(at, value.Bind(inst, init), true, args...)
 		}
 		return inst
 
 	default:
-		panic(fmt.Errorf("don't know how to call %s", target))
+		panic(e.errorAt(at, "don't know how to call %s", target))
+	}
+}
+
+// Call calls a Lox function or class, or a builtin, from Go.
+func (env *Env) Call(f value.Value, args ...value.Value) (result value.Value, err error) {
+	target, ok := f.(value.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s is not callable", f)
 	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	return env.call(value.FromHost, target, false, args...), nil
 }
@@ -3,14 +3,25 @@ package eval
 import (
 	"fmt"
 	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/lex"
 	"github.com/jan-g/lox/value"
 	"io"
+	"strings"
 )
 
 type Env struct {
 	Out      io.Writer
 	Parent   *Env
-	Bindings map[string]value.Value
+	Slots    []value.Value          // locals, indexed by the slots assigned in analysis
+	Bindings map[string]value.Value // globals; only the root Env has these
+	root     *Env
+	frames   []value.Frame  // the call stack; only the root Env has this
+	hook     Hook           // only on the root Env
+	importer value.Importer // only on the root Env
+	budget   *budget        // only on the root Env, and only if there are limits to check
+	maxDepth int            // of calls; only on the root Env
+	names    []string       // of the locals in Slots, recorded only when there is a hook
+	inline   [4]value.Value // backing for Slots, which saves an allocation for most scopes
 }
 
 var _ value.Env = &Env{}
@@ -19,51 +30,103 @@ func (e *Env) Child() value.Env {
 	return New(e.Out, e)
 }
 
+// Bind creates or replaces a global.
 func (env *Env) Bind(name string, v value.Value) {
-	env.Bindings[name] = v
+	env.root.Bindings[name] = v
 }
 
-func (env *Env) Lookup(depth int, name string) value.Value {
+// Define sets a local in this scope.
+func (env *Env) Define(slot int, v value.Value) {
+	for len(env.Slots) <= slot {
+		env.Slots = append(env.Slots, nil)
+	}
+	env.Slots[slot] = v
+}
+
+func (env *Env) define(slot int, name string, v value.Value) {
+	if slot == ast.Global {
+		env.Bind(name, v)
+	} else {
+		env.Define(slot, v)
+		env.name(slot, name)
+	}
+}
+
+func (env *Env) Lookup(depth int, slot int, name string) value.Value {
+	if v, ok := env.lookup(depth, slot, name); ok {
+		return v
+	}
+	panic(fmt.Errorf("unbound variable: %s", name))
+}
+
+func (env *Env) lookup(depth int, slot int, name string) (value.Value, bool) {
+	if depth == ast.Global {
+		v, ok := env.root.Bindings[name]
+		return v, ok
+	}
 	for depth > 0 {
 		env = env.Parent
 		depth--
 	}
 
-	v, ok := env.Bindings[name]
-	if ok {
-		return v
+	if slot < len(env.Slots) && env.Slots[slot] != nil {
+		return env.Slots[slot], true
+	}
+	return nil, false
+}
+
+func (env *Env) Assign(depth int, slot int, name string, v value.Value) {
+	if !env.assign(depth, slot, name, v) {
+		panic(fmt.Errorf("cannot update unbound variable: %s", name))
 	}
-	panic(fmt.Errorf("unbound variable: %s", name))
 }
 
-func (env *Env) Assign(depth int, name string, v value.Value) {
+func (env *Env) assign(depth int, slot int, name string, v value.Value) bool {
+	if depth == ast.Global {
+		if _, ok := env.root.Bindings[name]; ok {
+			env.root.Bindings[name] = v
+			return true
+		}
+		return false
+	}
 	for depth > 0 {
 		env = env.Parent
 		depth--
 	}
 
-	_, ok := env.Bindings[name]
-	if ok {
-		env.Bindings[name] = v
-		return
+	if slot < len(env.Slots) && env.Slots[slot] != nil {
+		env.Slots[slot] = v
+		return true
 	}
+	return false
+}
 
-	panic(fmt.Errorf("cannot update unbound variable: %s", name))
+// errorAt builds a RuntimeError for a failure at the given position, capturing the current call stack.
+func (env *Env) errorAt(at lex.Pos, msg string, xs ...interface{}) *value.RuntimeError {
+	return &value.RuntimeError{
+		Pos:     at,
+		Message: fmt.Sprintf(msg, xs...),
+		Stack:   env.Stack(),
+	}
 }
 
 func New(out io.Writer, parent ...*Env) *Env {
 	if len(parent) > 1 {
 		panic("can only call New with 0 or 1 items")
 	}
-	var p *Env
-	if len(parent) == 1 {
-		p = parent[0]
+	e := &Env{
+		Out: out,
 	}
-	return &Env{
-		Out:      out,
-		Parent:   p,
-		Bindings: make(map[string]value.Value),
+	e.Slots = e.inline[:0]
+	if len(parent) == 1 {
+		e.Parent = parent[0]
+		e.root = parent[0].root
+	} else {
+		e.Bindings = make(map[string]value.Value)
+		e.root = e
+		e.maxDepth = MaxDepth
 	}
+	return e
 }
 
 func (env *Env) Run(e ast.Stmt) (err error) {
@@ -78,9 +141,19 @@ func (env *Env) Run(e ast.Stmt) (err error) {
 }
 
 func (env *Env) Exec(s ast.Stmt) error {
+	if b := env.root.budget; b != nil {
+		b.spend()
+	}
+	if h := env.root.hook; h != nil {
+		switch s.(type) {
+		case ast.Program, ast.Block:
+		default:
+			h.Before(env, s)
+		}
+	}
 	switch s := s.(type) {
 	case ast.Program:
-		for _, ss := range s {
+		for _, ss := range s.Stmts {
 			if err := env.Exec(ss); err != nil {
 				return err
 			}
@@ -95,10 +168,10 @@ func (env *Env) Exec(s ast.Stmt) error {
 		return nil
 	case *ast.VarDecl:
 		v := env.Eval(s.Expr)
-		env.Bind(s.VarName, v)
+		env.define(s.Slot, s.VarName, v)
 		return nil
 	case *ast.FunDef:
-		env.Bind(s.Name.VarName(), value.MakeClosure(env, s.Params, s.Body))
+		env.define(s.Name.Slot, s.Name.VarName(), value.MakeClosure(env, s.Name.VarName(), s.Params, s.Body))
 		return nil
 	case ast.ClassDef:
 		var sc value.Class
@@ -108,16 +181,19 @@ func (env *Env) Exec(s ast.Stmt) error {
 			sup := env.Eval(s.Superclass)
 			sc, ok = sup.(value.Class)
 			if !ok {
-				return fmt.Errorf("%s is not a class", sup)
+				return env.errorAt(s.Superclass.Span().Start, "%s is not a class", sup)
 			}
 			e2 = e2.Child()
-			e2.Bind("super", sc)
+			e2.Define(0, sc) // "super"
+			e2.(*Env).name(0, "super")
 		}
-		env.Bind(s.Name.VarName(), value.MakeClass(e2, s.Name.VarName(), sc, s.Methods...))
+		env.define(s.Name.Slot, s.Name.VarName(), value.MakeClass(e2, s.Name.VarName(), sc, s.Methods...))
 		return nil
+	case *ast.Import:
+		return env.importModule(s)
 	case ast.Block:
 		env2 := env.Child()
-		for _, ss := range s {
+		for _, ss := range s.Stmts {
 			if err := env2.Exec(ss); err != nil {
 				return err
 			}
@@ -138,10 +214,23 @@ func (env *Env) Exec(s ast.Stmt) error {
 			if !value.Truthful(cond) {
 				return nil
 			}
-			if err := env.Exec(s.Body); err != nil {
+			if err := env.Exec(s.Body); err == errBreak {
+				return nil
+			} else if err != nil && err != errContinue {
 				return err
 			}
+			if s.Incr != nil {
+				env.Eval(s.Incr)
+			}
 		}
+	case *ast.Throw:
+		return env.throw(s)
+	case *ast.Try:
+		return env.try(s)
+	case ast.Break:
+		return errBreak
+	case ast.Continue:
+		return errContinue
 	case *ast.Return:
 		var v value.Value = value.Nil
 		if s.Expr != nil {
@@ -155,9 +244,9 @@ func (env *Env) Exec(s ast.Stmt) error {
 func (env *Env) Eval(e ast.Expr) value.Value {
 	switch e := e.(type) {
 	case ast.StrLit:
-		return value.Str(e)
+		return value.Str(e.Value)
 	case ast.NLit:
-		return value.Num(e)
+		return value.Num(e.Value)
 	case *ast.UnOp:
 		return env.UnOp(e)
 	case *ast.BinOp:
@@ -167,75 +256,133 @@ func (env *Env) Eval(e ast.Expr) value.Value {
 	case ast.NilT:
 		return value.Nil
 	case ast.Bool:
-		return value.Bool(e)
+		return value.Bool(e.Value)
 	case ast.Var:
-		return env.Lookup(e.Depth, e.VarName())
+		return env.variable(e)
 	case ast.ThisT:
-		return env.Lookup(e.Depth, e.VarName())
+		return env.variable(e.Var)
 	case *ast.Assign:
 		rhs := env.Eval(e.Rhs)
-		env.Assign(e.Lhs.Depth, e.Lhs.VarName(), rhs)
+		if !env.assign(e.Lhs.Depth, e.Lhs.Slot, e.Lhs.VarName(), rhs) {
+			panic(env.errorAt(e.Lhs.Span().Start, "cannot update unbound variable: %s", e.Lhs.VarName()))
+		}
 		return rhs
 	case *ast.Call:
 		t := env.Eval(e.Callee)
 		target, ok := t.(value.Callable)
 		if !ok {
-			panic(fmt.Errorf("target %s is not callable", t))
+			panic(env.errorAt(e.Pos, "target %s is not callable", t))
 		}
 		ps := make([]value.Value, len(e.Args))
 		for i, a := range e.Args {
 			ps[i] = env.Eval(a)
 		}
-		return env.call(target, false, ps...)
+		return env.call(e.Pos, target, false, ps...)
 
 	case *ast.Get:
 		t := env.Eval(e.Object)
-		target, ok := t.(value.Instance)
+		target, ok := t.(value.Object)
 		if !ok {
-			panic(fmt.Errorf("target %s has no attributes", t))
+			panic(env.errorAt(e.Pos, "target %s has no attributes", t))
 		}
 		if v, err := target.Get(e.Attribute); err != nil {
-			panic(err)
+			panic(env.errorAt(e.Pos, "%s", err))
 		} else {
 			return v
 		}
 
 	case *ast.Set:
 		t := env.Eval(e.Object)
-		target, ok := t.(value.Instance)
+		target, ok := t.(value.Object)
 		if !ok {
-			panic(fmt.Errorf("target %s has no attributes", t))
+			panic(env.errorAt(e.Pos, "target %s has no attributes", t))
 		}
 		v := env.Eval(e.Rhs)
-		target.Fields[e.Attribute] = v
+		if err := target.Set(e.Attribute, v); err != nil {
+			panic(env.errorAt(e.Pos, "%s", err))
+		}
+		return v
+
+	case *ast.Interp:
+		buf := strings.Builder{}
+		for _, x := range e.Parts {
+			buf.WriteString(env.Eval(x).String())
+		}
+		return value.Str(buf.String())
+
+	case *ast.ListLit:
+		elems := make([]value.Value, len(e.Elems))
+		for i, x := range e.Elems {
+			elems[i] = env.Eval(x)
+		}
+		return value.NewList(elems...)
+
+	case *ast.MapLit:
+		m := value.NewMap()
+		for i, k := range e.Keys {
+			key := env.Eval(k)
+			v := env.Eval(e.Values[i])
+			if err := m.Set(key, v); err != nil {
+				panic(env.errorAt(e.Span().Start, "%s", err))
+			}
+		}
+		return m
+
+	case *ast.Index:
+		t := env.Eval(e.Object)
+		i := env.Eval(e.Index)
+		v, err := value.GetIndex(t, i)
+		if err != nil {
+			panic(env.errorAt(e.Pos, "%s", err))
+		}
+		return v
+
+	case *ast.SetIndex:
+		t := env.Eval(e.Object)
+		i := env.Eval(e.Index)
+		v := env.Eval(e.Rhs)
+		if err := value.SetIndex(t, i, v); err != nil {
+			panic(env.errorAt(e.Pos, "%s", err))
+		}
 		return v
 
 	case *ast.Super:
-		sc := env.Lookup(e.S.Depth, "super").(value.Class)
-		this := env.Lookup(e.S.Depth-1, "this").(value.Instance)
+		sc := env.Lookup(e.S.Depth, e.S.Slot, "super").(value.Class)
+		this := env.Lookup(e.S.Depth-1, 0, "this").(value.Instance)
 		m, err := sc.FindMethod(e.Attribute)
 		if err != nil {
-			panic(err)
+			panic(env.errorAt(e.S.Span().Start, "%s", err))
 		}
 		return value.Bind(this, m)
 
 	case *ast.FunLit:
 		if e.Name == nil {
-			return value.MakeClosure(env, e.Params, e.Body)
+			return value.MakeClosure(env, "", e.Params, e.Body)
 		}
 		e2 := env.Child()
-		cl := value.MakeClosure(e2, e.Params, e.Body)
-		e2.Bind(e.Name.VarName(), cl)
+		cl := value.MakeClosure(e2, e.Name.VarName(), e.Params, e.Body)
+		e2.Define(e.Name.Slot, cl)
+		e2.(*Env).name(e.Name.Slot, e.Name.VarName())
 		return cl
 
 	}
 	panic(fmt.Errorf("unhandled expr %s", e))
 }
 
+func (env *Env) variable(v ast.Var) value.Value {
+	if x, ok := env.lookup(v.Depth, v.Slot, v.VarName()); ok {
+		return x
+	}
+	panic(env.errorAt(v.Span().Start, "unbound variable: %s", v.VarName()))
+}
+
 func (env *Env) UnOp(e *ast.UnOp) value.Value {
 	switch e.Op {
 	case "-":
-		n := env.Eval(e.Arg).(value.Num)
+		n, ok := env.Eval(e.Arg).(value.Num)
+		if !ok {
+			panic(env.errorAt(e.Pos, "Operand must be a number."))
+		}
 		return -n
 	case "!":
 		return value.Bool(!value.Truthful(env.Eval(e.Arg)))
@@ -262,24 +409,40 @@ func (env *Env) BinOp(e *ast.BinOp) value.Value {
 				return l + r
 			}
 		}
+		panic(env.errorAt(e.Pos, "Operands must be two numbers or two strings."))
+	case "==":
+		return value.Bool(l == r)
+	case "!=":
+		return value.Bool(l != r)
+	}
+	ln, okl := l.(value.Num)
+	rn, okr := r.(value.Num)
+	if !okl || !okr {
+		panic(env.errorAt(e.Pos, "Operands must be numbers."))
+	}
+	switch e.Op {
 	case "*":
-		return l.(value.Num) * r.(value.Num)
+		return ln * rn
 	case "-":
-		return l.(value.Num) - r.(value.Num)
+		return ln - rn
 	case "/":
-		return l.(value.Num) / r.(value.Num)
+		return ln / rn
+	case "%", "div":
+		if rn == 0 {
+			panic(env.errorAt(e.Pos, "Division by zero."))
+		}
+		if e.Op == "%" {
+			return value.Mod(ln, rn)
+		}
+		return value.Div(ln, rn)
 	case "<":
-		return value.Bool(l.(value.Num) < r.(value.Num))
+		return value.Bool(ln < rn)
 	case "<=":
-		return value.Bool(l.(value.Num) <= r.(value.Num))
+		return value.Bool(ln <= rn)
 	case ">":
-		return value.Bool(l.(value.Num) > r.(value.Num))
+		return value.Bool(ln > rn)
 	case ">=":
-		return value.Bool(l.(value.Num) >= r.(value.Num))
-	case "==":
-		return value.Bool(l == r)
-	case "!=":
-		return value.Bool(l != r)
+		return value.Bool(ln >= rn)
 	}
 	panic(fmt.Errorf("unhandled binary op %s", e))
 }
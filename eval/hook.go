@@ -0,0 +1,89 @@
+package eval
+
+import (
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/value"
+	"sort"
+)
+
+// Hook is called before the evaluator executes each statement, other than programs and
+// blocks, with the scope that the statement runs in. It may block to pause the program.
+// Debuggers attach a Hook; without one, the evaluator only pays for a nil check.
+type Hook interface {
+	Before(env *Env, s ast.Stmt)
+}
+
+// SetHook attaches a Hook to the whole program, or detaches it with nil. While a hook
+// is attached, scopes also record the names of their locals.
+func (env *Env) SetHook(h Hook) {
+	env.root.hook = h
+}
+
+// Depth is the number of Lox function calls that are active.
+func (env *Env) Depth() int {
+	return len(env.root.frames)
+}
+
+// Stack returns the active calls, innermost first.
+func (env *Env) Stack() []value.Frame {
+	frames := env.root.frames
+	stack := make([]value.Frame, len(frames))
+	for i, f := range frames {
+		stack[len(frames)-1-i] = f
+	}
+	return stack
+}
+
+// Variable is a named value in a scope.
+type Variable struct {
+	Name  string
+	Value value.Value
+}
+
+// Variables lists the locals of this scope, or the globals (in name order) of the root.
+// Locals are only named if they were defined while a Hook was attached. The exception
+// is "this", which value.Bind defines without a name, so an unnamed local is "this".
+func (env *Env) Variables() []Variable {
+	var vs []Variable
+	if env.Parent == nil {
+		for name, v := range env.Bindings {
+			vs = append(vs, Variable{Name: name, Value: v})
+		}
+		sort.Slice(vs, func(i, j int) bool { return vs[i].Name < vs[j].Name })
+		return vs
+	}
+	for slot, v := range env.Slots {
+		if v == nil {
+			continue
+		}
+		name := "this"
+		if slot < len(env.names) && env.names[slot] != "" {
+			name = env.names[slot]
+		}
+		vs = append(vs, Variable{Name: name, Value: v})
+	}
+	return vs
+}
+
+// Find looks a name up, from this scope outwards to the globals.
+func (env *Env) Find(name string) (value.Value, bool) {
+	for e := env; e != nil; e = e.Parent {
+		for _, v := range e.Variables() {
+			if v.Name == name {
+				return v.Value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// name records the name of a local, if a Hook is attached.
+func (env *Env) name(slot int, name string) {
+	if env.root.hook == nil {
+		return
+	}
+	for len(env.names) <= slot {
+		env.names = append(env.names, "")
+	}
+	env.names[slot] = name
+}
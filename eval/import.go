@@ -0,0 +1,37 @@
+package eval
+
+import (
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/value"
+)
+
+// SetImporter sets what runs the modules named by import statements.
+func (env *Env) SetImporter(i value.Importer) {
+	env.root.importer = i
+}
+
+func (env *Env) importModule(s *ast.Import) error {
+	if env.root.importer == nil {
+		return env.errorAt(s.Span().Start, "cannot import %q: modules are not available", s.Path)
+	}
+	m, err := env.root.importer.Import(s.Span().File, s.Path)
+	if abandoned(err) {
+		// The module ran out of the budget it shares with the importer, which can't be caught
+		return err
+	} else if err != nil {
+		rerr := env.errorAt(s.Span().Start, "cannot import %q", s.Path)
+		rerr.Cause = err
+		return rerr
+	}
+	if s.As != nil {
+		env.define(s.As.Slot, s.As.VarName(), m)
+	}
+	for _, n := range s.Names {
+		v, err := m.Get(n.VarName())
+		if err != nil {
+			return env.errorAt(n.Span().Start, "%s", err)
+		}
+		env.define(n.Slot, n.VarName(), v)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/value"
+)
+
+// MaxDepth is the default limit on the depth of Lox function calls. It matches the VM's.
+const MaxDepth = 1 << 16
+
+// ErrStepLimit is returned by Run when a program executes more statements than its
+// Limits allow. Like the error from a cancelled context, it can't be caught by a try
+// statement.
+var ErrStepLimit = errors.New("step limit exceeded")
+
+// Limits bound the resources that the programs run by an Env may use.
+type Limits struct {
+	Steps int64 // the number of statements that may be executed; zero for no limit
+	Depth int   // of Lox function calls, beyond which a call is a "stack overflow" error; zero for MaxDepth
+}
+
+// budget counts the statements executed, against a limit and a context.
+type budget struct {
+	ctx   context.Context
+	steps int64
+	max   int64
+}
+
+// How many statements are run between checks of the context
+const checkEvery = 1 << 10
+
+func (b *budget) spend() {
+	b.steps++
+	if b.max > 0 && b.steps > b.max {
+		panic(ErrStepLimit)
+	}
+	if b.ctx != nil && b.steps%checkEvery == 0 {
+		if err := b.ctx.Err(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// abandoned reports whether err is one that ends the whole program, rather than one
+// that try statements may catch or clean up after.
+func abandoned(err error) bool {
+	return errors.Is(err, ErrStepLimit) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// SetLimits applies to everything run by the Env from now on. The steps are counted
+// from the last call to ResetSteps, if any, or else from the Env's creation.
+func (env *Env) SetLimits(l Limits) {
+	root := env.root
+	root.maxDepth = l.Depth
+	if root.maxDepth == 0 {
+		root.maxDepth = MaxDepth
+	}
+	if l.Steps > 0 && root.budget == nil {
+		root.budget = &budget{}
+	}
+	if root.budget != nil {
+		root.budget.max = l.Steps
+	}
+}
+
+// ShareBudget makes env count its steps against the same limit as other, and be
+// abandoned by the same context, as for the modules that a program imports.
+func (env *Env) ShareBudget(other *Env) {
+	if other.root.budget == nil {
+		other.root.budget = &budget{}
+	}
+	env.root.budget = other.root.budget
+}
+
+// ResetSteps starts counting the statements executed against the step limit afresh, as
+// for each separate request that the Env serves.
+func (env *Env) ResetSteps() {
+	if b := env.root.budget; b != nil {
+		b.steps = 0
+	}
+}
+
+// RunContext runs a statement as Run does, and abandons it with the context's error once
+// the context is done.
+func (env *Env) RunContext(ctx context.Context, s ast.Stmt) error {
+	return env.withContext(ctx, func() error {
+		return env.Run(s)
+	})
+}
+
+// EvalContext evaluates an expression, returning any error rather than panicking. Like
+// RunContext, it is abandoned once the context is done.
+func (env *Env) EvalContext(ctx context.Context, e ast.Expr) (v value.Value, err error) {
+	err = env.withContext(ctx, func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = r.(error)
+			}
+		}()
+		v = env.Eval(e)
+		return nil
+	})
+	return v, err
+}
+
+func (env *Env) withContext(ctx context.Context, f func() error) error {
+	root := env.root
+	if root.budget == nil {
+		root.budget = &budget{}
+	}
+	outer := root.budget.ctx
+	root.budget.ctx = ctx
+	defer func() { root.budget.ctx = outer }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f()
+}
@@ -0,0 +1,94 @@
+package eval
+
+import (
+	"bytes"
+	"context"
+	"github.com/jan-g/lox/builtin"
+	"github.com/jan-g/lox/value"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const spin = `
+var n = 0;
+while (true) {
+  try {
+    while (true) n = n + 1;
+  } catch (e) {
+    print "caught";
+  }
+}
+`
+
+func TestStepLimit(t *testing.T) {
+	prog := prepare(t, spin)
+	env := New(&bytes.Buffer{})
+	env.SetLimits(Limits{Steps: 1000})
+	assert.Equal(t, ErrStepLimit, builtin.InitEnv(env).Run(prog))
+	// The program, var, while, block, try, block and while; then one statement per iteration
+	assert.Equal(t, value.Num(1000-7), env.Lookup(-1, 0, "n"))
+}
+
+func TestContext(t *testing.T) {
+	prog := prepare(t, spin)
+	env := New(&bytes.Buffer{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, env.RunContext(ctx, prog))
+
+	// A context that's already done stops the program before it starts
+	out := &bytes.Buffer{}
+	env = New(out)
+	assert.Equal(t, context.DeadlineExceeded, env.RunContext(ctx, prepare(t, `print 1;`)))
+	assert.Empty(t, out.String())
+}
+
+func TestStackOverflow(t *testing.T) {
+	prog := prepare(t, `
+fun down(n) {
+  if (n == 0) return 0;
+  return down(n - 1);
+}
+print down(9);
+try {
+  print down(10);
+} catch (e) {
+  print e.message;
+}
+down(10);
+`)
+	out := &bytes.Buffer{}
+	env := New(out)
+	env.SetLimits(Limits{Depth: 10})
+	err := builtin.InitEnv(env).Run(prog)
+	assert.Equal(t, "0\nstack overflow\n", out.String())
+	if rerr, ok := err.(*value.RuntimeError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, "stack overflow", rerr.Message)
+		assert.Len(t, rerr.Stack, 10)
+	}
+}
+
+// A finally block can't swallow an abort by leaving early, nor does it run at all
+func TestFinally(t *testing.T) {
+	for _, src := range []string{
+		`fun f() { try { while (true) {} } finally { print "finally"; return "swallowed"; } } print f();`,
+		`while (true) { try { while (true) {} } finally { print "finally"; break; } } print "swallowed";`,
+		`var i = 0; while (true) { try { while (true) {} } finally { print "finally"; i = i + 1; if (i < 3) continue; } }`,
+	} {
+		prog := prepare(t, src)
+
+		out := &bytes.Buffer{}
+		env := New(out)
+		env.SetLimits(Limits{Steps: 1000})
+		assert.Equal(t, ErrStepLimit, builtin.InitEnv(env).Run(prog), src)
+		assert.Empty(t, out.String(), src)
+
+		out = &bytes.Buffer{}
+		env = New(out)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		assert.Equal(t, context.DeadlineExceeded, env.RunContext(ctx, prog), src)
+		assert.Empty(t, out.String(), src)
+		cancel()
+	}
+}
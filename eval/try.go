@@ -0,0 +1,79 @@
+package eval
+
+import (
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/value"
+)
+
+// errorClass is the class of the values that catch blocks receive for errors raised
+// by the interpreter itself, rather than by a throw statement.
+var errorClass = value.MakeClass(nil, "Error", nil)
+
+// caught returns the value that a catch block sees for err.
+func caught(err *value.RuntimeError) value.Value {
+	if err.Thrown != nil {
+		return err.Thrown
+	}
+	inst, _ := value.Instantiate(errorClass)
+	inst.Fields["message"] = value.Str(err.Message)
+	return inst
+}
+
+func (env *Env) throw(s *ast.Throw) error {
+	v := env.Eval(s.Expr)
+	err := env.errorAt(s.Span().Start, "uncaught exception: %s", v)
+	err.Thrown = v
+	panic(err)
+}
+
+// try runs a try statement. The finally block runs however the rest of the statement
+// is left: normally, by break or continue, by return, or by an error. It doesn't run
+// when the program is abandoned, by the step limit or its context.
+func (env *Env) try(s *ast.Try) (err error) {
+	if s.Finally != nil {
+		defer func() {
+			r := recover()
+			if err, ok := r.(error); ok && abandoned(err) {
+				panic(r)
+			}
+			// Anything that leaves the finally block early supersedes what was in flight
+			if ferr := env.Exec(s.Finally); ferr != nil {
+				err = ferr
+				return
+			}
+			if r != nil {
+				panic(r)
+			}
+		}()
+	}
+	if s.Catch == nil {
+		return env.Exec(s.Body)
+	}
+	rerr, err := env.protect(s.Body)
+	if rerr == nil {
+		return err
+	}
+	env2 := env.Child()
+	env2.Define(s.CatchVar.Slot, caught(rerr))
+	env2.(*Env).name(s.CatchVar.Slot, s.CatchVar.VarName())
+	return env2.Exec(s.Catch)
+}
+
+// protect runs a try block, separating out any runtime error that it raised. Other ways
+// of leaving the block - return, break and continue - carry on as usual.
+func (env *Env) protect(s ast.Stmt) (rerr *value.RuntimeError, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*value.RuntimeError)
+			if !ok {
+				panic(r)
+			}
+			rerr = e
+		}
+	}()
+	err = env.Exec(s)
+	if e, ok := err.(*value.RuntimeError); ok {
+		return e, nil
+	}
+	return nil, err
+}
@@ -6,7 +6,10 @@ import (
 	"github.com/jan-g/lox/analysis"
 	"github.com/jan-g/lox/builtin"
 	"github.com/jan-g/lox/eval"
+	"github.com/jan-g/lox/module"
 	"github.com/jan-g/lox/parse"
+	"github.com/jan-g/lox/value"
+	"github.com/jan-g/lox/vm"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"io/fs"
@@ -40,13 +43,35 @@ func loxFiles(dir string) []string {
 	return files
 }
 
+// Every example must behave identically on each engine.
+var engines = []struct {
+	name string
+	new  func(out io.Writer, i value.Importer) value.Env
+}{
+	{"eval", func(out io.Writer, i value.Importer) value.Env {
+		e := eval.New(out)
+		e.SetImporter(i)
+		return e
+	}},
+	{"vm", func(out io.Writer, i value.Importer) value.Env {
+		v := vm.New(out)
+		v.SetImporter(i)
+		return v
+	}},
+}
+
 func TestExamples(t *testing.T) {
 	d := curDir()
-	for _, f := range loxFiles(d) {
-		dir, fn := filepath.Split(f)
-		t.Run(strings.TrimPrefix(f, d+"/"), func(t *testing.T) {
-			if err := run1(t, dir, fn); err != nil {
-				t.Fatal(err)
+	for _, engine := range engines {
+		engine := engine
+		t.Run(engine.name, func(t *testing.T) {
+			for _, f := range loxFiles(d) {
+				dir, fn := filepath.Split(f)
+				t.Run(strings.TrimPrefix(f, d+"/"), func(t *testing.T) {
+					if err := run1(t, engine.new, dir, fn); err != nil {
+						t.Fatal(err)
+					}
+				})
 			}
 		})
 	}
@@ -66,9 +91,12 @@ func loadFile(dir string, fn string, ext string) (string, error) {
 	return string(expected), nil
 }
 
-func run1(t *testing.T, dir string, fn string) (err error) {
+func run1(t *testing.T, newEnv func(io.Writer, value.Importer) value.Env, dir string, fn string) (err error) {
 	buf := &bytes.Buffer{}
-	env := builtin.InitEnv(eval.New(buf))
+	l := module.NewLoader(func(l *module.Loader) value.Env {
+		return builtin.InitEnv(newEnv(buf, l))
+	}, builtin.Names())
+	env := l.New()
 	f, err := os.Open(filepath.Join(dir, fn))
 	if err != nil {
 		t.Fatal(err)
@@ -90,15 +118,16 @@ func run1(t *testing.T, dir string, fn string) (err error) {
 		}
 	}()
 
-	p := parse.New(f)
+	p := parse.NewFile(filepath.Join(dir, fn), f)
 	ast, err := p.Parse()
 	if err != nil {
 		return err
 	}
-	if err := analysis.Analyse(ast); err != nil {
+	if err := analysis.Analyse(ast, builtin.Names()...); err != nil {
 		return err
 	}
 
+	defer l.Enter(filepath.Join(dir, fn))()
 	if err := env.Run(ast); err != nil {
 		return err
 	}
@@ -0,0 +1,42 @@
+package lex
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// program generates a Lox source of roughly size bytes that uses most kinds of token.
+func program(size int) []byte {
+	buf := &bytes.Buffer{}
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(buf, `// function number %d
+fun f%d(a, b) {
+  /* a block
+     comment */
+  var xs = [1, 2.5, 0xFF, 1_000, 6.02e23];
+  var m = {"k%d": a, "tab\t": b};
+  if (a <= b and !(a == nil)) {
+    return "a ${a} and b ${b + %d}\n";
+  }
+  return `+"`raw %d`"+`;
+}
+`, i, i, i, i, i)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkLexer(b *testing.B) {
+	src := program(1 << 20)
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l := New(bytes.NewReader(src), MakeSwitch(MakeId(Kws...), WS, Op, Num, Str, Raw))
+		for t := l.Scan(); t.Token != TokEof; t = l.Scan() {
+			if t.Token == TokErr {
+				b.Fatal(t)
+			}
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package lex
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"strings"
@@ -25,6 +24,10 @@ const (
 	TokPunc
 	TokStr
 	TokNum
+	TokInterp    // the text of a string up to an interpolated expression
+	TokInterpMid // the text between the end of one interpolated expression and the next
+	TokInterpEnd // the text from the end of the last interpolated expression to the end of the string
+	TokRaw       // the text of a raw string
 )
 
 func (t TokenType) String() string {
@@ -45,6 +48,14 @@ func (t TokenType) String() string {
 		return "STR"
 	case TokNum:
 		return "NUM"
+	case TokInterp:
+		return "INTERP"
+	case TokInterpMid:
+		return "INTERPMID"
+	case TokInterpEnd:
+		return "INTERPEND"
+	case TokRaw:
+		return "RAW"
 	default:
 		return fmt.Sprintf("?%d", t)
 	}
@@ -65,6 +76,14 @@ func (t T) String() string {
 		return t.Lexeme
 	case TokStr:
 		return fmt.Sprintf("%q", t.Lexeme)
+	case TokInterp:
+		return fmt.Sprintf("%q${", t.Lexeme)
+	case TokInterpMid:
+		return fmt.Sprintf("}%q${", t.Lexeme)
+	case TokInterpEnd:
+		return fmt.Sprintf("}%q", t.Lexeme)
+	case TokRaw:
+		return "`" + t.Lexeme + "`"
 	default:
 		if len(t.Lexeme) > 10 {
 			return fmt.Sprintf("%s{%10q...}", t.Token, t.Lexeme)
@@ -80,26 +99,55 @@ type T struct {
 	Lexeme string
 }
 
+// Comment is a comment in the source, including its delimiters.
+type Comment struct {
+	Start Pos
+	End   Pos
+	Text  string
+}
+
+// Lexer scans source held in memory. State functions are run as the tokens they emit
+// are needed; tokens that have been emitted but not yet scanned wait in a ring buffer,
+// which grows as far as the lookahead requires.
 type Lexer struct {
-	r       *bufio.Reader
-	start   Pos
-	pos     Pos
-	lastPos Pos
-	tokens  chan T
-	rs      []rune
-	state   StateFunc
-	hitEof  bool
-	started bool
-	current T
+	Comments []Comment // comments skipped so far
+
+	src      []byte
+	err      error // from reading the source, reported at its end
+	off      int   // of the next rune
+	lastOff  int
+	startOff int // of the token being scanned
+	start    Pos
+	pos      Pos
+	lastPos  Pos
+	hitEof   bool
+	buf      []byte // the text of the string being scanned
+	state    StateFunc
+	started  bool
+	current  T
+	toks     []T // the ring of tokens emitted but not yet scanned
+	head     int
+	n        int
+	interp   []int // for each interpolation being scanned, the depth of braces within it
 }
 
 type StateFunc func(l *Lexer) StateFunc
 
+// New makes a Lexer for the whole of r. An error reading r is reported as a TokErr
+// after whatever could be read.
 func New(r io.Reader, state StateFunc) *Lexer {
+	src, err := io.ReadAll(r)
+	l := NewBytes(src, state)
+	l.err = err
+	return l
+}
+
+// NewBytes makes a Lexer for src, which should not be modified while it is in use.
+func NewBytes(src []byte, state StateFunc) *Lexer {
 	return &Lexer{
-		r:      bufio.NewReader(r),
-		tokens: make(chan T, 2),
-		state:  state,
+		src:   src,
+		state: state,
+		toks:  make([]T, 8),
 	}
 }
 
@@ -111,23 +159,31 @@ func (l *Lexer) Current() T {
 }
 
 func (l *Lexer) Scan() T {
-	if l.state != nil {
-	loop:
-		for {
-			select {
-			case t, ok := <-l.tokens:
-				l.started = true
-				if ok {
-					l.current = t
-					return t
-				}
-				break loop
-			default:
-				l.state = l.state(l)
-			}
-		}
+	if !l.fill(1) {
+		return l.eofToken()
 	}
+	t := l.toks[l.head]
+	l.head = (l.head + 1) % len(l.toks)
+	l.n--
+	l.started = true
+	l.current = t
+	return t
+}
 
+// Lookahead returns the token that the nth call to Scan from now will return, without
+// consuming any tokens. Lookahead(0), or any n below 1, returns the Current token.
+func (l *Lexer) Lookahead(n int) T {
+	if n < 1 {
+		return l.Current()
+	}
+	if !l.fill(n) {
+		return l.eofToken()
+	}
+	return l.toks[(l.head+n-1)%len(l.toks)]
+}
+
+// eofToken is what scanning gives once the state functions have finished.
+func (l *Lexer) eofToken() T {
 	return T{
 		Token: TokEof,
 		Start: l.pos,
@@ -135,23 +191,57 @@ func (l *Lexer) Scan() T {
 	}
 }
 
+// fill runs the state functions until there are n tokens waiting, if there are that
+// many more.
+func (l *Lexer) fill(n int) bool {
+	for l.n < n && l.state != nil {
+		l.state = l.state(l)
+	}
+	return l.n >= n
+}
+
+func (l *Lexer) push(t T) {
+	if l.n == len(l.toks) {
+		toks := make([]T, 2*len(l.toks))
+		for i := 0; i < l.n; i++ {
+			toks[i] = l.toks[(l.head+i)%len(l.toks)]
+		}
+		l.toks = toks
+		l.head = 0
+	}
+	l.toks[(l.head+l.n)%len(l.toks)] = t
+	l.n++
+}
+
 func (l *Lexer) Runes() string {
-	return string(l.rs)
+	return string(l.src[l.startOff:l.off])
 }
 
 func (l *Lexer) Emit(t TokenType) {
-	l.tokens <- T{
+	l.emitText(t, l.Runes())
+}
+
+// emitText emits a token whose lexeme is not the source it was scanned from, such as
+// an error message or the text of a string.
+func (l *Lexer) emitText(t TokenType, text string) {
+	l.push(T{
 		Token:  t,
 		Start:  l.start,
 		End:    l.pos,
-		Lexeme: l.Runes(),
-	}
+		Lexeme: text,
+	})
+	l.Drop()
+}
+
+// comment records the runes read so far as a comment, and drops them.
+func (l *Lexer) comment() {
+	l.Comments = append(l.Comments, Comment{Start: l.start, End: l.pos, Text: l.Runes()})
 	l.Drop()
 }
 
 func (l *Lexer) Drop() {
+	l.startOff = l.off
 	l.start = l.pos
-	l.rs = nil
 }
 
 const eof = -1
@@ -160,15 +250,18 @@ func (l *Lexer) Next() rune {
 	if l.hitEof {
 		return eof
 	}
-	// Do we need to read more stuff in?
-	r, _, err := l.r.ReadRune()
+	l.lastOff = l.off
 	l.lastPos = l.pos
-	if err == io.EOF {
+	if l.off >= len(l.src) {
 		l.hitEof = true
 		l.pos.Col += 1
 		return eof
 	}
-	l.rs = append(l.rs, r)
+	r, w := rune(l.src[l.off]), 1
+	if r >= utf8.RuneSelf {
+		r, w = utf8.DecodeRune(l.src[l.off:])
+	}
+	l.off += w
 	if r == '\n' {
 		l.pos.Col = 0
 		l.pos.Line += 1
@@ -178,39 +271,46 @@ func (l *Lexer) Next() rune {
 	return r
 }
 
+// Backup undoes the most recent call to Next.
 func (l *Lexer) Backup() {
-	if l.hitEof {
-		l.hitEof = false
-	} else {
-		if err := l.r.UnreadRune(); err != nil {
-			panic(err)
-		}
-		if len(l.rs) > 0 {
-			l.rs = l.rs[:len(l.rs)-1]
-		}
-	}
+	l.hitEof = false
+	l.off = l.lastOff
 	l.pos = l.lastPos
 }
 
 func (l *Lexer) Peek() rune {
-	r := l.Next()
-	l.Backup()
+	if l.hitEof {
+		return eof
+	}
+	r, _ := l.peekAt(l.off)
 	return r
 }
 
 func (l *Lexer) Peek2() (rune, rune) {
-	buf, _ := l.r.Peek(16)
-	r1, w := utf8.DecodeRune(buf)
-	r2, _ := utf8.DecodeRune(buf[w:])
+	if l.hitEof {
+		return eof, eof
+	}
+	r1, w := l.peekAt(l.off)
+	r2, _ := l.peekAt(l.off + w)
 	return r1, r2
 }
 
+// peekAt decodes the rune at off, and returns it and its width.
+func (l *Lexer) peekAt(off int) (rune, int) {
+	if off >= len(l.src) {
+		return eof, 0
+	}
+	if r := l.src[off]; r < utf8.RuneSelf {
+		return rune(r), 1
+	}
+	return utf8.DecodeRune(l.src[off:])
+}
+
 func Lex(l *Lexer) StateFunc {
 	for l.Next() != eof {
 	}
 	l.Emit(TokId)
-	close(l.tokens)
-	return Lex
+	return nil
 }
 
 func Alpha(l *Lexer) StateFunc {
@@ -237,34 +337,43 @@ func MakeSwitch(sfs ...scanFunc) StateFunc {
 				return sw
 			}
 		}
-		if l.Next() == eof {
+		c := l.Next()
+		if c == eof {
+			if l.err != nil {
+				l.emitText(TokErr, l.err.Error())
+				l.err = nil
+				return sw
+			}
 			l.Emit(TokEof)
 			return nil
 		}
-		l.Emit(TokErr)
-		return nil
+		// Report the character and carry on, so the parser can find any later errors too
+		l.emitText(TokErr, fmt.Sprintf("unexpected character %q", c))
+		return sw
 	}
 	return sw
 }
 
 var (
 	alphaNum = []*unicode.RangeTable{unicode.Letter, unicode.Number}
-	Kws      = strings.Split("and class else false fun for if nil or print return super this true var while", " ")
+	Kws      = strings.Split("and as break catch class continue else false finally for from fun if import nil or print return super this throw true try var while", " ")
 )
 
 func MakeId(kws ...string) scanFunc {
-	m := make(map[string]TokenType)
+	// Keywords are looked up without converting the source to a string, and their
+	// lexemes are shared
+	m := make(map[string]string)
 	for _, k := range kws {
-		m[k] = TokKW
+		m[k] = k
 	}
 	return func(l *Lexer) bool {
 		if unicode.IsLetter(l.Peek()) {
 			l.Next()
-			for unicode.IsOneOf(alphaNum, l.Peek()) || l.Peek() == '_' {
+			for c := l.Peek(); unicode.IsOneOf(alphaNum, c) || c == '_'; c = l.Peek() {
 				l.Next()
 			}
-			if t, ok := m[l.Runes()]; ok {
-				l.Emit(t)
+			if k, ok := m[string(l.src[l.startOff:l.off])]; ok {
+				l.emitText(TokKW, k)
 			} else {
 				l.Emit(TokId)
 			}
@@ -319,12 +428,13 @@ func Op(l *Lexer) bool {
 		if l.Peek() == '/' {
 			// Consume to \n
 			for {
-				c := l.Next()
+				c := l.Peek()
 				if c == '\n' || c == eof {
 					break
 				}
+				l.Next()
 			}
-			l.Drop()
+			l.comment()
 			return true
 		}
 		if l.Peek() == '*' {
@@ -333,8 +443,7 @@ func Op(l *Lexer) bool {
 			for {
 				c := l.Next()
 				if c == eof {
-					l.rs = []rune("no closing comment")
-					l.Emit(TokErr)
+					l.emitText(TokErr, "no closing comment")
 					return true
 				}
 				if c != '*' {
@@ -344,13 +453,31 @@ func Op(l *Lexer) bool {
 					continue
 				}
 				l.Next()
-				l.Drop()
+				l.comment()
 				return true
 			}
 		}
 		l.Emit(TokOp)
 		return true
-	case '{', '}', ';', '(', ')', '.', ',':
+	case '{':
+		if n := len(l.interp); n > 0 {
+			l.interp[n-1]++
+		}
+		l.Emit(TokPunc)
+		return true
+	case '}':
+		if n := len(l.interp); n > 0 {
+			if l.interp[n-1] == 0 {
+				// The end of an interpolation; the string carries on
+				l.interp = l.interp[:n-1]
+				l.strRest(TokInterpMid, TokInterpEnd)
+				return true
+			}
+			l.interp[n-1]--
+		}
+		l.Emit(TokPunc)
+		return true
+	case ';', '(', ')', '.', ',', '[', ']', ':':
 		l.Emit(TokPunc)
 		return true
 
@@ -359,63 +486,268 @@ func Op(l *Lexer) bool {
 	return false
 }
 
+// Str scans a string literal. A string without interpolations is a TokStr. Otherwise,
+// the text before the first interpolation, `${expr}`, is a TokInterp, which is followed
+// by the tokens of the expression; the text between that and the next one is a
+// TokInterpMid, and the text after the last one is a TokInterpEnd.
 func Str(l *Lexer) bool {
 	if l.Peek() != '"' {
 		return false
 	}
 	l.Next()
+	l.strRest(TokInterp, TokStr)
+	return true
+}
+
+// Raw scans a raw string literal, which is delimited by backquotes. It may span lines,
+// and its text is taken as it is, without escapes or interpolation. It is a TokRaw.
+func Raw(l *Lexer) bool {
+	if l.Peek() != '`' {
+		return false
+	}
+	l.Next()
+	for {
+		switch l.Next() {
+		case eof:
+			l.Backup()
+			l.emitText(TokErr, "unterminated raw string")
+			return true
+		case '`':
+			l.emitText(TokRaw, string(l.src[l.startOff+1:l.off-1]))
+			return true
+		}
+	}
+}
+
+// escapes are the single-character escape sequences of strings.
+var escapes = map[rune]rune{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'0':  0,
+	'a':  '\a',
+	'b':  '\b',
+	'f':  '\f',
+	'v':  '\v',
+	'\\': '\\',
+	'"':  '"',
+	'\'': '\'',
+	'$':  '$',
+}
+
+// strRest scans the text of a string up to its end or its next interpolation, which it
+// emits as a token of type end or more respectively. The rune before the text - the
+// opening quote, or the brace closing an interpolation - has been read already.
+//
+// A malformed escape sequence is reported as a TokErr that covers it, in place of the
+// text that contains it.
+func (l *Lexer) strRest(more TokenType, end TokenType) {
+	l.buf = l.buf[:0]
+	var bad *T
+	emit := func(t TokenType) {
+		if bad != nil {
+			l.push(*bad)
+			l.Drop()
+			return
+		}
+		l.emitText(t, string(l.buf))
+	}
 	for {
 		c := l.Next()
 		switch c {
 		case eof, '\n':
 			l.Backup()
-			l.rs = []rune("unterminated string")
-			l.Emit(TokErr)
-			return true
+			l.emitText(TokErr, "unterminated string")
+			return
 		case '\\':
-			c := l.Next()
-			switch c {
-			case eof, '\n':
-				l.Backup()
-				l.rs = []rune("unterminated string")
-				l.Emit(TokErr)
-				return true
-			case 'n':
-				c = '\n'
-				fallthrough
-			default:
-				l.rs = l.rs[:len(l.rs)-1]
-				l.rs[len(l.rs)-1] = c
+			start := l.lastPos
+			if c := l.Peek(); c == eof || c == '\n' {
+				continue
+			}
+			r, err := l.escape()
+			if err != "" {
+				if bad == nil {
+					bad = &T{Token: TokErr, Start: start, End: l.pos, Lexeme: err}
+				}
+				continue
 			}
+			l.buf = utf8.AppendRune(l.buf, r)
+		case '$':
+			if l.Peek() == '{' {
+				l.Next()
+				emit(more)
+				l.interp = append(l.interp, 0)
+				return
+			}
+			l.buf = utf8.AppendRune(l.buf, c)
 		case '"':
-			// End of string, tidy up
-			l.rs = l.rs[1 : len(l.rs)-1]
-			l.Emit(TokStr)
-			return true
+			emit(end)
+			return
+		default:
+			l.buf = utf8.AppendRune(l.buf, c)
+		}
+	}
+}
+
+// escape reads an escape sequence, whose backslash has been read already. It returns
+// the rune that the sequence stands for, or what is wrong with it.
+//
+// \xNN is the code point U+00NN, and \u{N...} is the code point with between one and
+// six hex digits, which must be a valid rune.
+func (l *Lexer) escape() (rune, string) {
+	c := l.Next()
+	if r, ok := escapes[c]; ok {
+		return r, ""
+	}
+	switch c {
+	case 'x':
+		r, n := l.hex(2)
+		if n != 2 {
+			return 0, `\x must be followed by two hex digits`
+		}
+		return r, ""
+	case 'u':
+		const msg = `\u must be followed by a code point in braces, like \u{1F600}`
+		if l.Peek() != '{' {
+			return 0, msg
+		}
+		l.Next()
+		r, n := l.hex(6)
+		if n == 0 || l.Peek() != '}' {
+			return 0, msg
 		}
+		l.Next()
+		if !utf8.ValidRune(r) {
+			return 0, fmt.Sprintf("invalid code point U+%04X", r)
+		}
+		return r, ""
+	}
+	return 0, fmt.Sprintf(`unknown escape sequence \%c`, c)
+}
+
+// hex reads up to max hex digits, and returns their value and how many there were.
+func (l *Lexer) hex(max int) (rune, int) {
+	var r rune
+	n := 0
+	for ; n < max; n++ {
+		c := l.Peek()
+		var d rune
+		switch {
+		case '0' <= c && c <= '9':
+			d = c - '0'
+		case 'a' <= c && c <= 'f':
+			d = c - 'a' + 10
+		case 'A' <= c && c <= 'F':
+			d = c - 'A' + 10
+		default:
+			return r, n
+		}
+		l.Next()
+		r = r*16 + d
 	}
+	return r, n
 }
 
+// Num scans a numeric literal. It is either decimal, with an optional fraction and
+// exponent, as in 1.5e-3, or a hexadecimal (0xFF) or binary (0b1010) integer.
+// Underscores may separate digits, as in 1_000_000.
 func Num(l *Lexer) bool {
 	c := l.Peek()
-	if !unicode.IsDigit(c) {
+	if !isDecimal(c) {
 		return false
 	}
-	l.Next()
-	for {
-		c = l.Peek()
-		if unicode.IsDigit(c) {
+	if c == '0' {
+		switch _, c2 := l.Peek2(); c2 {
+		case 'x', 'X':
+			return l.radix("hexadecimal", isHex)
+		case 'b', 'B':
+			return l.radix("binary", isBinary)
+		}
+	}
+	if _, ok := l.digits(isDecimal); !ok {
+		return l.badNum(badSeparator)
+	}
+	if l.Peek() == '.' {
+		if _, c2 := l.Peek2(); isDecimal(c2) {
+			l.Next()
+			if _, ok := l.digits(isDecimal); !ok {
+				return l.badNum(badSeparator)
+			}
+		}
+	}
+	if c := l.Peek(); c == 'e' || c == 'E' {
+		l.Next()
+		if c := l.Peek(); c == '+' || c == '-' {
 			l.Next()
-			continue
 		}
-		if c == '.' {
-			_, c2 := l.Peek2()
-			if unicode.IsDigit(c2) {
+		n, ok := l.digits(isDecimal)
+		if n == 0 {
+			return l.badNum("exponent has no digits")
+		} else if !ok {
+			return l.badNum(badSeparator)
+		}
+	}
+	l.Emit(TokNum)
+	return true
+}
+
+const badSeparator = "'_' must separate successive digits"
+
+// radix scans an integer literal with a two-character base prefix.
+func (l *Lexer) radix(base string, isDigit func(rune) bool) bool {
+	l.Next()
+	l.Next()
+	n, ok := l.digits(isDigit)
+	switch {
+	case !ok:
+		return l.badNum(badSeparator)
+	case n == 0:
+		return l.badNum(base + " literal has no digits")
+	case unicode.IsLetter(l.Peek()) || unicode.IsDigit(l.Peek()):
+		return l.badNum(fmt.Sprintf("invalid digit %q in %s literal", l.Peek(), base))
+	}
+	l.Emit(TokNum)
+	return true
+}
+
+// digits reads a run of digits, which may be separated by single underscores. It
+// returns how many digits there were, and whether the underscores were well placed.
+func (l *Lexer) digits(isDigit func(rune) bool) (int, bool) {
+	n := 0
+	for {
+		c, c2 := l.Peek2()
+		switch {
+		case isDigit(c):
+			n++
+		case c == '_':
+			if n == 0 || !isDigit(c2) {
 				l.Next()
-				continue
+				return n, false
 			}
+		default:
+			return n, true
 		}
-		l.Emit(TokNum)
-		return true
+		l.Next()
+	}
+}
+
+// badNum emits an error for a malformed numeric literal, taking the rest of it too.
+func (l *Lexer) badNum(msg string) bool {
+	for c := l.Peek(); c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c); c = l.Peek() {
+		l.Next()
 	}
+	l.emitText(TokErr, msg)
+	return true
+}
+
+func isDecimal(c rune) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isBinary(c rune) bool {
+	return c == '0' || c == '1'
+}
+
+func isHex(c rune) bool {
+	return isDecimal(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
 }
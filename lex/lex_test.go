@@ -2,6 +2,7 @@ package lex
 
 import (
     "bytes"
+    "io"
     "github.com/stretchr/testify/assert"
     "testing"
 )
@@ -36,15 +37,47 @@ func TestTokenise(t *testing.T) {
             []string{"KW{if}", "ID{hello}", "+", "<=", "<", "{", "!", "!="}},
         {`"one two"`, []string{`"one two"`}},
         {"1 1. 1.1", []string{"NUM{1}", "NUM{1}", ".", "NUM{1.1}"}},
+        {"1e6 2.5E-3 1e+2 1_000_000", []string{"NUM{1e6}", "NUM{2.5E-3}", "NUM{1e+2}", "NUM{1_000_000}"}},
+        {"0xFF 0Xbe_ef 0b1010 0B1_0", []string{"NUM{0xFF}", "NUM{0Xbe_ef}", "NUM{0b1010}", "NUM{0B1_0}"}},
+        {"1.x 0", []string{"NUM{1}", ".", "ID{x}", "NUM{0}"}},
+        {"0x;", []string{"ERR{hexadecimal literal has no digits; [0,0]-[0,2]}", ";"}},
+        {"0b", []string{"ERR{binary literal has no digits; [0,0]-[0,2]}"}},
+        {"0b102 3", []string{"ERR{invalid digit '2' in binary literal; [0,0]-[0,5]}", "NUM{3}"}},
+        {"0xFG;", []string{"ERR{invalid digit 'G' in hexadecimal literal; [0,0]-[0,4]}", ";"}},
+        {"1e+;", []string{"ERR{exponent has no digits; [0,0]-[0,3]}", ";"}},
+        {"1ex", []string{"ERR{exponent has no digits; [0,0]-[0,3]}"}},
+        {"1__0 1_ 0x_1", []string{
+            "ERR{'_' must separate successive digits; [0,0]-[0,4]}",
+            "ERR{'_' must separate successive digits; [0,5]-[0,7]}",
+            "ERR{'_' must separate successive digits; [0,8]-[0,12]}"}},
         {`"abhab`, []string{"ERR{unterminated string; [0,0]-[0,6]}"}},
         {"\"abhab\n", []string{"ERR{unterminated string; [0,0]-[0,6]}"}},
         {"\"abhab\"", []string{`"abhab"`}},
         {`"ab\nhab"`, []string{`"ab\nhab"`}},
+        {`"a${b}c"`, []string{`"a"${`, "ID{b}", `}"c"`}},
+        {`"a${b}c${d}"`, []string{`"a"${`, "ID{b}", `}"c"${`, "ID{d}", `}""`}},
+        {`"${ {1: "${x}"} }"`, []string{`""${`, "{", "NUM{1}", ":", `""${`, "ID{x}", `}""`, "}", `}""`}},
+        {`"\${x} $y"`, []string{`"${x} $y"`}},
+        {`"\t\r\0\a\b\f\v"`, []string{`"\t\r\x00\a\b\f\v"`}},
+        {`"\\ \" \' \$"`, []string{`"\\ \" ' $"`}},
+        {`"\x41\x7e\xe9"`, []string{`"A~é"`}},
+        {`"\u{1F600} \u{e9} \u{00004A}"`, []string{`"😀 é J"`}},
+        {`"a\qb"`, []string{`ERR{unknown escape sequence \q; [0,2]-[0,4]}`}},
+        {`"\x4" x`, []string{`ERR{\x must be followed by two hex digits; [0,1]-[0,4]}`, "ID{x}"}},
+        {`"\xg1"`, []string{`ERR{\x must be followed by two hex digits; [0,1]-[0,3]}`}},
+        {`"\u0041"`, []string{`ERR{\u must be followed by a code point in braces, like \u{1F600}; [0,1]-[0,3]}`}},
+        {`"\u{}"`, []string{`ERR{\u must be followed by a code point in braces, like \u{1F600}; [0,1]-[0,4]}`}},
+        {`"\u{1234567}"`, []string{`ERR{\u must be followed by a code point in braces, like \u{1F600}; [0,1]-[0,10]}`}},
+        {`"\u{D800}"`, []string{`ERR{invalid code point U+D800; [0,1]-[0,9]}`}},
+        {`"\u{110000}"`, []string{`ERR{invalid code point U+110000; [0,1]-[0,11]}`}},
+        {`"\q${x}\t"`, []string{`ERR{unknown escape sequence \q; [0,1]-[0,3]}`, "ID{x}", `}"\t"`}},
+        {"`a\\n${b}\n\"c\"` d", []string{"`a\\n${b}\n\"c\"`", "ID{d}"}},
+        {"`abc\n", []string{"ERR{unterminated raw string; [0,0]-[1,0]}"}},
     }
     for _, tt := range ts {
         t.Run(tt.in, func(t *testing.T) {
             r := bytes.NewReader([]byte(tt.in))
-            s := New(r, MakeSwitch(MakeId(Kws...), WS, Op, Num, Str))
+            s := New(r, MakeSwitch(MakeId(Kws...), WS, Op, Num, Str, Raw))
             ws := []string{}
             for {
                 n := s.Scan()
@@ -57,4 +90,39 @@ func TestTokenise(t *testing.T) {
             assert.Equal(t, ws, tt.res)
         })
     }
-}
\ No newline at end of file
+}
+
+func TestLookahead(t *testing.T) {
+    s := NewBytes([]byte("a b c d e f g h i j"), MakeSwitch(MakeId(Kws...), WS))
+    assert.Equal(t, "ID{a}", s.Lookahead(1).String())
+    assert.Equal(t, "ID{j}", s.Lookahead(10).String())
+    assert.Equal(t, TokEof, s.Lookahead(11).Token)
+    assert.Equal(t, TokEof, s.Lookahead(20).Token)
+    assert.Equal(t, "ID{a}", s.Scan().String())
+    assert.Equal(t, "ID{a}", s.Current().String())
+    assert.Equal(t, "ID{a}", s.Lookahead(0).String())
+    assert.Equal(t, "ID{c}", s.Lookahead(2).String())
+    for _, w := range []string{"b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+        assert.Equal(t, "ID{"+w+"}", s.Scan().String())
+    }
+    assert.Equal(t, TokEof, s.Scan().Token)
+
+    // Looking no tokens ahead is the same as asking for the current one
+    s = NewBytes([]byte("a b"), MakeSwitch(MakeId(Kws...), WS))
+    assert.Equal(t, "ID{a}", s.Lookahead(0).String())
+    assert.Equal(t, "ID{a}", s.Lookahead(-1).String())
+    assert.Equal(t, "ID{b}", s.Lookahead(1).String())
+}
+
+type failing struct{}
+
+func (failing) Read([]byte) (int, error) {
+    return 0, io.ErrUnexpectedEOF
+}
+
+func TestReadError(t *testing.T) {
+    s := New(io.MultiReader(bytes.NewReader([]byte("a")), failing{}), MakeSwitch(MakeId(Kws...), WS))
+    assert.Equal(t, "ID{a}", s.Scan().String())
+    assert.Equal(t, "ERR{unexpected EOF; [0,1]-[0,2]}", s.Scan().String())
+    assert.Equal(t, TokEof, s.Scan().Token)
+}
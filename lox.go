@@ -0,0 +1,196 @@
+// Package lox runs Lox programs from Go.
+//
+//	i := lox.New(lox.WithStdout(w))
+//	if _, err := i.RunFile("script.lox"); err != nil { ... }
+//	v, err := i.Call("handle", value.Str("request"))
+//
+// Programs run on the tree-walking evaluator. Each Interpreter has its own globals,
+// which persist from one piece of source to the next.
+package lox
+
+import (
+	"context"
+	"fmt"
+	"github.com/jan-g/lox/analysis"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/builtin"
+	"github.com/jan-g/lox/eval"
+	"github.com/jan-g/lox/module"
+	"github.com/jan-g/lox/parse"
+	"github.com/jan-g/lox/value"
+	"io"
+	"os"
+	"strings"
+)
+
+type Interpreter struct {
+	env     *eval.Env
+	globals []string // the names that later source may refer to
+	stdout  io.Writer
+	stderr  io.Writer
+	stdin   io.Reader
+	limits  *eval.Limits
+	path    []string
+	loader  *module.Loader
+}
+
+// Option configures an Interpreter.
+type Option func(*Interpreter)
+
+// WithStdout sets where print statements write to. The default is os.Stdout.
+func WithStdout(w io.Writer) Option {
+	return func(i *Interpreter) { i.stdout = w }
+}
+
+// WithStderr sets where the eprint builtin writes to. The default is os.Stderr.
+func WithStderr(w io.Writer) Option {
+	return func(i *Interpreter) { i.stderr = w }
+}
+
+// WithStdin sets what the readline builtin reads from. The default is os.Stdin.
+func WithStdin(r io.Reader) Option {
+	return func(i *Interpreter) { i.stdin = r }
+}
+
+// WithLimits bounds the statements executed and the depth of calls; see eval.Limits.
+// The step limit applies to each call of Eval, RunFile or Call separately.
+func WithLimits(l eval.Limits) Option {
+	return func(i *Interpreter) { i.limits = &l }
+}
+
+// WithPath sets the directories searched for imported modules that are not found
+// relative to the file importing them.
+func WithPath(dirs ...string) Option {
+	return func(i *Interpreter) { i.path = dirs }
+}
+
+func New(opts ...Option) *Interpreter {
+	i := &Interpreter{
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+		stdin:  os.Stdin,
+	}
+	for _, o := range opts {
+		o(i)
+	}
+	stdio := builtin.Stdio(i.stdin, i.stderr)
+	i.globals = builtin.Names()
+	for _, b := range stdio {
+		i.globals = append(i.globals, b.Name)
+	}
+	// Modules have the builtins, but not the globals that the host sets. They run within
+	// the same limits and context as the program that imports them.
+	l := module.NewLoader(func(l *module.Loader) value.Env {
+		env := eval.New(i.stdout)
+		if i.env != nil {
+			env.ShareBudget(i.env)
+		}
+		if i.limits != nil {
+			env.SetLimits(*i.limits)
+		}
+		env.SetImporter(l)
+		builtin.InitEnv(env)
+		for _, b := range stdio {
+			env.Bind(b.Name, b)
+		}
+		return env
+	}, i.globals, i.path...)
+	i.loader = l
+	i.env = l.New().(*eval.Env)
+	return i
+}
+
+// Eval runs Lox source. If it ends with an expression statement, the value of that
+// expression is returned; otherwise the result is nil.
+//
+// Syntax and resolution errors are returned as ast.Diagnostics, before anything runs;
+// errors raised by the program are *value.RuntimeError.
+func (i *Interpreter) Eval(src string) (value.Value, error) {
+	return i.run(context.Background(), "", strings.NewReader(src))
+}
+
+// EvalContext is Eval, abandoning the program with the context's error once it is done.
+func (i *Interpreter) EvalContext(ctx context.Context, src string) (value.Value, error) {
+	return i.run(ctx, "", strings.NewReader(src))
+}
+
+// RunFile runs the Lox source in a file, as Eval does.
+func (i *Interpreter) RunFile(path string) (value.Value, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return i.run(context.Background(), path, f)
+}
+
+func (i *Interpreter) run(ctx context.Context, file string, r io.Reader) (value.Value, error) {
+	prog, err := parse.NewFile(file, r).Parse()
+	if err != nil {
+		return nil, err
+	}
+	if err := analysis.Analyse(prog, i.globals...); err != nil {
+		return nil, err
+	}
+	i.globals = append(i.globals, analysis.Globals(prog)...)
+	i.env.ResetSteps()
+	if file != "" {
+		// A file that its own imports lead back to is an import cycle
+		defer i.loader.Enter(file)()
+	}
+
+	// The final expression is run separately, to capture its value
+	p := prog.(ast.Program)
+	var last ast.Expr
+	if n := len(p.Stmts); n > 0 {
+		if e, ok := p.Stmts[n-1].(*ast.Expression); ok {
+			last = e.Expr
+			p.Stmts = p.Stmts[:n-1]
+		}
+	}
+	if err := i.env.RunContext(ctx, p); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, nil
+	}
+	return i.env.EvalContext(ctx, last)
+}
+
+// Set creates or replaces a global, which source run afterwards may refer to.
+func (i *Interpreter) Set(name string, v value.Value) {
+	i.env.Bind(name, v)
+	for _, g := range i.globals {
+		if g == name {
+			return
+		}
+	}
+	i.globals = append(i.globals, name)
+}
+
+// Register binds a Go function to a global, as a builtin; see builtin.Native for the
+// functions that can be registered, and how their arguments and results are converted.
+func (i *Interpreter) Register(name string, fn interface{}) error {
+	b, err := builtin.Native(name, fn)
+	if err != nil {
+		return err
+	}
+	i.Set(name, b)
+	return nil
+}
+
+// Get returns the value of a global.
+func (i *Interpreter) Get(name string) (value.Value, bool) {
+	v, ok := i.env.Bindings[name]
+	return v, ok
+}
+
+// Call calls the Lox function or class bound to a global.
+func (i *Interpreter) Call(name string, args ...value.Value) (value.Value, error) {
+	f, ok := i.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("undefined variable: %s", name)
+	}
+	i.env.ResetSteps()
+	return i.env.Call(f, args...)
+}
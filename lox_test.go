@@ -0,0 +1,245 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/builtin"
+	"github.com/jan-g/lox/eval"
+	"github.com/jan-g/lox/value"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEval(t *testing.T) {
+	out := &bytes.Buffer{}
+	i := New(WithStdout(out))
+
+	v, err := i.Eval("var x = 2;\nprint x;\nx * 3;")
+	assert.NoError(t, err)
+	assert.Equal(t, value.Num(6), v)
+	assert.Equal(t, "2\n", out.String())
+
+	// Globals persist
+	v, err = i.Eval("x = x + 1;")
+	assert.NoError(t, err)
+	assert.Equal(t, value.Num(3), v)
+
+	v, err = i.Eval("print x;")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	_, err = i.Eval("print y;")
+	assert.IsType(t, ast.Diagnostics{}, err)
+	assert.EqualError(t, err, "undefined variable: y [0,6]")
+
+	_, err = i.Eval("-nil;")
+	assert.IsType(t, &value.RuntimeError{}, err)
+}
+
+func TestGlobals(t *testing.T) {
+	i := New(WithStdout(&bytes.Buffer{}))
+	i.Set("greeting", value.Str("hello"))
+	_, err := i.Eval(`var message = greeting + ", world";`)
+	assert.NoError(t, err)
+	v, ok := i.Get("message")
+	assert.True(t, ok)
+	assert.Equal(t, value.Str("hello, world"), v)
+
+	_, ok = i.Get("nothing")
+	assert.False(t, ok)
+}
+
+func TestCall(t *testing.T) {
+	i := New(WithStdout(&bytes.Buffer{}))
+	_, err := i.Eval(`
+fun add(a, b) { return a + b; }
+class Box { init(v) { this.v = v; } }
+`)
+	assert.NoError(t, err)
+
+	v, err := i.Call("add", value.Num(1), value.Num(2))
+	assert.NoError(t, err)
+	assert.Equal(t, value.Num(3), v)
+
+	box, err := i.Call("Box", value.Str("x"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, value.Str("x"), box.(value.Instance).Fields["v"])
+	}
+
+	_, err = i.Call("add", value.Num(1))
+	assert.EqualError(t, err, "<closure of arity 2> required 2 args, 1 given")
+	_, err = i.Call("add", value.Num(1), value.Nil)
+	assert.EqualError(t, err, "Operands must be two numbers or two strings. [1,25]\n  in add called from Go")
+	_, err = i.Call("missing")
+	assert.EqualError(t, err, "undefined variable: missing")
+}
+
+func TestRegister(t *testing.T) {
+	out := &bytes.Buffer{}
+	i := New(WithStdout(out))
+	assert.NoError(t, i.Register("repeat", strings.Repeat))
+	assert.NoError(t, i.Register("check", func(ok bool) error {
+		if !ok {
+			return errors.New("check failed")
+		}
+		return nil
+	}))
+	assert.NoError(t, i.Register("explode", func() { panic("boom") }))
+	_, err := i.Eval(`
+print repeat("ab", 3);
+try { check(false); } catch (e) { print e.message; }
+try { explode(); } catch (e) { print e.message; }
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, "ababab\ncheck failed\nexplode panicked: boom\n", out.String())
+
+	_, err = i.Eval(`repeat("ab", 1.5);`)
+	assert.EqualError(t, err, "repeat requires an integer for argument 2, not 1.5 [0,6]")
+
+	assert.Error(t, i.Register("bad", 1))
+}
+
+type account struct {
+	Owner   string
+	Balance int
+}
+
+func (a *account) Deposit(n int) { a.Balance += n }
+
+func (a *account) String() string { return a.Owner }
+
+func TestStruct(t *testing.T) {
+	out := &bytes.Buffer{}
+	i := New(WithStdout(out))
+	a := &account{Owner: "ann"}
+	s, err := builtin.Wrap(a)
+	assert.NoError(t, err)
+	i.Set("acct", s)
+	assert.NoError(t, i.Register("open", func(owner string) *account { return &account{Owner: owner} }))
+
+	_, err = i.Eval(`
+acct.Deposit(10);
+acct.Balance = acct.Balance + 5;
+print acct.Balance;
+var b = open("bob");
+b.Deposit(1);
+print b.Owner;
+print b.Balance;
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, 15, a.Balance)
+	assert.Equal(t, "15\nbob\n1\n", out.String())
+
+	_, err = i.Eval(`acct.Balance = 1.5;`)
+	assert.EqualError(t, err, "field Balance of <go lox.account> requires an integer, not 1.5 [0,5]")
+}
+
+func TestStdio(t *testing.T) {
+	out, errs := &bytes.Buffer{}, &bytes.Buffer{}
+	i := New(WithStdout(out), WithStderr(errs), WithStdin(strings.NewReader("one\ntwo")))
+	_, err := i.Eval(`
+var l = readline();
+while (l != nil) {
+  print l;
+  l = readline();
+}
+eprint("done");
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, "one\ntwo\n", out.String())
+	assert.Equal(t, "done\n", errs.String())
+}
+
+func TestRunFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "script.lox")
+	if err := os.WriteFile(fn, []byte("print 1;\nprint nope;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := New(WithStdout(&bytes.Buffer{})).RunFile(fn)
+	if ds, ok := err.(ast.Diagnostics); assert.True(t, ok) {
+		assert.Equal(t, fn, ds[0].Loc.File)
+	}
+}
+
+func TestModules(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "greet.lox"), []byte(`fun hello(n) { return "hello, " + n; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	i := New(WithStdout(&bytes.Buffer{}), WithPath(dir))
+	v, err := i.Eval(`from "greet.lox" import hello;
+hello("world");`)
+	assert.NoError(t, err)
+	assert.Equal(t, value.Str("hello, world"), v)
+
+	_, err = New(WithStdout(&bytes.Buffer{})).Eval(`import "greet.lox" as g;`)
+	assert.EqualError(t, err, "cannot import \"greet.lox\" [0,0]\nmodule \"greet.lox\" not found")
+}
+
+// The file that RunFile runs is part of any import cycle that leads back to it
+func TestImportCycle(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"a.lox": "print \"a\";\nimport \"b.lox\" as b;\n",
+		"b.lox": "print \"b\";\nimport \"a.lox\" as a;\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := &bytes.Buffer{}
+	_, err := New(WithStdout(out)).RunFile(filepath.Join(dir, "a.lox"))
+	assert.EqualError(t, err, `cannot import "b.lox" [1,0]
+cannot import "a.lox" [1,0]
+import cycle: "a.lox" -> "b.lox" -> "a.lox"`)
+	assert.Equal(t, "a\nb\n", out.String())
+}
+
+func TestBudgets(t *testing.T) {
+	i := New(WithStdout(&bytes.Buffer{}), WithLimits(eval.Limits{Steps: 100}))
+	_, err := i.Eval("while (true) {}")
+	assert.Equal(t, eval.ErrStepLimit, err)
+
+	// Each top-level call has the whole budget
+	_, err = i.Eval("fun count(n) { var i = 0; while (i < n) i = i + 1; return i; }")
+	assert.NoError(t, err)
+	for n := 0; n < 3; n++ {
+		v, err := i.Call("count", value.Num(30))
+		assert.NoError(t, err)
+		assert.Equal(t, value.Num(30), v)
+	}
+	_, err = i.Call("count", value.Num(100))
+	assert.Equal(t, eval.ErrStepLimit, err)
+
+	i = New(WithStdout(&bytes.Buffer{}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = i.EvalContext(ctx, "fun spin() { while (true) {} }\nspin();")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// Modules are bound by the same budget as the program that imports them
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "spin.lox"), []byte("fun spin() { while (true) {} }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "count.lox"), []byte("var i = 0;\nwhile (i < 1000) i = i + 1;"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	i = New(WithStdout(&bytes.Buffer{}), WithPath(dir))
+	_, err = i.Eval(`from "spin.lox" import spin;`)
+	assert.NoError(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = i.EvalContext(ctx, "spin();")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	i = New(WithStdout(&bytes.Buffer{}), WithPath(dir), WithLimits(eval.Limits{Steps: 100}))
+	_, err = i.Eval(`import "count.lox" as c;`)
+	assert.Equal(t, eval.ErrStepLimit, err)
+}
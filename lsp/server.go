@@ -0,0 +1,341 @@
+// Package lsp is a Language Server Protocol server for Lox, speaking JSON-RPC over a
+// pair of streams. It reports the diagnostics from parse and analysis, and uses the
+// resolver's index to answer definition, reference and hover requests.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/jan-g/lox/analysis"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/builtin"
+	"github.com/jan-g/lox/lex"
+	"github.com/jan-g/lox/parse"
+	"github.com/jan-g/lox/wire"
+	"io"
+	"strings"
+)
+
+type Server struct {
+	in   *bufio.Reader
+	out  io.Writer
+	docs map[string]*document
+}
+
+// document is an open file, as last analysed.
+type document struct {
+	uri   string
+	prog  ast.Program
+	index *analysis.Index
+	diags ast.Diagnostics
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: make(map[string]*document),
+	}
+}
+
+// Serve handles messages until the client sends exit, or the input is closed.
+func (s *Server) Serve() error {
+	for {
+		body, err := wire.ReadMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var m message
+		if err := json.Unmarshal(body, &m); err != nil {
+			if err := s.replyError(nil, codeParseError, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		if m.Method == "exit" {
+			return nil
+		}
+		if err := s.handle(&m); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) handle(m *message) error {
+	var result interface{}
+	var err error
+	switch m.Method {
+	case "initialize":
+		r := InitializeResult{Capabilities: ServerCapabilities{
+			TextDocumentSync:       syncFull,
+			DefinitionProvider:     true,
+			ReferencesProvider:     true,
+			HoverProvider:          true,
+			DocumentSymbolProvider: true,
+		}}
+		r.ServerInfo.Name = "lox"
+		result = r
+	case "shutdown":
+	case "textDocument/didOpen":
+		var p DidOpenTextDocumentParams
+		if err = json.Unmarshal(m.Params, &p); err == nil {
+			err = s.update(p.TextDocument.URI, p.TextDocument.Text)
+		}
+	case "textDocument/didChange":
+		var p DidChangeTextDocumentParams
+		if err = json.Unmarshal(m.Params, &p); err == nil && len(p.ContentChanges) > 0 {
+			err = s.update(p.TextDocument.URI, p.ContentChanges[len(p.ContentChanges)-1].Text)
+		}
+	case "textDocument/didClose":
+		var p DidCloseTextDocumentParams
+		if err = json.Unmarshal(m.Params, &p); err == nil {
+			delete(s.docs, p.TextDocument.URI)
+		}
+	case "textDocument/definition":
+		var p TextDocumentPositionParams
+		if err = json.Unmarshal(m.Params, &p); err == nil {
+			result = s.definition(p)
+		}
+	case "textDocument/references":
+		var p ReferenceParams
+		if err = json.Unmarshal(m.Params, &p); err == nil {
+			result = s.references(p)
+		}
+	case "textDocument/hover":
+		var p TextDocumentPositionParams
+		if err = json.Unmarshal(m.Params, &p); err == nil {
+			result = s.hover(p)
+		}
+	case "textDocument/documentSymbol":
+		var p DocumentSymbolParams
+		if err = json.Unmarshal(m.Params, &p); err == nil {
+			result = s.symbols(p)
+		}
+	default:
+		if m.ID != nil {
+			return s.replyError(m.ID, codeMethodNotFound, fmt.Sprintf("method not supported: %s", m.Method))
+		}
+		// Notifications that we don't understand are ignored
+		return nil
+	}
+
+	if m.ID == nil {
+		// A notification: there is nothing to reply to, even with an error
+		return nil
+	}
+	if err != nil {
+		return s.replyError(m.ID, codeInvalidParams, err.Error())
+	}
+	return s.reply(m.ID, result)
+}
+
+func (s *Server) send(m message) error {
+	m.JSONRPC = "2.0"
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return wire.WriteMessage(s.out, body)
+}
+
+func (s *Server) reply(id *json.RawMessage, result interface{}) error {
+	r, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return s.send(message{ID: id, Result: r})
+}
+
+func (s *Server) replyError(id *json.RawMessage, code int, msg string) error {
+	if id == nil {
+		null := json.RawMessage("null")
+		id = &null
+	}
+	return s.send(message{ID: id, Error: &responseError{Code: code, Message: msg}})
+}
+
+func (s *Server) notify(method string, params interface{}) error {
+	p, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return s.send(message{Method: method, Params: p})
+}
+
+// update reanalyses a document and publishes its diagnostics.
+func (s *Server) update(uri string, text string) error {
+	d := analyse(uri, text)
+	s.docs[uri] = d
+	ds := make([]Diagnostic, len(d.diags))
+	for i, diag := range d.diags {
+		ds[i] = Diagnostic{
+			Range:    toRange(diag.Loc),
+			Severity: severityError,
+			Source:   "lox",
+			Message:  diag.Message,
+		}
+	}
+	return s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: uri, Diagnostics: ds})
+}
+
+func analyse(uri string, text string) *document {
+	d := &document{uri: uri}
+	prog, err := parse.NewFile(uri, strings.NewReader(text)).Parse()
+	d.prog = prog.(ast.Program)
+	if err != nil {
+		// Names in the statements that failed to parse would be reported as undefined,
+		// so only the syntax errors are given.
+		d.diags = err.(ast.Diagnostics)
+		d.index, _ = analysis.Resolve(d.prog, builtin.Names()...)
+		return d
+	}
+	d.index, err = analysis.Resolve(d.prog, builtin.Names()...)
+	if err != nil {
+		d.diags = err.(ast.Diagnostics)
+	}
+	return d
+}
+
+// lookup finds the definition of the name at a position.
+func (s *Server) lookup(p TextDocumentPositionParams) (*document, *analysis.Definition) {
+	d, ok := s.docs[p.TextDocument.URI]
+	if !ok {
+		return nil, nil
+	}
+	return d, d.index.At(p.Position.pos())
+}
+
+func (s *Server) definition(p TextDocumentPositionParams) []Location {
+	d, def := s.lookup(p)
+	if def == nil {
+		return nil
+	}
+	return []Location{{URI: d.uri, Range: toRange(def.Loc)}}
+}
+
+func (s *Server) references(p ReferenceParams) []Location {
+	d, def := s.lookup(p.TextDocumentPositionParams)
+	if def == nil {
+		return nil
+	}
+	var locs []Location
+	if p.Context.IncludeDeclaration {
+		locs = append(locs, Location{URI: d.uri, Range: toRange(def.Loc)})
+	}
+	for _, r := range def.Refs {
+		locs = append(locs, Location{URI: d.uri, Range: toRange(r)})
+	}
+	return locs
+}
+
+func (s *Server) hover(p TextDocumentPositionParams) *Hover {
+	d, def := s.lookup(p)
+	if d == nil {
+		return nil
+	}
+	var text string
+	var at ast.Span
+	if def != nil {
+		at = def.Loc
+		switch def.Kind {
+		case analysis.KindVar:
+			text = "var " + def.Name
+		case analysis.KindParam:
+			text = "parameter " + def.Name
+		case analysis.KindClass:
+			text = "class " + def.Name
+		case analysis.KindFun:
+			text = "fun " + signature(def.Name, def.Fun)
+		case analysis.KindModule:
+			text = fmt.Sprintf("module %q", def.Path)
+		case analysis.KindImport:
+			text = fmt.Sprintf("%s from %q", def.Name, def.Path)
+		}
+	} else if m, c := methodAt(d.prog, p.Position.pos()); m != nil {
+		// Methods are not bound in any scope, but we can describe their declarations
+		at = m.Name.Span()
+		text = c.Name.VarName() + "." + signature(m.Name.VarName(), m)
+	} else {
+		return nil
+	}
+	return &Hover{
+		Contents: MarkupContent{Kind: "plaintext", Value: text},
+		Range:    toRange(at),
+	}
+}
+
+func signature(name string, f *ast.FunDef) string {
+	ps := make([]string, len(f.Params))
+	for i, p := range f.Params {
+		ps[i] = p.VarName()
+	}
+	return fmt.Sprintf("%s(%s)", name, strings.Join(ps, ", "))
+}
+
+func methodAt(prog ast.Program, pos lex.Pos) (*ast.FunDef, ast.ClassDef) {
+	for _, st := range prog.Stmts {
+		if c, ok := st.(ast.ClassDef); ok {
+			for _, m := range c.Methods {
+				loc := m.Name.Span()
+				if !before(pos, loc.Start) && !before(loc.End, pos) {
+					return m, c
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func before(a, b lex.Pos) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Col < b.Col
+}
+
+// symbols lists the top-level classes, with their methods, and functions.
+func (s *Server) symbols(p DocumentSymbolParams) []DocumentSymbol {
+	d, ok := s.docs[p.TextDocument.URI]
+	if !ok {
+		return nil
+	}
+	syms := []DocumentSymbol{}
+	for _, st := range d.prog.Stmts {
+		switch st := st.(type) {
+		case ast.ClassDef:
+			c := DocumentSymbol{
+				Name:           st.Name.VarName(),
+				Kind:           symbolClass,
+				Range:          toRange(st.Span()),
+				SelectionRange: toRange(st.Name.Span()),
+			}
+			if st.Superclass != nil {
+				c.Detail = "< " + st.Superclass.VarName()
+			}
+			for _, m := range st.Methods {
+				kind := symbolMethod
+				if m.Name.VarName() == "init" {
+					kind = symbolConstructor
+				}
+				c.Children = append(c.Children, DocumentSymbol{
+					Name:           m.Name.VarName(),
+					Detail:         signature(m.Name.VarName(), m),
+					Kind:           kind,
+					Range:          toRange(m.Span()),
+					SelectionRange: toRange(m.Name.Span()),
+				})
+			}
+			syms = append(syms, c)
+		case *ast.FunDef:
+			syms = append(syms, DocumentSymbol{
+				Name:           st.Name.VarName(),
+				Detail:         signature(st.Name.VarName(), st),
+				Kind:           symbolFunction,
+				Range:          toRange(st.Span()),
+				SelectionRange: toRange(st.Name.Span()),
+			})
+		}
+	}
+	return syms
+}
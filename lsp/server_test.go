@@ -0,0 +1,244 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/jan-g/lox/wire"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+// client drives a Server in-process, as an editor would.
+type client struct {
+	t      *testing.T
+	w      io.WriteCloser
+	r      *bufio.Reader
+	nextID int
+	notes  []message // notifications received while waiting for a response
+	done   chan error
+}
+
+func newClient(t *testing.T) *client {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := &client{t: t, w: inW, r: bufio.NewReader(outR), done: make(chan error, 1)}
+	go func() {
+		err := NewServer(inR, outW).Serve()
+		_ = outW.Close()
+		c.done <- err
+	}()
+	return c
+}
+
+func (c *client) send(m message) {
+	m.JSONRPC = "2.0"
+	body, err := json.Marshal(m)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := wire.WriteMessage(c.w, body); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) read() message {
+	body, err := wire.ReadMessage(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var m message
+	if err := json.Unmarshal(body, &m); err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+func (c *client) notify(method string, params interface{}) {
+	p, _ := json.Marshal(params)
+	c.send(message{Method: method, Params: p})
+}
+
+// call makes a request and decodes its result into result.
+func (c *client) call(method string, params interface{}, result interface{}) *responseError {
+	c.nextID++
+	id, _ := json.Marshal(c.nextID)
+	raw := json.RawMessage(id)
+	p, _ := json.Marshal(params)
+	c.send(message{ID: &raw, Method: method, Params: p})
+	for {
+		m := c.read()
+		if m.ID == nil {
+			c.notes = append(c.notes, m)
+			continue
+		}
+		if string(*m.ID) != string(id) {
+			c.t.Fatalf("response to %s, waiting for %s", *m.ID, id)
+		}
+		if m.Error == nil && result != nil {
+			if err := json.Unmarshal(m.Result, result); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return m.Error
+	}
+}
+
+// diagnostics waits for the next diagnostics to be published.
+func (c *client) diagnostics() PublishDiagnosticsParams {
+	var m message
+	if len(c.notes) > 0 {
+		m, c.notes = c.notes[0], c.notes[1:]
+	} else {
+		m = c.read()
+	}
+	assert.Equal(c.t, "textDocument/publishDiagnostics", m.Method)
+	var p PublishDiagnosticsParams
+	if err := json.Unmarshal(m.Params, &p); err != nil {
+		c.t.Fatal(err)
+	}
+	return p
+}
+
+func (c *client) exit() {
+	assert.Nil(c.t, c.call("shutdown", nil, nil))
+	c.notify("exit", nil)
+	assert.NoError(c.t, <-c.done)
+}
+
+const uri = "file:///test.lox"
+
+const src = `fun add(a, b) {
+  return a + b;
+}
+class Counter {
+  init(start) { this.n = start; }
+  bump(by) { this.n = add(this.n, by); }
+}
+var c = Counter(1);
+c.bump(2);
+print c.n + add(1, 2);
+`
+
+func at(line, char int) TextDocumentPositionParams {
+	return TextDocumentPositionParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: line, Character: char},
+	}
+}
+
+func span(l1, c1, l2, c2 int) Range {
+	return Range{Start: Position{l1, c1}, End: Position{l2, c2}}
+}
+
+func open(c *client, text string) PublishDiagnosticsParams {
+	c.notify("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "lox", Version: 1, Text: text},
+	})
+	return c.diagnostics()
+}
+
+func TestInitialize(t *testing.T) {
+	c := newClient(t)
+	var r InitializeResult
+	assert.Nil(t, c.call("initialize", map[string]interface{}{}, &r))
+	assert.True(t, r.Capabilities.DefinitionProvider)
+	assert.Equal(t, syncFull, r.Capabilities.TextDocumentSync)
+
+	err := c.call("textDocument/formatting", map[string]interface{}{}, nil)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, codeMethodNotFound, err.Code)
+	}
+	c.exit()
+}
+
+func TestDiagnostics(t *testing.T) {
+	c := newClient(t)
+	d := open(c, "print x;\nvar y = 1;\n")
+	assert.Equal(t, uri, d.URI)
+	assert.Equal(t, []Diagnostic{{
+		Range: span(0, 6, 0, 7), Severity: severityError, Source: "lox", Message: "undefined variable: x",
+	}}, d.Diagnostics)
+
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": 2},
+		"contentChanges": []map[string]string{{"text": "print (1;\nprint y;\n"}},
+	})
+	d = c.diagnostics()
+	if assert.Len(t, d.Diagnostics, 1) {
+		assert.Equal(t, "expect ')' after expression", d.Diagnostics[0].Message)
+	}
+
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": 3},
+		"contentChanges": []map[string]string{{"text": "print len([]);\n"}},
+	})
+	assert.Empty(t, c.diagnostics().Diagnostics)
+	c.exit()
+}
+
+func TestNavigation(t *testing.T) {
+	c := newClient(t)
+	assert.Empty(t, open(c, src).Diagnostics)
+
+	// From the use of add in a method, back to the function
+	var locs []Location
+	assert.Nil(t, c.call("textDocument/definition", at(5, 22), &locs))
+	assert.Equal(t, []Location{{URI: uri, Range: span(0, 4, 0, 7)}}, locs)
+
+	// A parameter
+	assert.Nil(t, c.call("textDocument/definition", at(1, 13), &locs))
+	assert.Equal(t, []Location{{URI: uri, Range: span(0, 11, 0, 12)}}, locs)
+
+	// Nothing is bound here
+	assert.Nil(t, c.call("textDocument/definition", at(9, 0), &locs))
+	assert.Empty(t, locs)
+
+	var refs []Location
+	ps := ReferenceParams{TextDocumentPositionParams: at(0, 5)}
+	ps.Context.IncludeDeclaration = true
+	assert.Nil(t, c.call("textDocument/references", ps, &refs))
+	assert.Equal(t, []Location{
+		{URI: uri, Range: span(0, 4, 0, 7)},
+		{URI: uri, Range: span(5, 22, 5, 25)},
+		{URI: uri, Range: span(9, 12, 9, 15)},
+	}, refs)
+	c.exit()
+}
+
+func TestHover(t *testing.T) {
+	c := newClient(t)
+	open(c, src)
+
+	var h Hover
+	assert.Nil(t, c.call("textDocument/hover", at(9, 13), &h))
+	assert.Equal(t, "fun add(a, b)", h.Contents.Value)
+	assert.Equal(t, span(0, 4, 0, 7), h.Range)
+
+	assert.Nil(t, c.call("textDocument/hover", at(4, 3), &h))
+	assert.Equal(t, "Counter.init(start)", h.Contents.Value)
+
+	assert.Nil(t, c.call("textDocument/hover", at(7, 9), &h))
+	assert.Equal(t, "class Counter", h.Contents.Value)
+	c.exit()
+}
+
+func TestDocumentSymbols(t *testing.T) {
+	c := newClient(t)
+	open(c, src)
+
+	var syms []DocumentSymbol
+	assert.Nil(t, c.call("textDocument/documentSymbol", DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: uri}}, &syms))
+	if assert.Len(t, syms, 2) {
+		assert.Equal(t, "add", syms[0].Name)
+		assert.Equal(t, symbolFunction, syms[0].Kind)
+		assert.Equal(t, "Counter", syms[1].Name)
+		assert.Equal(t, symbolClass, syms[1].Kind)
+		assert.Equal(t, span(3, 0, 6, 1), syms[1].Range)
+		if assert.Len(t, syms[1].Children, 2) {
+			assert.Equal(t, symbolConstructor, syms[1].Children[0].Kind)
+			assert.Equal(t, "bump(by)", syms[1].Children[1].Detail)
+		}
+	}
+	c.exit()
+}
@@ -0,0 +1,131 @@
+// Package module finds, runs and caches the modules that import statements name.
+package module
+
+import (
+	"fmt"
+	"github.com/jan-g/lox/analysis"
+	"github.com/jan-g/lox/parse"
+	"github.com/jan-g/lox/value"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Loader runs each module once, the first time it is imported, and keeps the result.
+//
+// A module path is looked for relative to the directory of the file that imports it,
+// then in each directory of Path in turn. Modules that are the same file are the same
+// module, however they are named.
+type Loader struct {
+	Path []string
+
+	// New makes the environment that a module runs in, which ought to have this Loader
+	// as its importer. Predefined names the globals that it already has, such as the
+	// builtins, which the module may refer to.
+	New        func() value.Env
+	Predefined []string
+
+	modules map[string]*value.Module // by absolute file name
+	loading []string                 // the modules being run, innermost last
+	paths   []string                 // and the paths they were imported by
+}
+
+var _ value.Importer = &Loader{}
+
+// NewLoader makes a Loader whose modules run in environments made by newEnv.
+func NewLoader(newEnv func(l *Loader) value.Env, predefined []string, path ...string) *Loader {
+	l := &Loader{Path: path, Predefined: predefined}
+	l.New = func() value.Env { return newEnv(l) }
+	return l
+}
+
+// Enter notes that the program in file, which is not itself imported, is being run.
+// Should one of its imports lead back to it, that is reported as an import cycle rather
+// than running the file again as a module. Call the returned func once it has finished.
+func (l *Loader) Enter(file string) (exit func()) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		abs = file
+	}
+	// Cycles name the program by its file, as imports name the modules they run
+	return l.enter(abs, filepath.Base(file))
+}
+
+// enter pushes a module onto those being run, until the returned func pops it.
+func (l *Loader) enter(file string, path string) func() {
+	l.loading = append(l.loading, file)
+	l.paths = append(l.paths, path)
+	return func() {
+		l.loading = l.loading[:len(l.loading)-1]
+		l.paths = l.paths[:len(l.paths)-1]
+	}
+}
+
+func (l *Loader) Import(from string, path string) (*value.Module, error) {
+	file, err := l.find(from, path)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := l.modules[file]; ok {
+		return m, nil
+	}
+	for i, f := range l.loading {
+		if f == file {
+			cycle := make([]string, 0, len(l.loading)-i+1)
+			for _, p := range append(l.paths[i:], path) {
+				cycle = append(cycle, fmt.Sprintf("%q", p))
+			}
+			return nil, fmt.Errorf("import cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	defer l.enter(file, path)()
+
+	m, err := l.run(file, path)
+	if err != nil {
+		return nil, err
+	}
+	if l.modules == nil {
+		l.modules = make(map[string]*value.Module)
+	}
+	l.modules[file] = m
+	return m, nil
+}
+
+// find returns the absolute name of the file that a module path refers to.
+func (l *Loader) find(from string, path string) (string, error) {
+	var candidates []string
+	if filepath.IsAbs(path) {
+		candidates = []string{path}
+	} else {
+		candidates = append(candidates, filepath.Join(filepath.Dir(from), path))
+		for _, dir := range l.Path {
+			candidates = append(candidates, filepath.Join(dir, path))
+		}
+	}
+	for _, c := range candidates {
+		if fi, err := os.Stat(c); err == nil && !fi.IsDir() {
+			return filepath.Abs(c)
+		}
+	}
+	return "", fmt.Errorf("module %q not found", path)
+}
+
+func (l *Loader) run(file string, path string) (*value.Module, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	prog, err := parse.NewFile(file, f).Parse()
+	if err != nil {
+		return nil, err
+	}
+	if err := analysis.Analyse(prog, l.Predefined...); err != nil {
+		return nil, err
+	}
+	env := l.New()
+	if err := env.Run(prog); err != nil {
+		return nil, err
+	}
+	return value.NewModule(path, env, analysis.Globals(prog)...), nil
+}
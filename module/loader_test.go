@@ -0,0 +1,74 @@
+package module
+
+import (
+	"bytes"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/builtin"
+	"github.com/jan-g/lox/eval"
+	"github.com/jan-g/lox/value"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func write(t *testing.T, dir string, files map[string]string) {
+	for name, src := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newLoader(out *bytes.Buffer, path ...string) *Loader {
+	return NewLoader(func(l *Loader) value.Env {
+		e := eval.New(out)
+		e.SetImporter(l)
+		return builtin.InitEnv(e)
+	}, builtin.Names(), path...)
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, map[string]string{
+		"main/prog.lox": "",
+		"main/local.lox": `print "local";
+var x = 1;`,
+		"lib/util.lox": `print "util";
+fun twice(n) { return 2 * n; }`,
+		"bad/syntax.lox": "var = 2;",
+	})
+	out := &bytes.Buffer{}
+	l := newLoader(out, filepath.Join(dir, "lib"))
+	from := filepath.Join(dir, "main", "prog.lox")
+
+	// Found next to the importing file
+	m, err := l.Import(from, "local.lox")
+	if assert.NoError(t, err) {
+		v, err := m.Get("x")
+		assert.NoError(t, err)
+		assert.Equal(t, value.Num(1), v)
+	}
+
+	// Found on the search path, and run only once however it is named
+	m1, err := l.Import(from, "util.lox")
+	assert.NoError(t, err)
+	m2, err := l.Import(filepath.Join(dir, "lib", "x.lox"), "./util.lox")
+	assert.NoError(t, err)
+	assert.Same(t, m1, m2)
+	assert.Equal(t, "local\nutil\n", out.String())
+	_, err = m1.Get("print")
+	assert.EqualError(t, err, "Undefined property 'print' on <module util.lox>")
+
+	_, err = l.Import(from, "missing.lox")
+	assert.EqualError(t, err, `module "missing.lox" not found`)
+
+	_, err = l.Import(from, "../bad/syntax.lox")
+	if ds, ok := err.(ast.Diagnostics); assert.True(t, ok) {
+		assert.Equal(t, filepath.Join(dir, "bad", "syntax.lox"), ds[0].Loc.File)
+	}
+}
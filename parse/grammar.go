@@ -4,66 +4,126 @@ import (
 	"fmt"
 	"github.com/jan-g/lox/ast"
 	"github.com/jan-g/lox/lex"
+	"math"
+	"math/big"
 	"strconv"
+	"strings"
 )
 
-func (p *parser) Parse() (e ast.Stmt, err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			err = e.(error)
-		}
-	}()
-	e = p.Program()
-	if p.Eof() {
-		return e, nil
-	}
-	return nil, fmt.Errorf("unexpected token: %s %s", p.Peek().Lexeme, p.Peek().Start)
+// Parse returns as much of the program as could be parsed. If there were syntax
+// errors, they are all returned as ast.Diagnostics.
+func (p *parser) Parse() (ast.Stmt, error) {
+	prog := p.Program().(ast.Program)
+	prog.Comments = p.l.Comments
+	return prog, p.errs.Err()
 }
 
 func (p *parser) Program() ast.Stmt {
+	start := p.Peek().Start
 	sts := []ast.Stmt{}
 	for !p.Eof() {
-		s := p.Decl()
-		if s == nil {
-			break
+		if s := p.Decl(); s != nil {
+			sts = append(sts, s)
 		}
-		sts = append(sts, s)
 	}
-	return ast.ProgStmt(sts...)
+	return ast.ProgStmt(p.span(start), sts...)
 }
 
-func (p *parser) Decl() ast.Stmt {
+// Decl parses a declaration or statement. On a syntax error, the error is recorded,
+// the parser skips to the next statement boundary, and Decl returns nil.
+func (p *parser) Decl() (s ast.Stmt) {
+	defer func() {
+		if e := recover(); e != nil {
+			d, ok := e.(*ast.Diagnostic)
+			if !ok {
+				panic(e)
+			}
+			p.errs = append(p.errs, d)
+			p.synchronise()
+			s = nil
+		}
+	}()
+	return p.decl()
+}
+
+func (p *parser) decl() ast.Stmt {
 	if p.Match(lex.TokKW, "var") {
 		return p.DeclStmt()
 	}
 	if p.Match(lex.TokKW, "fun") {
-		return p.FunDef()
+		return p.FunDef(p.Previous().Start)
 	}
 	if p.Match(lex.TokKW, "class") {
 		return p.ClassDef()
 	}
+	if p.Match(lex.TokKW, "import") {
+		return p.ImportStmt()
+	}
+	if p.Match(lex.TokKW, "from") {
+		return p.FromImportStmt()
+	}
 	return p.Stmt()
 }
 
+// ImportStmt parses `import "path" as name;`
+func (p *parser) ImportStmt() ast.Stmt {
+	start := p.Previous().Start
+	path := p.modulePath("import requires a module path")
+	p.Consume("expect 'as' after module path", lex.TokKW, "as")
+	name := p.Consume("expect module name after 'as'", lex.TokId)
+	p.Consume("expect ';' after import", lex.TokPunc, ";")
+	return ast.ImportStmt(p.span(start), path.Lexeme, p.tokSpan(path), ast.Id(p.tokSpan(name), name.Lexeme))
+}
+
+// modulePath parses the string naming a module, which may be raw.
+func (p *parser) modulePath(msg string) lex.T {
+	if p.Match(lex.TokRaw) {
+		return p.Previous()
+	}
+	return p.Consume(msg, lex.TokStr)
+}
+
+// FromImportStmt parses `from "path" import a, b;`
+func (p *parser) FromImportStmt() ast.Stmt {
+	start := p.Previous().Start
+	path := p.modulePath("from requires a module path")
+	p.Consume("expect 'import' after module path", lex.TokKW, "import")
+	var names []ast.Var
+	for {
+		name := p.Consume("expect a name to import", lex.TokId)
+		names = append(names, ast.Id(p.tokSpan(name), name.Lexeme))
+		if !p.Match(lex.TokPunc, ",") {
+			break
+		}
+	}
+	p.Consume("expect ';' after import", lex.TokPunc, ";")
+	return ast.FromImportStmt(p.span(start), path.Lexeme, p.tokSpan(path), names...)
+}
+
 func (p *parser) DeclStmt() ast.Stmt {
-	name := p.Consume("variable name expected", lex.TokId).Lexeme
-	var init ast.Expr = ast.Nil
+	start := p.Previous().Start
+	name := p.Consume("variable name expected", lex.TokId)
+	var init ast.Expr
 	if p.Match(lex.TokOp, "=") {
 		init = p.Expr()
+	} else {
+		// The implicit initialiser is attributed to the variable name
+		init = ast.Nil(p.tokSpan(name))
 	}
 	p.Consume("expect ';' after declaration", lex.TokPunc, ";")
-	return ast.Decl(name, init)
+	return ast.Decl(p.span(start), p.tokSpan(name), name.Lexeme, init)
 }
 
-func (p *parser) FunDef() ast.Stmt {
-	name := p.Consume("function requires a name", lex.TokId).Lexeme
-	fName := ast.Id(name)
+// FunDef parses a named function; start is the position of the "fun" keyword, if any.
+func (p *parser) FunDef(start lex.Pos) ast.Stmt {
+	name := p.Consume("function requires a name", lex.TokId)
+	fName := ast.Id(p.tokSpan(name), name.Lexeme)
 	p.Consume("function definition expects '('", lex.TokPunc, "(")
 	var params []ast.Var
 	if !p.Check(lex.TokPunc, ")") {
 		for {
 			formal := p.Consume("formal parameter must be an identifier", lex.TokId)
-			params = append(params, ast.Id(formal.Lexeme))
+			params = append(params, ast.Id(p.tokSpan(formal), formal.Lexeme))
 			if !p.Match(lex.TokPunc, ",") {
 				break
 			}
@@ -72,23 +132,25 @@ func (p *parser) FunDef() ast.Stmt {
 	p.Consume("formal parameters must end with ')'", lex.TokPunc, ")")
 	p.Consume("function body must be a block", lex.TokPunc, "{")
 	body := p.Block()
-	return ast.FunStmt(fName, params, body)
+	return ast.FunStmt(p.span(start), fName, params, body)
 }
 
 func (p *parser) ClassDef() ast.Stmt {
-	name := p.Consume("expect class name", lex.TokId).Lexeme
+	start := p.Previous().Start
+	name := p.Consume("expect class name", lex.TokId)
 	var sc ast.Var
 	if p.Match(lex.TokOp, "<") {
-		sc = ast.Id(p.Consume("expect superclass name", lex.TokId).Lexeme)
+		sup := p.Consume("expect superclass name", lex.TokId)
+		sc = ast.Id(p.tokSpan(sup), sup.Lexeme)
 	}
 	p.Consume("class def required '{'", lex.TokPunc, "{")
 	var methods []*ast.FunDef
 	for !p.Check(lex.TokPunc, "}") && !p.Eof() {
-		m := p.FunDef().(*ast.FunDef)
+		m := p.FunDef(p.Peek().Start).(*ast.FunDef)
 		methods = append(methods, m)
 	}
 	p.Consume("class def required '}'", lex.TokPunc, "}")
-	return ast.ClassStmt(ast.Id(name), sc, methods...)
+	return ast.ClassStmt(p.span(start), ast.Id(p.tokSpan(name), name.Lexeme), sc, methods...)
 }
 
 func (p *parser) Stmt() ast.Stmt {
@@ -107,6 +169,25 @@ func (p *parser) Stmt() ast.Stmt {
 	if p.Match(lex.TokKW, "return") {
 		return p.ReturnStmt()
 	}
+	if p.Match(lex.TokKW, "throw") {
+		start := p.Previous().Start
+		e := p.Expr()
+		p.Consume("throw requires ';'", lex.TokPunc, ";")
+		return ast.ThrowStmt(p.span(start), e)
+	}
+	if p.Match(lex.TokKW, "try") {
+		return p.TryStmt()
+	}
+	if p.Match(lex.TokKW, "break") {
+		start := p.Previous().Start
+		p.Consume("break requires ';'", lex.TokPunc, ";")
+		return ast.BreakStmt(p.span(start))
+	}
+	if p.Match(lex.TokKW, "continue") {
+		start := p.Previous().Start
+		p.Consume("continue requires ';'", lex.TokPunc, ";")
+		return ast.ContinueStmt(p.span(start))
+	}
 	if p.Match(lex.TokPunc, "{") {
 		return p.Block()
 	}
@@ -114,6 +195,7 @@ func (p *parser) Stmt() ast.Stmt {
 }
 
 func (p *parser) IfStmt() ast.Stmt {
+	start := p.Previous().Start
 	p.Consume("if condition must be preceded by '('", lex.TokPunc, "(")
 	cond := p.Expr()
 	p.Consume("if condition must be followed by ')'", lex.TokPunc, ")")
@@ -122,18 +204,20 @@ func (p *parser) IfStmt() ast.Stmt {
 	if p.Match(lex.TokKW, "else") {
 		el = p.Stmt()
 	}
-	return ast.IfStmt(cond, th, el)
+	return ast.IfStmt(p.span(start), cond, th, el)
 }
 
 func (p *parser) WhileStmt() ast.Stmt {
+	start := p.Previous().Start
 	p.Consume("while condition must be preceded by '('", lex.TokPunc, "(")
 	cond := p.Expr()
 	p.Consume("while condition must be followed by ')'", lex.TokPunc, ")")
 	body := p.Stmt()
-	return ast.WhileStmt(cond, body)
+	return ast.WhileStmt(p.span(start), cond, body)
 }
 
 func (p *parser) ForStmt() ast.Stmt {
+	start := p.Previous().Start
 	p.Consume("for condition must be followed by '('", lex.TokPunc, "(")
 
 	var init ast.Stmt
@@ -160,48 +244,77 @@ func (p *parser) ForStmt() ast.Stmt {
 	p.Consume("for increment must be followed by ')'", lex.TokPunc, ")")
 	body := p.Stmt()
 
-	// Desugar
-	if incr != nil {
-		body = ast.BlockStmt(body, ast.ExprStmt(incr))
-	}
+	// Desugar. The synthesised nodes all span the whole of the for statement.
+	// The increment is kept separate from the body so that continue still runs it.
+	loc := p.span(start)
 	if cond == nil {
-		cond = ast.True
+		cond = ast.True(loc)
 	}
-	body = ast.WhileStmt(cond, body)
+	body = ast.LoopStmt(loc, cond, body, incr)
 	if init != nil {
-		body = ast.BlockStmt(init, body)
+		body = ast.BlockStmt(loc, init, body)
 	}
 	return body
 }
 
+func (p *parser) TryStmt() ast.Stmt {
+	start := p.Previous().Start
+	p.Consume("try body must be a block", lex.TokPunc, "{")
+	body := p.Block()
+	var v ast.Var
+	var catch, finally ast.Stmt
+	if p.Match(lex.TokKW, "catch") {
+		p.Consume("catch must be followed by '('", lex.TokPunc, "(")
+		name := p.Consume("catch requires a variable name", lex.TokId)
+		v = ast.Id(p.tokSpan(name), name.Lexeme)
+		p.Consume("catch variable must be followed by ')'", lex.TokPunc, ")")
+		p.Consume("catch body must be a block", lex.TokPunc, "{")
+		catch = p.Block()
+	}
+	if p.Match(lex.TokKW, "finally") {
+		p.Consume("finally body must be a block", lex.TokPunc, "{")
+		finally = p.Block()
+	}
+	if catch == nil && finally == nil {
+		panic(p.Error("try requires catch or finally"))
+	}
+	return ast.TryStmt(p.span(start), body, v, catch, finally)
+}
+
 func (p *parser) Block() ast.Stmt {
+	start := p.Previous().Start
 	sts := []ast.Stmt{}
 	for !p.Check(lex.TokPunc, "}") && !p.Eof() {
-		sts = append(sts, p.Decl())
+		if s := p.Decl(); s != nil {
+			sts = append(sts, s)
+		}
 	}
 	p.Consume("block must close with '}'", lex.TokPunc, "}")
-	return ast.BlockStmt(sts...)
+	return ast.BlockStmt(p.span(start), sts...)
 }
 
 func (p *parser) PrintStmt() ast.Stmt {
+	start := p.Previous().Start
 	e := p.Expr()
 	p.Consume("';' expected after value", lex.TokPunc, ";")
-	return ast.PrintStmt(e)
+	return ast.PrintStmt(p.span(start), e)
 }
 
 func (p *parser) ExprStmt() ast.Stmt {
+	start := p.Peek().Start
 	e := p.Expr()
 	p.Consume("';' expected after value", lex.TokPunc, ";")
-	return ast.ExprStmt(e)
+	return ast.ExprStmt(p.span(start), e)
 }
 
 func (p *parser) ReturnStmt() ast.Stmt {
+	start := p.Previous().Start
 	if p.Match(lex.TokPunc, ";") {
-		return ast.ReturnStmt(nil)
+		return ast.ReturnStmt(p.span(start), nil)
 	}
 	e := p.Expr()
 	p.Consume("return requires ';'", lex.TokPunc, ";")
-	return ast.ReturnStmt(e)
+	return ast.ReturnStmt(p.span(start), e)
 }
 
 func (p *parser) Expr() ast.Expr {
@@ -209,14 +322,17 @@ func (p *parser) Expr() ast.Expr {
 }
 
 func (p *parser) Assign() ast.Expr {
+	start := p.Peek().Start
 	lhs := p.LogOr()
 	if p.Match(lex.TokOp, "=") {
 		rhs := p.Assign()
 		switch lhs := lhs.(type) {
 		case ast.Var:
-			return ast.Assignment(lhs, rhs)
+			return ast.Assignment(p.span(start), lhs, rhs)
 		case *ast.Get:
-			return ast.SetAttr(lhs.Object, lhs.Attribute, rhs)
+			return ast.SetAttr(p.span(start), lhs.Object, lhs.Attribute, rhs, lhs.Pos)
+		case *ast.Index:
+			return ast.SetIndexExpr(p.span(start), lhs.Object, lhs.Index, rhs, lhs.Pos)
 		}
 		panic(p.Error("assignment must have variable on the LHS"))
 	}
@@ -224,64 +340,73 @@ func (p *parser) Assign() ast.Expr {
 }
 
 func (p *parser) LogOr() ast.Expr {
+	start := p.Peek().Start
 	cond := p.LogAnd()
 	for p.Match(lex.TokKW, "or") {
 		c2 := p.LogOr()
-		cond = ast.Log(cond, "or", c2)
+		cond = ast.Log(p.span(start), cond, "or", c2)
 	}
 	return cond
 }
 
 func (p *parser) LogAnd() ast.Expr {
+	start := p.Peek().Start
 	cond := p.Equality()
 	for p.Match(lex.TokKW, "and") {
 		c2 := p.LogAnd()
-		cond = ast.Log(cond, "and", c2)
+		cond = ast.Log(p.span(start), cond, "and", c2)
 	}
 	return cond
 }
 
 func (p *parser) Equality() ast.Expr {
+	start := p.Peek().Start
 	e := p.Comparison()
 
 	if p.Match(lex.TokOp, "==", "!=") {
 		op := p.Previous()
-		e = ast.Bin(e, op.Lexeme, p.Comparison())
+		r := p.Comparison()
+		e = ast.Bin(p.span(start), e, op.Lexeme, r, op.Start)
 	}
 
 	return e
 }
 
 func (p *parser) Comparison() ast.Expr {
+	start := p.Peek().Start
 	e := p.Term()
 
 	if p.Match(lex.TokOp, "<", "<=", ">", ">=") {
 		op := p.Previous()
-		e = ast.Bin(e, op.Lexeme, p.Term())
+		r := p.Term()
+		e = ast.Bin(p.span(start), e, op.Lexeme, r, op.Start)
 	}
 
 	return e
 }
 
 func (p *parser) Term() ast.Expr {
+	start := p.Peek().Start
 	e := p.Factor()
 
 	for p.Match(lex.TokOp, "+", "-") {
 		op := p.Previous()
 		r := p.Factor()
-		e = ast.Bin(e, op.Lexeme, r)
+		e = ast.Bin(p.span(start), e, op.Lexeme, r, op.Start)
 	}
 
 	return e
 }
 
 func (p *parser) Factor() ast.Expr {
+	start := p.Peek().Start
 	e := p.Unary()
 
-	for p.Match(lex.TokOp, "*", "/") {
+	// div is not reserved: an identifier can only follow an operand as this operator
+	for p.Match(lex.TokOp, "*", "/", "%") || p.Match(lex.TokId, "div") {
 		op := p.Previous()
 		r := p.Unary()
-		e = ast.Bin(e, op.Lexeme, r)
+		e = ast.Bin(p.span(start), e, op.Lexeme, r, op.Start)
 	}
 
 	return e
@@ -290,25 +415,34 @@ func (p *parser) Factor() ast.Expr {
 func (p *parser) Unary() ast.Expr {
 	if p.Match(lex.TokOp, "-", "!") {
 		op := p.Previous()
-		return ast.Un(op.Lexeme, p.Unary())
+		arg := p.Unary()
+		return ast.Un(p.span(op.Start), op.Lexeme, arg, op.Start)
 	}
 
 	return p.Call()
 }
 
 func (p *parser) Call() ast.Expr {
+	start := p.Peek().Start
 	c := p.Primary()
 	for {
 		if p.Match(lex.TokPunc, "(") {
+			at := p.Previous().Start
 			if p.Match(lex.TokPunc, ")") {
 				// Nothing to do
-				c = ast.CallExpr(c)
+				c = ast.CallExpr(p.span(start), at, c)
 			} else {
-				c = ast.CallExpr(c, p.Arguments()...)
+				args := p.Arguments()
+				c = ast.CallExpr(p.span(start), at, c, args...)
 			}
 		} else if p.Match(lex.TokPunc, ".") {
 			a := p.Consume("expect property name after '.'", lex.TokId)
-			c = ast.GetAttr(c, a.Lexeme)
+			c = ast.GetAttr(p.span(start), c, a.Lexeme, a.Start)
+		} else if p.Match(lex.TokPunc, "[") {
+			at := p.Previous().Start
+			idx := p.Expr()
+			p.Consume("expect ']' after index", lex.TokPunc, "]")
+			c = ast.IndexExpr(p.span(start), c, idx, at)
 		} else {
 			break
 		}
@@ -332,39 +466,54 @@ func (p *parser) Arguments() []ast.Expr {
 
 func (p *parser) Primary() ast.Expr {
 	if p.Match(lex.TokStr) {
-		return ast.Str(p.Previous().Lexeme)
+		return ast.Str(p.tokSpan(p.Previous()), p.Previous().Lexeme)
+	}
+	if p.Match(lex.TokRaw) {
+		return ast.RawStr(p.tokSpan(p.Previous()), p.Previous().Lexeme)
+	}
+	if p.Match(lex.TokInterp) {
+		return p.Interpolation()
 	}
 	if p.Match(lex.TokNum) {
 		n := p.Previous()
-		v, err := strconv.ParseFloat(n.Lexeme, 64)
-		if err == nil {
-			return ast.Num(v)
+		v, err := number(n.Lexeme)
+		if err != nil {
+			panic(&ast.Diagnostic{Loc: p.tokSpan(n), Message: fmt.Sprintf("Can't parse numeric value %s: %s", n.Lexeme, err)})
 		}
-		panic(p.Error("Can't parse numeric value %s: %s", n.Lexeme, err))
+		return ast.Num(p.tokSpan(n), v, n.Lexeme)
 	}
 	if p.Match(lex.TokKW, "nil") {
-		return ast.Nil
+		return ast.Nil(p.tokSpan(p.Previous()))
 	}
 	if p.Match(lex.TokKW, "true") {
-		return ast.True
+		return ast.True(p.tokSpan(p.Previous()))
 	}
 	if p.Match(lex.TokKW, "false") {
-		return ast.False
+		return ast.False(p.tokSpan(p.Previous()))
 	}
 	if p.Match(lex.TokKW, "this") {
-		return ast.This(p.Previous().Lexeme)
+		return ast.This(p.tokSpan(p.Previous()), p.Previous().Lexeme)
 	}
 	if p.Match(lex.TokKW, "super") {
+		kw := p.Previous()
 		p.Consume("'.' required after super", lex.TokPunc, ".")
-		return ast.Supercall(p.Consume("attribute name required for supercall", lex.TokId).Lexeme)
+		attr := p.Consume("attribute name required for supercall", lex.TokId).Lexeme
+		return ast.Supercall(p.span(kw.Start), p.tokSpan(kw), attr)
 	}
 	if p.Match(lex.TokPunc, "(") {
 		e := p.Expr()
 		p.Consume("expect ')' after expression", lex.TokPunc, ")")
 		return e
 	}
+	if p.Match(lex.TokPunc, "[") {
+		return p.ListLit()
+	}
+	if p.Match(lex.TokPunc, "{") {
+		// A brace that starts a statement is a block; any other is a map literal
+		return p.MapLit()
+	}
 	if p.Match(lex.TokId) {
-		return ast.Id(p.Previous().Lexeme)
+		return ast.Id(p.tokSpan(p.Previous()), p.Previous().Lexeme)
 	}
 	if p.Match(lex.TokKW, "fun") {
 		return p.FunLit()
@@ -372,21 +521,54 @@ func (p *parser) Primary() ast.Expr {
 	panic(p.Error("expected: Primary"))
 }
 
+func (p *parser) ListLit() ast.Expr {
+	start := p.Previous().Start
+	var elems []ast.Expr
+	if !p.Check(lex.TokPunc, "]") {
+		for {
+			elems = append(elems, p.Expr())
+			if !p.Match(lex.TokPunc, ",") {
+				break
+			}
+		}
+	}
+	p.Consume("expect ']' after list elements", lex.TokPunc, "]")
+	return ast.List(p.span(start), elems...)
+}
+
+func (p *parser) MapLit() ast.Expr {
+	start := p.Previous().Start
+	var keys, values []ast.Expr
+	if !p.Check(lex.TokPunc, "}") {
+		for {
+			keys = append(keys, p.Expr())
+			p.Consume("expect ':' after map key", lex.TokPunc, ":")
+			values = append(values, p.Expr())
+			if !p.Match(lex.TokPunc, ",") {
+				break
+			}
+		}
+	}
+	p.Consume("expect '}' after map entries", lex.TokPunc, "}")
+	return ast.Map(p.span(start), keys, values)
+}
+
 func (p *parser) FunLit() *ast.FunLit {
 	// Either fun(args) { body }
 	// or fun name(args) { body }
 	// the second a way to construct recursive-capable function literals
 
+	start := p.Previous().Start
 	var name ast.Var
 	if p.Match(lex.TokId) {
-		name = ast.Id(p.Previous().Lexeme)
+		name = ast.Id(p.tokSpan(p.Previous()), p.Previous().Lexeme)
 	}
 	p.Consume("function literal requires '('", lex.TokPunc, "(")
 	var params []ast.Var
 	if !p.Check(lex.TokPunc, ")") {
 		for {
 			formal := p.Consume("formal parameter must be an identifier", lex.TokId)
-			params = append(params, ast.Id(formal.Lexeme))
+			params = append(params, ast.Id(p.tokSpan(formal), formal.Lexeme))
 			if !p.Match(lex.TokPunc, ",") {
 				break
 			}
@@ -395,5 +577,54 @@ func (p *parser) FunLit() *ast.FunLit {
 	p.Consume("formal parameters must end with ')'", lex.TokPunc, ")")
 	p.Consume("function literal body must be a block", lex.TokPunc, "{")
 	body := p.Block()
-	return ast.FunExpr(name, params, body)
+	return ast.FunExpr(p.span(start), name, params, body)
+}
+
+// Interpolation parses the rest of a string with interpolated expressions, whose text up
+// to the first of them has been read.
+func (p *parser) Interpolation() ast.Expr {
+	start := p.Previous().Start
+	parts := []ast.Expr{ast.Str(p.tokSpan(p.Previous()), p.Previous().Lexeme)}
+	for {
+		if p.Check(lex.TokInterpMid) || p.Check(lex.TokInterpEnd) {
+			panic(p.Error("expect expression in interpolation"))
+		}
+		parts = append(parts, p.Expr())
+		if p.Match(lex.TokInterpMid) {
+			parts = append(parts, ast.Str(p.tokSpan(p.Previous()), p.Previous().Lexeme))
+			continue
+		}
+		if p.Match(lex.TokInterpEnd) {
+			parts = append(parts, ast.Str(p.tokSpan(p.Previous()), p.Previous().Lexeme))
+			return ast.Interpolate(p.span(start), parts...)
+		}
+		panic(p.Error("expect '}' after interpolated expression"))
+	}
+}
+
+// number converts the lexeme of a numeric literal to its value.
+func number(s string) (float64, error) {
+	s = strings.ReplaceAll(s, "_", "")
+	if len(s) > 2 && s[0] == '0' {
+		base := 0
+		switch s[1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		}
+		if base != 0 {
+			// Like a decimal literal, one too big for an integer type is rounded
+			n, ok := new(big.Int).SetString(s[2:], base)
+			if !ok {
+				return 0, fmt.Errorf("invalid digits")
+			}
+			f, _ := new(big.Float).SetInt(n).Float64()
+			if math.IsInf(f, 0) {
+				return 0, fmt.Errorf("value out of range")
+			}
+			return f, nil
+		}
+	}
+	return strconv.ParseFloat(s, 64)
 }
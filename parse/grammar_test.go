@@ -0,0 +1,176 @@
+package parse
+
+import (
+	"github.com/jan-g/lox/ast"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func parseString(t *testing.T, src string) ast.Program {
+	p := NewFile("test.lox", strings.NewReader(src))
+	prog, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prog.(ast.Program)
+}
+
+func TestExprSpans(t *testing.T) {
+	prog := parseString(t, "print a + b.c(1);")
+	pr := prog.Stmts[0].(*ast.Print)
+	assert.Equal(t, "test.lox:[0,0]-[0,17]", pr.Span().String())
+	bin := pr.Expr.(*ast.BinOp)
+	assert.Equal(t, "test.lox:[0,6]-[0,16]", bin.Span().String())
+	assert.Equal(t, "test.lox:[0,6]-[0,7]", bin.Left.Span().String())
+	call := bin.Right.(*ast.Call)
+	assert.Equal(t, "test.lox:[0,10]-[0,16]", call.Span().String())
+	assert.Equal(t, "test.lox:[0,10]-[0,13]", call.Callee.Span().String())
+	assert.Equal(t, "test.lox:[0,14]-[0,15]", call.Args[0].Span().String())
+}
+
+func TestStmtSpans(t *testing.T) {
+	prog := parseString(t, "var x;\nclass A < B {\n  m() { return this; }\n}\n")
+	assert.Equal(t, "test.lox:[0,0]-[3,1]", prog.Span().String())
+	decl := prog.Stmts[0].(*ast.VarDecl)
+	assert.Equal(t, "test.lox:[0,0]-[0,6]", decl.Span().String())
+	assert.Equal(t, "test.lox:[0,4]-[0,5]", decl.Expr.Span().String())
+	class := prog.Stmts[1].(ast.ClassDef)
+	assert.Equal(t, "test.lox:[1,0]-[3,1]", class.Span().String())
+	assert.Equal(t, "test.lox:[1,10]-[1,11]", class.Superclass.Span().String())
+	m := class.Methods[0]
+	assert.Equal(t, "test.lox:[2,2]-[2,22]", m.Span().String())
+	ret := m.Body.(ast.Block).Stmts[0].(*ast.Return)
+	assert.Equal(t, "test.lox:[2,8]-[2,20]", ret.Span().String())
+}
+
+func TestDesugaredForSpans(t *testing.T) {
+	prog := parseString(t, "for (var i = 0; i < 3; i = i + 1)\n  print i;\n")
+	outer := prog.Stmts[0].(ast.Block)
+	assert.Equal(t, "test.lox:[0,0]-[1,10]", outer.Span().String())
+	w := outer.Stmts[1].(*ast.While)
+	assert.Equal(t, "test.lox:[0,0]-[1,10]", w.Span().String())
+	assert.Equal(t, "test.lox:[0,16]-[0,21]", w.Cond.Span().String())
+	assert.Equal(t, "test.lox:[1,2]-[1,10]", w.Body.Span().String())
+	assert.Equal(t, "test.lox:[0,23]-[0,32]", w.Incr.Span().String())
+
+	// An omitted condition is an implicit true, attributed to the for statement.
+	prog = parseString(t, "for (;;) {}")
+	w = prog.Stmts[0].(*ast.While)
+	assert.Equal(t, "test.lox:[0,0]-[0,11]", w.Cond.Span().String())
+}
+
+func TestRecovery(t *testing.T) {
+	p := New(strings.NewReader("print 1;\nvar = 2;\nprint (3;\nfun f( { print 4; }\nprint 5;\n"))
+	prog, err := p.Parse()
+	ds, ok := err.(ast.Diagnostics)
+	if !assert.True(t, ok, "expected diagnostics, got %v", err) {
+		return
+	}
+	assert.Equal(t, []string{
+		"variable name expected [1,4]",
+		"expect ')' after expression [2,8]",
+		"formal parameter must be an identifier [3,7]",
+	}, []string{ds[0].Error(), ds[1].Error(), ds[2].Error()})
+	assert.Len(t, ds, 3)
+
+	// The statements around the errors are still parsed
+	sts := prog.(ast.Program).Stmts
+	if assert.Len(t, sts, 2) {
+		assert.Equal(t, "print 1;\n", sts[0].String())
+		assert.Equal(t, "print 5;\n", sts[1].String())
+	}
+}
+
+func TestListSyntax(t *testing.T) {
+	prog := parseString(t, "xs[i + 1] = [1, [2]][0];")
+	e := prog.Stmts[0].(*ast.Expression).Expr
+	set, ok := e.(*ast.SetIndex)
+	if assert.True(t, ok) {
+		assert.Equal(t, "xs@0[(i@0 + 1)] = [1, [2]][0]", set.String())
+		assert.Equal(t, "test.lox:[0,12]-[0,23]", set.Rhs.Span().String())
+		assert.Equal(t, "test.lox:[0,12]-[0,20]", set.Rhs.(*ast.Index).Object.Span().String())
+	}
+}
+
+func TestMapSyntax(t *testing.T) {
+	// A brace at the start of a statement is a block; elsewhere it is a map literal
+	prog := parseString(t, "{ print {}; }\nvar m = {\"a\": 1, 2: [3]};")
+	blk, ok := prog.Stmts[0].(ast.Block)
+	if assert.True(t, ok) {
+		assert.IsType(t, &ast.MapLit{}, blk.Stmts[0].(*ast.Print).Expr)
+	}
+	m, ok := prog.Stmts[1].(*ast.VarDecl).Expr.(*ast.MapLit)
+	if assert.True(t, ok) {
+		assert.Equal(t, `{"a": 1, 2: [3]}`, m.String())
+		assert.Equal(t, "test.lox:[1,8]-[1,24]", m.Span().String())
+	}
+}
+
+func TestTrySyntax(t *testing.T) {
+	prog := parseString(t, "try { f(); } catch (e) { print e; } finally { g(); }")
+	try, ok := prog.Stmts[0].(*ast.Try)
+	if assert.True(t, ok) {
+		assert.Equal(t, "e", try.CatchVar.VarName())
+		assert.NotNil(t, try.Catch)
+		assert.NotNil(t, try.Finally)
+	}
+
+	_, err := New(strings.NewReader("try { f(); }\nprint 1;")).Parse()
+	assert.EqualError(t, err, "try requires catch or finally [1,0]")
+}
+
+func TestInterpolationSyntax(t *testing.T) {
+	prog := parseString(t, `print "a ${x + 1} b ${"c"}";`)
+	i, ok := prog.Stmts[0].(*ast.Print).Expr.(*ast.Interp)
+	if assert.True(t, ok) {
+		assert.Equal(t, `("a " .. (x@0 + 1) .. " b " .. "c" .. "")`, i.String())
+		assert.Equal(t, "test.lox:[0,6]-[0,27]", i.Span().String())
+		assert.Equal(t, "test.lox:[0,11]-[0,16]", i.Parts[1].Span().String())
+	}
+
+	_, err := New(strings.NewReader(`print "${a b}";`)).Parse()
+	assert.EqualError(t, err, "expect '}' after interpolated expression [0,11]")
+
+	// The text after an interpolation can't be taken for a string literal
+	for src, msg := range map[string]string{
+		`print "${}" "tail";`:        "expect expression in interpolation [0,9]",
+		`print "a ${x + }" "b";`:     "expected: Primary [0,15]",
+		`print "abc ${x + } def";`:   "expected: Primary [0,17]",
+		`print "${x}" "${y}" "z";`:   "';' expected after value [0,13]",
+		`print "a ${1} b ${2 3} c";`: "expect '}' after interpolated expression [0,20]",
+	} {
+		_, err = New(strings.NewReader(src)).Parse()
+		assert.EqualError(t, err, msg, src)
+	}
+}
+
+func TestNumberSyntax(t *testing.T) {
+	for src, v := range map[string]float64{
+		"1e6":                          1e6,
+		"2.5E-3":                       2.5e-3,
+		"1_000.5":                      1000.5,
+		"0xFF":                         255,
+		"0Xdead_beef":                  0xdeadbeef,
+		"0b1010":                       10,
+		"0x1_0000_0000_0000_0000":      1 << 64,
+		"0b" + strings.Repeat("1", 70): 1 << 70,
+	} {
+		prog := parseString(t, "print "+src+";")
+		assert.Equal(t, v, float64(prog.Stmts[0].(*ast.Print).Expr.(ast.NLit).Value), src)
+	}
+
+	_, err := New(strings.NewReader("print 0x;")).Parse()
+	assert.EqualError(t, err, "hexadecimal literal has no digits [0,6]")
+	_, err = New(strings.NewReader("print 0xFG;")).Parse()
+	assert.EqualError(t, err, "invalid digit 'G' in hexadecimal literal [0,6]")
+	_, err = New(strings.NewReader("print 1e400;")).Parse()
+	assert.EqualError(t, err, `Can't parse numeric value 1e400: strconv.ParseFloat: parsing "1e400": value out of range [0,6]`)
+	_, err = New(strings.NewReader("print 0x1" + strings.Repeat("0", 300) + ";")).Parse()
+	assert.Error(t, err)
+}
+
+func TestDivSyntax(t *testing.T) {
+	prog := parseString(t, "var div = 1;\nprint div div div(2);")
+	assert.Equal(t, "(div@0 div div@0(2))", prog.Stmts[1].(*ast.Print).Expr.String())
+}
@@ -15,14 +15,31 @@ type Parser interface {
 type parser struct {
 	l    *lex.Lexer
 	prev lex.T
+	file string
+	errs ast.Diagnostics
 }
 
 func New(r io.Reader) Parser {
+	return NewFile("", r)
+}
+
+// NewFile returns a parser whose node spans are attributed to the named file.
+func NewFile(file string, r io.Reader) Parser {
 	return &parser{
-		l: lex.New(r, lex.MakeSwitch(lex.MakeId(lex.Kws...), lex.WS, lex.Op, lex.Num, lex.Str)),
+		l:    lex.New(r, lex.MakeSwitch(lex.MakeId(lex.Kws...), lex.WS, lex.Op, lex.Num, lex.Str, lex.Raw)),
+		file: file,
 	}
 }
 
+// span covers the source from start to the end of the most recently consumed token.
+func (p *parser) span(start lex.Pos) ast.Span {
+	return ast.Span{File: p.file, Start: start, End: p.prev.End}
+}
+
+func (p *parser) tokSpan(t lex.T) ast.Span {
+	return ast.Span{File: p.file, Start: t.Start, End: t.End}
+}
+
 func (p *parser) Peek() lex.T {
 	return p.l.Current()
 }
@@ -78,11 +95,50 @@ func (p *parser) Consume(msg string, t lex.TokenType, lexeme ...string) lex.T {
 	panic(p.Error(msg))
 }
 
-func (p *parser) Error(msg string, xs ...interface{}) error {
-	if p.Eof() {
-		return fmt.Errorf("%s AT EOF", fmt.Sprintf(msg, xs...))
+// Error describes a problem at the current token. Lexical errors take precedence
+// over whatever the grammar expected to find there.
+func (p *parser) Error(msg string, xs ...interface{}) *ast.Diagnostic {
+	c := p.Peek()
+	msg = fmt.Sprintf(msg, xs...)
+	switch c.Token {
+	case lex.TokErr:
+		msg = c.Lexeme
+	case lex.TokEof:
+		msg += " at end of file"
+	}
+	return &ast.Diagnostic{Loc: p.tokSpan(c), Message: msg}
+}
+
+// synchronise discards tokens until the start of what looks like the next statement.
+// Any braced block that begins while skipping is skipped in its entirety, so that
+// its contents and closing brace don't produce a cascade of further errors.
+func (p *parser) synchronise() {
+	depth := 0
+	skip := func() {
+		if p.Check(lex.TokPunc, "{") {
+			depth++
+		} else if p.Check(lex.TokPunc, "}") && depth > 0 {
+			depth--
+		}
+		p.Next()
+	}
+	if !p.Eof() {
+		skip()
+	}
+	for !p.Eof() {
+		if depth == 0 {
+			if p.Previous().Token == lex.TokPunc && p.Previous().Lexeme == ";" {
+				return
+			}
+			if p.Check(lex.TokPunc, "}") {
+				return
+			}
+			if p.Check(lex.TokKW, "class", "fun", "var", "for", "if", "while", "print", "return", "break", "continue", "throw", "try", "import", "from") {
+				return
+			}
+		}
+		skip()
 	}
-	return fmt.Errorf("%s %s", fmt.Sprintf(msg, xs...), p.Peek().Start)
 }
 
 func (p *parser) accept(t lex.TokenType) (lex.T, bool) {
@@ -0,0 +1,652 @@
+// Package printer renders a syntax tree as canonically formatted Lox source.
+package printer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/lex"
+	"github.com/jan-g/lox/parse"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const indent = "  "
+
+// Format parses Lox source and returns it formatted. Source with syntax errors is
+// not formatted; the errors are returned instead.
+func Format(file string, r io.Reader) ([]byte, error) {
+	prog, err := parse.NewFile(file, r).Parse()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := Fprint(buf, prog); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Fprint writes the formatted source of a statement. The comments of a Program are
+// written alongside the statements they are found between.
+func Fprint(w io.Writer, s ast.Stmt) error {
+	p := &printer{}
+	if prog, ok := s.(ast.Program); ok {
+		p.comments = prog.Comments
+		p.stmts(prog.Stmts, lex.Pos{Line: 1 << 30})
+	} else {
+		p.stmt(s)
+		p.newline()
+	}
+	_, err := w.Write([]byte(p.buf.String()))
+	return err
+}
+
+type printer struct {
+	buf      strings.Builder
+	depth    int
+	comments []lex.Comment // those not yet written
+	lastLine int           // the source line that the output has reached
+	started  bool          // whether anything has been written on the current output line
+	broken   bool          // whether a line comment has ended the output line within a statement
+	wrapped  bool          // whether the statement has continued onto further lines, indented
+}
+
+func (p *printer) write(xs ...string) {
+	if p.broken {
+		p.newline()
+		p.wrapped = true
+	}
+	if !p.started {
+		depth := p.depth
+		if p.wrapped {
+			depth++
+		}
+		p.buf.WriteString(strings.Repeat(indent, depth))
+		p.started = true
+	}
+	for _, x := range xs {
+		p.buf.WriteString(x)
+	}
+}
+
+func (p *printer) newline() {
+	p.buf.WriteRune('\n')
+	p.started = false
+	p.broken = false
+}
+
+// gap writes a blank line if the source had any between the last thing written and line.
+func (p *printer) gap(line int, first bool) {
+	if !first && line > p.lastLine+1 {
+		p.newline()
+	}
+}
+
+// leadingComments writes the comments that come before a position, each on its own line.
+func (p *printer) leadingComments(before lex.Pos, first bool) bool {
+	for len(p.comments) > 0 && less(p.comments[0].Start, before) {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		p.gap(c.Start.Line, first)
+		p.write(c.Text)
+		p.newline()
+		p.lastLine = c.End.Line
+		first = false
+	}
+	return first
+}
+
+// trailingComment writes a comment that follows on the same source line as end,
+// provided that nothing else comes between them.
+func (p *printer) trailingComment(end lex.Pos, next lex.Pos) {
+	if !p.broken && len(p.comments) > 0 && p.comments[0].Start.Line == end.Line && !less(p.comments[0].Start, end) && less(p.comments[0].Start, next) {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		p.write(" ", c.Text)
+		p.lastLine = c.End.Line
+	}
+}
+
+// commentsBefore writes the comments that come before the start of some code within a
+// statement, ahead of it on the same line.
+func (p *printer) commentsBefore(pos lex.Pos) {
+	for len(p.comments) > 0 && less(p.comments[0].Start, pos) {
+		p.inlineComment()
+		if !p.broken {
+			p.write(" ")
+		}
+	}
+}
+
+// commentsAfter writes the comments that come before pos within a statement, after
+// the code written so far. If more code must follow on the same line, such as a comma,
+// only block comments are written, and not those that sit right up against pos; they
+// are left to go with the code that follows.
+func (p *printer) commentsAfter(pos lex.Pos, lineComments bool) {
+	for len(p.comments) > 0 && less(p.comments[0].Start, pos) {
+		c := p.comments[0]
+		if !lineComments && (isLineComment(c) || c.End.Line == pos.Line && pos.Col-c.End.Col <= 1) {
+			return
+		}
+		p.inlineComment()
+	}
+}
+
+// inlineComment writes the next comment in the middle of a statement. A line comment
+// ends the output line; the statement continues on the next, further indented.
+func (p *printer) inlineComment() {
+	c := p.comments[0]
+	p.comments = p.comments[1:]
+	noSpaceAfter := " "
+	if !isLineComment(c) {
+		noSpaceAfter = " ([{"
+	}
+	if out := p.buf.String(); p.started && !p.broken && !strings.ContainsAny(out[len(out)-1:], noSpaceAfter) {
+		p.write(" ")
+	}
+	p.write(c.Text)
+	p.lastLine = c.End.Line
+	p.broken = isLineComment(c)
+}
+
+func isLineComment(c lex.Comment) bool {
+	return strings.HasPrefix(c.Text, "//")
+}
+
+func less(a, b lex.Pos) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Col < b.Col
+}
+
+// stmts writes a sequence of statements, one per line, along with the comments
+// that come before end.
+func (p *printer) stmts(ss []ast.Stmt, end lex.Pos) {
+	first := true
+	for i, s := range ss {
+		loc := s.Span()
+		first = p.leadingComments(loc.Start, first)
+		p.gap(loc.Start.Line, first)
+		p.wrapped = false
+		p.stmt(s)
+		p.commentsAfter(loc.End, true)
+		if loc.End.Line > p.lastLine {
+			p.lastLine = loc.End.Line
+		}
+		next := end
+		if i+1 < len(ss) {
+			next = ss[i+1].Span().Start
+		}
+		p.trailingComment(loc.End, next)
+		p.newline()
+		first = false
+	}
+	p.leadingComments(end, first)
+}
+
+func (p *printer) block(b ast.Block) {
+	if len(b.Stmts) == 0 && (len(p.comments) == 0 || !less(p.comments[0].Start, b.Span().End)) {
+		p.write("{}")
+		return
+	}
+	p.write("{")
+	// Comments in the header of the statement that the block belongs to follow the brace
+	p.commentsAfter(b.Span().Start, true)
+	if p.lastLine < b.Span().Start.Line {
+		p.lastLine = b.Span().Start.Line
+	}
+	next := b.Span().End
+	if len(b.Stmts) > 0 {
+		next = b.Stmts[0].Span().Start
+	}
+	p.trailingComment(b.Span().Start, next)
+	p.newline()
+	wrapped := p.wrapped
+	if wrapped {
+		p.depth++
+	}
+	p.depth++
+	p.stmts(b.Stmts, b.Span().End)
+	p.depth--
+	p.wrapped = false
+	p.write("}")
+	if wrapped {
+		p.depth--
+		p.wrapped = true
+	}
+}
+
+// body writes the statement controlled by an if, else or loop: a block goes on the
+// same line, anything else on the next line, indented.
+func (p *printer) body(s ast.Stmt) {
+	if b, ok := s.(ast.Block); ok {
+		p.write(" ")
+		p.block(b)
+		return
+	}
+	p.commentsAfter(s.Span().Start, true)
+	p.newline()
+	wrapped := p.wrapped
+	if wrapped {
+		p.depth++
+	}
+	p.depth++
+	p.wrapped = false
+	p.stmt(s)
+	p.depth--
+	if wrapped {
+		p.depth--
+		p.wrapped = true
+	}
+}
+
+func (p *printer) stmt(s ast.Stmt) {
+	switch s := s.(type) {
+	case ast.Program:
+		p.stmts(s.Stmts, s.Span().End)
+	case *ast.Print:
+		p.write("print ")
+		p.expr(s.Expr, precLowest)
+		p.write(";")
+	case *ast.Expression:
+		if ambiguous(s.Expr) {
+			p.write("(")
+			p.expr(s.Expr, precLowest)
+			p.write(");")
+			return
+		}
+		p.expr(s.Expr, precLowest)
+		p.write(";")
+	case *ast.VarDecl:
+		p.write("var ", s.VarName)
+		if !implicit(s) {
+			p.write(" = ")
+			p.expr(s.Expr, precLowest)
+		}
+		p.write(";")
+	case *ast.FunDef:
+		p.write("fun ")
+		p.function(s)
+	case ast.ClassDef:
+		p.class(s)
+	case method:
+		p.function(s.FunDef)
+	case ast.Block:
+		if init, loop, ok := desugaredFor(s); ok {
+			p.forLoop(init, loop)
+			return
+		}
+		p.block(s)
+	case *ast.If:
+		p.write("if (")
+		p.expr(s.Cond, precLowest)
+		p.write(")")
+		p.body(s.Then)
+		if s.Else != nil {
+			if _, ok := s.Then.(ast.Block); ok {
+				p.write(" ")
+			} else {
+				p.newline()
+			}
+			p.write("else")
+			if elif, ok := s.Else.(*ast.If); ok {
+				p.write(" ")
+				p.stmt(elif)
+			} else {
+				p.body(s.Else)
+			}
+		}
+	case *ast.While:
+		if s.For {
+			p.forLoop(nil, s)
+			return
+		}
+		p.write("while (")
+		p.expr(s.Cond, precLowest)
+		p.write(")")
+		p.body(s.Body)
+	case *ast.Return:
+		if s.Expr == nil {
+			p.write("return;")
+			return
+		}
+		p.write("return ")
+		p.expr(s.Expr, precLowest)
+		p.write(";")
+	case ast.Break:
+		p.write("break;")
+	case ast.Continue:
+		p.write("continue;")
+	case *ast.Throw:
+		p.write("throw ")
+		p.expr(s.Expr, precLowest)
+		p.write(";")
+	case *ast.Try:
+		p.write("try ")
+		p.block(s.Body.(ast.Block))
+		if s.Catch != nil {
+			p.write(" catch (", s.CatchVar.VarName(), ") ")
+			p.block(s.Catch.(ast.Block))
+		}
+		if s.Finally != nil {
+			p.write(" finally ")
+			p.block(s.Finally.(ast.Block))
+		}
+	case *ast.Import:
+		if s.As != nil {
+			p.write("import ", quote(s.Path), " as ", s.As.VarName(), ";")
+			return
+		}
+		p.write("from ", quote(s.Path), " import ")
+		for i, n := range s.Names {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.write(n.VarName())
+		}
+		p.write(";")
+	default:
+		panic(fmt.Errorf("don't know how to print stmt %s", s))
+	}
+}
+
+// ambiguous reports whether an expression statement would be read as a declaration
+// or a block, unless it is parenthesised.
+func ambiguous(e ast.Expr) bool {
+	for {
+		switch x := e.(type) {
+		case *ast.FunLit, *ast.MapLit:
+			return true
+		case *ast.BinOp:
+			e = x.Left
+		case *ast.LogOp:
+			e = x.First
+		case *ast.Set:
+			e = x.Object
+		case *ast.SetIndex:
+			e = x.Object
+		case *ast.Call:
+			e = x.Callee
+		case *ast.Get:
+			e = x.Object
+		case *ast.Index:
+			e = x.Object
+		default:
+			return false
+		}
+	}
+}
+
+// implicit reports whether a declaration had no initialiser in the source.
+func implicit(d *ast.VarDecl) bool {
+	_, isNil := d.Expr.(ast.NilT)
+	return isNil && d.Expr.Span() == d.NameLoc
+}
+
+// desugaredFor recognises the block that the parser wraps around a for loop with an
+// initialiser. The nodes synthesised for a for loop all share its span.
+func desugaredFor(b ast.Block) (ast.Stmt, *ast.While, bool) {
+	if len(b.Stmts) != 2 {
+		return nil, nil, false
+	}
+	loop, ok := b.Stmts[1].(*ast.While)
+	if !ok || !loop.For || loop.Span() != b.Span() {
+		return nil, nil, false
+	}
+	return b.Stmts[0], loop, true
+}
+
+func (p *printer) forLoop(init ast.Stmt, loop *ast.While) {
+	p.write("for (")
+	switch init := init.(type) {
+	case nil:
+		p.write(";")
+	case *ast.VarDecl, *ast.Expression:
+		p.stmt(init)
+	}
+	if b, ok := loop.Cond.(ast.Bool); !ok || !b.Value || b.Span() != loop.Span() {
+		p.write(" ")
+		p.expr(loop.Cond, precLowest)
+	}
+	p.write(";")
+	if loop.Incr != nil {
+		p.write(" ")
+		p.expr(loop.Incr, precLowest)
+	}
+	p.write(")")
+	p.body(loop.Body)
+}
+
+func (p *printer) function(f *ast.FunDef) {
+	if f.Name != nil {
+		p.write(f.Name.VarName())
+	}
+	p.write("(")
+	for i, param := range f.Params {
+		if i > 0 {
+			p.commentsAfter(param.Span().Start, false)
+			p.write(", ")
+		}
+		p.commentsBefore(param.Span().Start)
+		p.write(param.VarName())
+	}
+	p.write(") ")
+	p.block(f.Body.(ast.Block))
+}
+
+func (p *printer) class(c ast.ClassDef) {
+	p.write("class ", c.Name.VarName())
+	if c.Superclass != nil {
+		p.write(" < ", c.Superclass.VarName())
+	}
+	p.write(" ")
+	ms := make([]ast.Stmt, len(c.Methods))
+	for i, m := range c.Methods {
+		ms[i] = method{m}
+	}
+	p.block(ast.BlockStmt(c.Span(), ms...).(ast.Block))
+}
+
+// method is a class's method, printed without the fun keyword.
+type method struct {
+	*ast.FunDef
+}
+
+// Binding strength of expressions, loosest first
+const (
+	precLowest = iota
+	precAssign
+	precOr
+	precAnd
+	precEquality
+	precComparison
+	precTerm
+	precFactor
+	precUnary
+	precCall
+	precPrimary
+)
+
+var binPrec = map[string]int{
+	"==": precEquality, "!=": precEquality,
+	"<": precComparison, "<=": precComparison, ">": precComparison, ">=": precComparison,
+	"+": precTerm, "-": precTerm,
+	"*": precFactor, "/": precFactor, "%": precFactor, "div": precFactor,
+}
+
+func precedence(e ast.Expr) int {
+	switch e := e.(type) {
+	case *ast.Assign, *ast.Set, *ast.SetIndex:
+		return precAssign
+	case *ast.LogOp:
+		if e.Op == "or" {
+			return precOr
+		}
+		return precAnd
+	case *ast.BinOp:
+		return binPrec[e.Op]
+	case *ast.UnOp:
+		return precUnary
+	case *ast.Call, *ast.Get, *ast.Index:
+		return precCall
+	}
+	return precPrimary
+}
+
+// expr writes an expression, in parentheses if it binds less tightly than min.
+func (p *printer) expr(e ast.Expr, min int) {
+	p.commentsBefore(e.Span().Start)
+	if precedence(e) < min {
+		p.write("(")
+		defer p.write(")")
+	}
+	switch e := e.(type) {
+	case ast.StrLit:
+		if e.Raw {
+			p.write("`", e.Value, "`")
+			return
+		}
+		p.write(quote(e.Value))
+	case *ast.Interp:
+		p.write(`"`)
+		for i, x := range e.Parts {
+			if i%2 == 0 {
+				p.write(escape(x.(ast.StrLit).Value))
+				continue
+			}
+			p.write("${")
+			p.expr(x, precLowest)
+			p.commentsAfter(e.Parts[i+1].Span().Start, true)
+			p.write("}")
+		}
+		p.write(`"`)
+	case ast.NLit:
+		if e.Lexeme != "" {
+			p.write(e.Lexeme)
+		} else {
+			p.write(strconv.FormatFloat(e.Value, 'g', -1, 64))
+		}
+	case ast.NilT:
+		p.write("nil")
+	case ast.Bool:
+		p.write(e.String())
+	case ast.Var:
+		p.write(e.VarName())
+	case ast.ThisT:
+		p.write("this")
+	case *ast.Super:
+		p.write("super.", e.Attribute)
+	case *ast.UnOp:
+		p.write(e.Op)
+		p.expr(e.Arg, precUnary)
+	case *ast.BinOp:
+		prec := binPrec[e.Op]
+		if prec == precEquality || prec == precComparison {
+			// These don't associate
+			p.expr(e.Left, prec+1)
+		} else {
+			p.expr(e.Left, prec)
+		}
+		p.write(" ", e.Op, " ")
+		p.expr(e.Right, prec+1)
+	case *ast.LogOp:
+		// The parser groups these to the right
+		prec := precedence(e)
+		p.expr(e.First, prec+1)
+		p.write(" ", e.Op, " ")
+		p.expr(e.Second, prec)
+	case *ast.Assign:
+		p.write(e.Lhs.VarName(), " = ")
+		p.expr(e.Rhs, precAssign)
+	case *ast.Set:
+		p.expr(e.Object, precCall)
+		p.write(".", e.Attribute, " = ")
+		p.expr(e.Rhs, precAssign)
+	case *ast.SetIndex:
+		p.expr(e.Object, precCall)
+		p.write("[")
+		p.expr(e.Index, precLowest)
+		p.write("] = ")
+		p.expr(e.Rhs, precAssign)
+	case *ast.Call:
+		p.expr(e.Callee, precCall)
+		p.write("(")
+		p.list(e.Args, e.Span().End)
+		p.write(")")
+	case *ast.Get:
+		p.expr(e.Object, precCall)
+		p.write(".", e.Attribute)
+	case *ast.Index:
+		p.expr(e.Object, precCall)
+		p.write("[")
+		p.expr(e.Index, precLowest)
+		p.commentsAfter(e.Span().End, true)
+		p.write("]")
+	case *ast.ListLit:
+		p.write("[")
+		p.list(e.Elems, e.Span().End)
+		p.write("]")
+	case *ast.MapLit:
+		p.write("{")
+		for i, k := range e.Keys {
+			if i > 0 {
+				p.commentsAfter(k.Span().Start, false)
+				p.write(", ")
+			}
+			p.expr(k, precAssign)
+			p.commentsAfter(e.Values[i].Span().Start, false)
+			p.write(": ")
+			p.expr(e.Values[i], precAssign)
+		}
+		p.commentsAfter(e.Span().End, true)
+		p.write("}")
+	case *ast.FunLit:
+		p.write("fun ")
+		p.function((*ast.FunDef)(e))
+	default:
+		panic(fmt.Errorf("don't know how to print expr %s", e))
+	}
+}
+
+// list writes the elements of a list or the arguments of a call, along with the
+// comments that come before the bracket closing them at end.
+func (p *printer) list(es []ast.Expr, end lex.Pos) {
+	for i, e := range es {
+		if i > 0 {
+			p.commentsAfter(e.Span().Start, false)
+			p.write(", ")
+		}
+		p.expr(e, precAssign)
+	}
+	p.commentsAfter(end, true)
+}
+
+func quote(s string) string {
+	return `"` + escape(s) + `"`
+}
+
+// escapes are the characters that are written as two-character escape sequences.
+var escapes = map[rune]string{
+	'\n': `\n`, '\t': `\t`, '\r': `\r`, 0: `\0`, '\a': `\a`, '\b': `\b`, '\f': `\f`, '\v': `\v`,
+}
+
+// escape writes the text of a string literal, so that it reads back as it was.
+func escape(s string) string {
+	buf := strings.Builder{}
+	rs := []rune(s)
+	for i, r := range rs {
+		switch {
+		case r == '"', r == '\\', r == '$' && i+1 < len(rs) && rs[i+1] == '{':
+			buf.WriteRune('\\')
+			buf.WriteRune(r)
+		case escapes[r] != "":
+			buf.WriteString(escapes[r])
+		case !unicode.IsPrint(r):
+			fmt.Fprintf(&buf, `\u{%X}`, r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,222 @@
+package printer
+
+import (
+	"bytes"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/lex"
+	"github.com/jan-g/lox/parse"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func format(t *testing.T, src string) string {
+	out, err := Format("test.lox", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestFormat(t *testing.T) {
+	src := `// leading
+var a=1;var b ;  // trailing
+
+
+fun f(x,y){return x+y*(2-x);}
+for(var i=0;i<3;i=i+1)print -(i*2) ;
+for(;;){break;}
+if (a) print a; else if (b) { print b; } else print nil;
+class A < B { init() { this.x = [1, {"k": "v\"\n"}]; } m() {} }
+print (a or b) and !c;
+(fun (x) { print x; })(1);
+{
+  // only a comment
+}
+`
+	assert.Equal(t, `// leading
+var a = 1;
+var b; // trailing
+
+fun f(x, y) {
+  return x + y * (2 - x);
+}
+for (var i = 0; i < 3; i = i + 1)
+  print -(i * 2);
+for (;;) {
+  break;
+}
+if (a)
+  print a;
+else if (b) {
+  print b;
+} else
+  print nil;
+class A < B {
+  init() {
+    this.x = [1, {"k": "v\"\n"}];
+  }
+  m() {}
+}
+print (a or b) and !c;
+(fun (x) {
+  print x;
+}(1));
+{
+  // only a comment
+}
+`, format(t, src))
+}
+
+func TestRoundTrip(t *testing.T) {
+	var files []string
+	if err := filepath.WalkDir("../examples", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filepath.Ext(path) == ".lox" {
+			files = append(files, path)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fn := range files {
+		t.Run(fn, func(t *testing.T) {
+			src, err := os.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			orig, err := parse.NewFile(fn, bytes.NewReader(src)).Parse()
+			if err != nil {
+				t.Skip("does not parse")
+			}
+			out, err := Format(fn, bytes.NewReader(src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := parse.NewFile(fn, bytes.NewReader(out)).Parse()
+			if err != nil {
+				t.Fatalf("formatted source does not parse: %s\n%s", err, out)
+			}
+			assert.True(t, sameTree(reflect.ValueOf(orig), reflect.ValueOf(again)), "formatted tree differs:\n%s", out)
+
+			out2, err := Format(fn, bytes.NewReader(out))
+			if assert.NoError(t, err) {
+				assert.Equal(t, string(out), string(out2), "formatting is not idempotent")
+			}
+		})
+	}
+}
+
+var (
+	spanType = reflect.TypeOf(ast.Span{})
+	posType  = reflect.TypeOf(lex.Pos{})
+)
+
+// sameTree compares two syntax trees, ignoring source positions.
+func sameTree(a, b reflect.Value) bool {
+	if a.Kind() != b.Kind() {
+		return false
+	}
+	switch a.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		if a.Elem().Type() != b.Elem().Type() {
+			return false
+		}
+		return sameTree(a.Elem(), b.Elem())
+	case reflect.Slice:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !sameTree(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		if a.Type() == spanType || a.Type() == posType {
+			return true
+		}
+		for i := 0; i < a.NumField(); i++ {
+			if !sameTree(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.String:
+		return a.String() == b.String()
+	case reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int:
+		return a.Int() == b.Int()
+	}
+	return false
+}
+
+func TestInlineComments(t *testing.T) {
+	// Comments within a statement stay in line with the code around them
+	src := `var x = [1, // one
+  2, /* two */ 3 // three
+];
+if (x) // cond
+  print x;
+if (x) // cond
+{
+  print x;
+}
+fun f(a /* the a */, b) {
+  return a + // plus
+    b;
+}
+var m = {"a": /* va */ 1, "b" /* kb */: 2};
+print f(1, /* arg */ 2) /* before semi */;
+print "s ${x // in interp
+}!";
+var fs = [ // funs
+  fun() { return 1; }];
+`
+	assert.Equal(t, `var x = [1, // one
+  2, /* two */ 3 // three
+  ];
+if (x) // cond
+  print x;
+if (x) { // cond
+  print x;
+}
+fun f(a /* the a */, b) {
+  return a + // plus
+    b;
+}
+var m = {"a": /* va */ 1, "b" /* kb */: 2};
+print f(1, /* arg */ 2); /* before semi */
+print "s ${x // in interp
+  }!";
+var fs = [ // funs
+  fun () {
+    return 1;
+  }];
+`, format(t, src))
+}
+
+func TestRawStrings(t *testing.T) {
+	src := "print `line one\nline \"two\" ${x}`;\nprint \"a\\tb\";\n"
+	assert.Equal(t, src, format(t, src))
+}
+
+func TestNumbers(t *testing.T) {
+	// Numbers are written as they were in the source
+	src := "print 0xFF + 0b1010 + 1_000_000 + 1e-7 + 1e300 + 2.50;\n"
+	assert.Equal(t, src, format(t, src))
+}
@@ -30,7 +30,7 @@ var _ Callable = &_Class{}
 func MakeClass(env Env, name string, sup Class, defs ...*ast.FunDef) Class {
 	methods := make(map[string]*Closure)
 	for _, d := range defs {
-		m := MakeClosure(env, d.Params, d.Body)
+		m := MakeClosure(env, name+"."+d.Name.VarName(), d.Params, d.Body)
 		if d.Name.VarName() == "init" {
 			m.IsInitialiser = true
 		}
@@ -57,8 +57,8 @@ func (c *_Class) FindMethod(name string) (*Closure, error) {
 
 func Bind(i Instance, m *Closure) *Closure {
 	e2 := m.ParentEnv.Child()
-	e2.Bind("this", i)
-	m2 := MakeClosure(e2, m.Formals, m.Body)
+	e2.Define(0, i) // "this"
+	m2 := MakeClosure(e2, m.Name, m.Formals, m.Body)
 	m2.IsInitialiser = m.IsInitialiser
 	return m2
 }
@@ -69,7 +69,7 @@ type _Instance struct {
 	Fields map[string]Value
 }
 
-var _ Value = &_Instance{}
+var _ Object = &_Instance{}
 
 func (i *_Instance) String() string {
 	return fmt.Sprintf("<instance %s>", i.Class.Name)
@@ -92,3 +92,8 @@ func (i *_Instance) Get(attr string) (Value, error) {
 		return nil, fmt.Errorf("Undefined property '%s' on %s", attr, i)
 	}
 }
+
+func (i *_Instance) Set(attr string, v Value) error {
+	i.Fields[attr] = v
+	return nil
+}
@@ -0,0 +1,64 @@
+package value
+
+import (
+	"fmt"
+	"github.com/jan-g/lox/lex"
+	"strings"
+)
+
+// FromHost is the position given for a call made from Go rather than from Lox source.
+var FromHost = lex.Pos{Line: -1, Col: -1}
+
+// Frame is an active call to a Lox function, recorded for runtime error reports.
+type Frame struct {
+	Function string
+	Call     lex.Pos // where the function was called from
+}
+
+func (f Frame) String() string {
+	name := f.Function
+	if name == "" {
+		name = "<anonymous>"
+	}
+	if f.Call == FromHost {
+		return fmt.Sprintf("in %s called from Go", name)
+	}
+	return fmt.Sprintf("in %s called at %s", name, f.Call)
+}
+
+// RuntimeError is a failure raised while running a Lox program. It may be caught by
+// a try statement.
+type RuntimeError struct {
+	Pos     lex.Pos
+	Message string
+	Stack   []Frame // innermost call first
+	Thrown  Value   // the value of a throw statement; nil if the interpreter raised the error
+	Cause   error   // what went wrong in an imported module, if that's the reason for the error
+}
+
+// The number of calls shown from each end of a long stack
+const stackShown = 10
+
+func (e *RuntimeError) Error() string {
+	buf := strings.Builder{}
+	buf.WriteString(e.Message)
+	if e.Pos != FromHost {
+		buf.WriteString(fmt.Sprintf(" %s", e.Pos))
+	}
+	for i, f := range e.Stack {
+		// A deep stack, as from runaway recursion, is shown only at either end
+		if i == stackShown && len(e.Stack) > 2*stackShown {
+			buf.WriteString(fmt.Sprintf("\n  ... %d more calls", len(e.Stack)-2*stackShown))
+		}
+		if i >= stackShown && i < len(e.Stack)-stackShown {
+			continue
+		}
+		buf.WriteString("\n  ")
+		buf.WriteString(f.String())
+	}
+	if e.Cause != nil {
+		buf.WriteString("\n")
+		buf.WriteString(e.Cause.Error())
+	}
+	return buf.String()
+}
@@ -0,0 +1,88 @@
+package value
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// List is a mutable sequence of values. Lists are shared by reference.
+type List struct {
+	Elems []Value
+}
+
+func NewList(elems ...Value) *List {
+	return &List{Elems: elems}
+}
+
+func (l *List) String() string {
+	buf := strings.Builder{}
+	buf.WriteRune('[')
+	for i, e := range l.Elems {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(e.String())
+	}
+	buf.WriteRune(']')
+	return buf.String()
+}
+
+// Integer checks that v is a whole number.
+func Integer(v Value) (int, error) {
+	num, ok := v.(Num)
+	if !ok || num != Num(math.Trunc(float64(num))) {
+		return 0, fmt.Errorf("%s is not an integer", v)
+	}
+	return int(num), nil
+}
+
+// Index checks that i is a valid index into a sequence of length n.
+func Index(i Value, n int) (int, error) {
+	num, err := Integer(i)
+	if err != nil {
+		return 0, fmt.Errorf("index %s", err)
+	}
+	if num < 0 || num >= n {
+		return 0, fmt.Errorf("index %d out of range for length %d", num, n)
+	}
+	return num, nil
+}
+
+// GetIndex implements target[i].
+func GetIndex(target Value, i Value) (Value, error) {
+	switch t := target.(type) {
+	case *List:
+		n, err := Index(i, len(t.Elems))
+		if err != nil {
+			return nil, err
+		}
+		return t.Elems[n], nil
+	case *Map:
+		if err := Key(i); err != nil {
+			return nil, err
+		}
+		v, ok := t.Get(i)
+		if !ok {
+			return nil, fmt.Errorf("key %s not found", i)
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("target %s cannot be indexed", target)
+}
+
+// SetIndex implements target[i] = v.
+func SetIndex(target Value, i Value, v Value) error {
+	switch t := target.(type) {
+	case *List:
+		n, err := Index(i, len(t.Elems))
+		if err != nil {
+			return err
+		}
+		t.Elems[n] = v
+		return nil
+	case *Map:
+		return t.Set(i, v)
+	}
+	return fmt.Errorf("target %s cannot be indexed", target)
+}
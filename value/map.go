@@ -0,0 +1,98 @@
+package value
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Map is a mutable dictionary keyed by strings, numbers, booleans and nil.
+// Its entries are kept in insertion order. Maps are shared by reference.
+type Map struct {
+	keys   []Value
+	values map[Value]Value
+}
+
+func NewMap() *Map {
+	return &Map{values: make(map[Value]Value)}
+}
+
+// Key checks that v may be used as a map key.
+func Key(v Value) error {
+	switch v := v.(type) {
+	case Num:
+		if math.IsNaN(float64(v)) {
+			// NaN is not equal to itself, so it could never be found again
+			return fmt.Errorf("NaN cannot be used as a map key")
+		}
+		return nil
+	case Str, Bool, NilT:
+		return nil
+	}
+	return fmt.Errorf("%s cannot be used as a map key", v)
+}
+
+func (m *Map) String() string {
+	buf := strings.Builder{}
+	buf.WriteRune('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(fmt.Sprintf("%s: %s", k, m.values[k]))
+	}
+	buf.WriteRune('}')
+	return buf.String()
+}
+
+func (m *Map) Len() int {
+	return len(m.keys)
+}
+
+func (m *Map) Get(k Value) (Value, bool) {
+	if Key(k) != nil {
+		return nil, false
+	}
+	v, ok := m.values[k]
+	return v, ok
+}
+
+func (m *Map) Set(k Value, v Value) error {
+	if err := Key(k); err != nil {
+		return err
+	}
+	if _, ok := m.values[k]; !ok {
+		m.keys = append(m.keys, k)
+	}
+	m.values[k] = v
+	return nil
+}
+
+// Delete removes k from the map, and reports whether it was there.
+func (m *Map) Delete(k Value) bool {
+	if _, ok := m.Get(k); !ok {
+		return false
+	}
+	delete(m.values, k)
+	for i, k2 := range m.keys {
+		if k2 == k {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Keys returns the map's keys in insertion order.
+func (m *Map) Keys() []Value {
+	return append([]Value{}, m.keys...)
+}
+
+// Values returns the map's values in the insertion order of their keys.
+func (m *Map) Values() []Value {
+	vs := make([]Value, len(m.keys))
+	for i, k := range m.keys {
+		vs[i] = m.values[k]
+	}
+	return vs
+}
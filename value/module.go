@@ -0,0 +1,45 @@
+package value
+
+import (
+	"fmt"
+	"github.com/jan-g/lox/ast"
+)
+
+// Importer runs the modules that import statements name.
+type Importer interface {
+	// Import returns the module at path, which is named by a statement in the file from.
+	Import(from string, path string) (*Module, error)
+}
+
+// Module is the namespace of an imported file. Its attributes are the file's top-level
+// bindings, which are read from the environment it ran in.
+type Module struct {
+	Path  string // as it was imported
+	Env   Env
+	names map[string]bool
+}
+
+var _ Object = &Module{}
+
+func NewModule(path string, env Env, names ...string) *Module {
+	m := &Module{Path: path, Env: env, names: make(map[string]bool)}
+	for _, n := range names {
+		m.names[n] = true
+	}
+	return m
+}
+
+func (m *Module) String() string {
+	return fmt.Sprintf("<module %s>", m.Path)
+}
+
+func (m *Module) Get(attr string) (Value, error) {
+	if !m.names[attr] {
+		return nil, fmt.Errorf("Undefined property '%s' on %s", attr, m)
+	}
+	return m.Env.Lookup(ast.Global, 0, attr), nil
+}
+
+func (m *Module) Set(attr string, v Value) error {
+	return fmt.Errorf("cannot assign to '%s' on %s", attr, m)
+}
@@ -3,6 +3,7 @@ package value
 import (
 	"fmt"
 	"github.com/jan-g/lox/ast"
+	"math"
 	"strconv"
 )
 
@@ -22,6 +23,22 @@ func (n Num) String() string {
 	return strconv.FormatFloat(float64(n), 'g', -1, 64)
 }
 
+// Mod is the remainder of floored division: the result has the sign of the divisor,
+// so that a == b * Div(a, b) + Mod(a, b). The divisor must not be zero.
+func Mod(a, b Num) Num {
+	m := math.Mod(float64(a), float64(b))
+	if m != 0 && (m < 0) != (b < 0) {
+		m += float64(b)
+	}
+	return Num(m)
+}
+
+// Div is floored division: the quotient rounded towards negative infinity.
+// The divisor must not be zero.
+func Div(a, b Num) Num {
+	return Num(math.Floor(float64(a / b)))
+}
+
 type Bool bool
 
 func (b Bool) String() string {
@@ -46,23 +63,34 @@ func Truthful(v Value) bool {
 	return true
 }
 
+// Env is a lexical scope. Locals are addressed by the (depth, slot) pairs computed by
+// the resolver; globals, with depth ast.Global, by name.
 type Env interface {
 	Child() Env
 
 	Bind(name string, v Value)
-	Lookup(depth int, name string) Value
-	Assign(depth int, name string, v Value)
+	Define(slot int, v Value)
+	Lookup(depth int, slot int, name string) Value
+	Assign(depth int, slot int, name string, v Value)
 
 	Run(stmt ast.Stmt) error
 	Exec(ast.Stmt) error
 }
 
+// Object is a value with attributes, which can be read and assigned.
+type Object interface {
+	Value
+	Get(attr string) (Value, error)
+	Set(attr string, v Value) error
+}
+
 type Callable interface {
 	Value
 	Arity() int
 }
 
 type Closure struct {
+	Name          string // for stack traces; methods are named Class.method
 	ParentEnv     Env
 	Formals       []ast.Var
 	Body          ast.Stmt
@@ -79,8 +107,9 @@ func (c *Closure) Arity() int {
 
 var _ Callable = &Closure{}
 
-func MakeClosure(parentEnv Env, formals []ast.Var, body ast.Stmt) *Closure {
+func MakeClosure(parentEnv Env, name string, formals []ast.Var, body ast.Stmt) *Closure {
 	return &Closure{
+		Name:      name,
 		ParentEnv: parentEnv,
 		Formals:   formals,
 		Body:      body,
@@ -0,0 +1,131 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/jan-g/lox/compile"
+	"github.com/jan-g/lox/value"
+)
+
+// globals holds the values of a VM's global variables, indexed as the compiler assigned
+// them. A closure keeps the globals it was defined with, so that a function from a
+// module still sees that module's globals when it is called from elsewhere.
+type globals struct {
+	names  *compile.Globals
+	values []value.Value // nil marks an unbound global
+}
+
+// Upvalue is a variable captured by a closure. While the variable is still live
+// on the stack the upvalue refers to its slot; once that slot goes out of scope
+// the value is moved into the upvalue itself.
+type Upvalue struct {
+	slot   int
+	open   bool
+	closed value.Value
+	next   *Upvalue
+}
+
+type Closure struct {
+	Fn       *compile.Function
+	Upvalues []*Upvalue
+	globals  *globals // of the program or module that defined the closure
+}
+
+func (c *Closure) String() string {
+	return fmt.Sprintf("<closure of arity %d>", c.Fn.Arity)
+}
+
+func (c *Closure) Arity() int {
+	return c.Fn.Arity
+}
+
+var _ value.Callable = &Closure{}
+
+type Class struct {
+	Name       string
+	Methods    map[string]*Closure
+	Superclass *Class
+}
+
+func (c *Class) String() string {
+	return fmt.Sprintf("<class %s>", c.Name)
+}
+
+func (c *Class) Arity() int {
+	if m, ok := c.FindMethod("init"); ok {
+		return m.Arity()
+	}
+	return 0
+}
+
+var _ value.Callable = &Class{}
+
+func (c *Class) FindMethod(name string) (*Closure, bool) {
+	for cl := c; cl != nil; cl = cl.Superclass {
+		if m, ok := cl.Methods[name]; ok {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+type Instance struct {
+	Class  *Class
+	Fields map[string]value.Value
+}
+
+func (i *Instance) String() string {
+	return fmt.Sprintf("<instance %s>", i.Class.Name)
+}
+
+func (i *Instance) Get(attr string) (value.Value, error) {
+	if v, ok := i.Fields[attr]; ok {
+		return v, nil
+	}
+	if m, ok := i.Class.FindMethod(attr); ok {
+		return &BoundMethod{Receiver: i, Method: m}, nil
+	}
+	return nil, fmt.Errorf("Undefined property '%s' on %s", attr, i)
+}
+
+func (i *Instance) Set(attr string, v value.Value) error {
+	i.Fields[attr] = v
+	return nil
+}
+
+var _ value.Object = &Instance{}
+
+type BoundMethod struct {
+	Receiver value.Value
+	Method   *Closure
+}
+
+func (b *BoundMethod) String() string {
+	return b.Method.String()
+}
+
+func (b *BoundMethod) Arity() int {
+	return b.Method.Arity()
+}
+
+var _ value.Callable = &BoundMethod{}
+
+// thrown holds a caught error on the stack while a catch or finally block is entered.
+type thrown struct {
+	err *value.RuntimeError
+}
+
+func (t *thrown) String() string {
+	return t.err.Message
+}
+
+// errorClass is the class of the values that catch blocks receive for errors raised
+// by the VM itself, rather than by a throw statement.
+var errorClass = &Class{Name: "Error", Methods: make(map[string]*Closure)}
+
+// caught returns the value that a catch block sees for err.
+func caught(err *value.RuntimeError) value.Value {
+	if err.Thrown != nil {
+		return err.Thrown
+	}
+	return &Instance{Class: errorClass, Fields: map[string]value.Value{"message": value.Str(err.Message)}}
+}
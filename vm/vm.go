@@ -0,0 +1,606 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/jan-g/lox/ast"
+	"github.com/jan-g/lox/builtin"
+	"github.com/jan-g/lox/compile"
+	"github.com/jan-g/lox/lex"
+	"github.com/jan-g/lox/value"
+	"io"
+	"strings"
+)
+
+const framesMax = 1 << 16
+
+type frame struct {
+	closure *Closure
+	ip      int
+	base    int
+}
+
+// pos is the source position of the instruction most recently read by the frame.
+func (f *frame) pos() lex.Pos {
+	return f.closure.Fn.Chunk.Pos[f.ip-1]
+}
+
+// handler is the state to restore when an error is caught by a try statement.
+type handler struct {
+	frame int // the index of the frame running the try statement
+	stack int // the stack height when the try statement began
+	ip    int // the start of the handler's code
+}
+
+type VM struct {
+	Out          io.Writer
+	globals      *globals
+	importer     value.Importer
+	stack        []value.Value
+	frames       []frame
+	handlers     []handler
+	openUpvalues *Upvalue
+}
+
+// The VM has a single global namespace; it stands in for the root eval.Env so that
+// builtins can be installed into either engine. Lookups are always by name.
+var _ value.Env = &VM{}
+
+func New(out io.Writer) *VM {
+	return &VM{
+		Out:     out,
+		globals: &globals{names: compile.NewGlobals()},
+		stack:   make([]value.Value, 0, 256),
+	}
+}
+
+func (vm *VM) Child() value.Env {
+	return vm
+}
+
+// SetImporter sets what runs the modules named by import statements.
+func (vm *VM) SetImporter(i value.Importer) {
+	vm.importer = i
+}
+
+// global returns the index of a global, growing the value table to cover any names
+// allocated by the compiler since it was last resized.
+func (vm *VM) global(name string) int {
+	g := vm.globals.names.Slot(name)
+	vm.globals.grow()
+	return g
+}
+
+func (gs *globals) grow() {
+	for len(gs.values) < len(gs.names.Names) {
+		gs.values = append(gs.values, nil)
+	}
+}
+
+func (vm *VM) Bind(name string, v value.Value) {
+	vm.globals.values[vm.global(name)] = v
+}
+
+// Define has no meaning for the VM, whose locals live on its stack.
+func (vm *VM) Define(slot int, v value.Value) {
+	panic(fmt.Errorf("the VM has no slot-addressed scopes"))
+}
+
+func (vm *VM) Lookup(depth int, slot int, name string) value.Value {
+	if v := vm.globals.values[vm.global(name)]; v != nil {
+		return v
+	}
+	panic(fmt.Errorf("unbound variable: %s", name))
+}
+
+func (vm *VM) Assign(depth int, slot int, name string, v value.Value) {
+	g := vm.global(name)
+	if vm.globals.values[g] == nil {
+		panic(fmt.Errorf("cannot update unbound variable: %s", name))
+	}
+	vm.globals.values[g] = v
+}
+
+func (vm *VM) Run(s ast.Stmt) (err error) {
+	defer func() {
+		e := recover()
+		if e == nil {
+			return
+		}
+		err = e.(error)
+	}()
+	return vm.Exec(s)
+}
+
+// Exec compiles the statement and executes the result. Globals persist between calls.
+func (vm *VM) Exec(s ast.Stmt) error {
+	fn, err := compile.Compile(s, vm.globals.names)
+	if err != nil {
+		return err
+	}
+	return vm.Interpret(fn)
+}
+
+// Interpret runs a function compiled against this VM's globals.
+func (vm *VM) Interpret(fn *compile.Function) error {
+	vm.globals.grow()
+	cl := &Closure{Fn: fn, globals: vm.globals}
+	vm.push(cl)
+	if err := vm.call(cl, 0); err != nil {
+		vm.reset()
+		return err
+	}
+	if err := vm.run(); err != nil {
+		vm.reset()
+		return err
+	}
+	return nil
+}
+
+func (vm *VM) reset() {
+	vm.stack = vm.stack[:0]
+	vm.frames = vm.frames[:0]
+	vm.handlers = vm.handlers[:0]
+	vm.openUpvalues = nil
+}
+
+// errorf builds a RuntimeError for the instruction currently executing, capturing the call stack.
+func (vm *VM) errorf(msg string, xs ...interface{}) *value.RuntimeError {
+	err := &value.RuntimeError{Message: fmt.Sprintf(msg, xs...)}
+	if len(vm.frames) == 0 {
+		return err
+	}
+	err.Pos = vm.frames[len(vm.frames)-1].pos()
+	for i := len(vm.frames) - 1; i > 0; i-- {
+		err.Stack = append(err.Stack, value.Frame{
+			Function: vm.frames[i].closure.Fn.Name,
+			Call:     vm.frames[i-1].pos(),
+		})
+	}
+	return err
+}
+
+func (vm *VM) push(v value.Value) {
+	vm.stack = append(vm.stack, v)
+}
+
+func (vm *VM) pop() value.Value {
+	v := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return v
+}
+
+func (vm *VM) peek(distance int) value.Value {
+	return vm.stack[len(vm.stack)-1-distance]
+}
+
+func (vm *VM) call(cl *Closure, argc int) error {
+	if cl.Fn.Arity != argc {
+		return vm.errorf("%s required %d args, %d given", cl, cl.Fn.Arity, argc)
+	}
+	// The script has a frame, and each call another
+	if len(vm.frames) > framesMax {
+		return vm.errorf("stack overflow")
+	}
+	vm.frames = append(vm.frames, frame{
+		closure: cl,
+		base:    len(vm.stack) - argc - 1,
+	})
+	return nil
+}
+
+func (vm *VM) callValue(callee value.Value, argc int) error {
+	base := len(vm.stack) - argc - 1
+	switch callee := callee.(type) {
+	case *Closure:
+		return vm.call(callee, argc)
+	case *BoundMethod:
+		if callee.Method.Fn.IsInitialiser {
+			// Calling init() on an existing instance does not rerun the initialiser.
+			if callee.Arity() != argc {
+				return vm.errorf("%s required %d args, %d given", callee, callee.Arity(), argc)
+			}
+			vm.stack[base] = callee.Receiver
+			vm.stack = vm.stack[:base+1]
+			return nil
+		}
+		vm.stack[base] = callee.Receiver
+		return vm.call(callee.Method, argc)
+	case *Class:
+		if callee.Arity() != argc {
+			return vm.errorf("%s required %d args, %d given", callee, callee.Arity(), argc)
+		}
+		vm.stack[base] = &Instance{Class: callee, Fields: make(map[string]value.Value)}
+		if init, ok := callee.FindMethod("init"); ok {
+			return vm.call(init, argc)
+		}
+		return nil
+	case *builtin.Builtin:
+		if callee.Arity() != argc {
+			return vm.errorf("%s required %d args, %d given", callee, callee.Arity(), argc)
+		}
+		args := make([]value.Value, argc)
+		copy(args, vm.stack[base+1:])
+		v, err := callee.Builtin(vm, args...)
+		if err != nil {
+			return vm.errorf("%s", err)
+		}
+		vm.stack[base] = v
+		vm.stack = vm.stack[:base+1]
+		return nil
+	}
+	return vm.errorf("target %s is not callable", callee)
+}
+
+func (vm *VM) captureUpvalue(slot int) *Upvalue {
+	var prev *Upvalue
+	u := vm.openUpvalues
+	for u != nil && u.slot > slot {
+		prev = u
+		u = u.next
+	}
+	if u != nil && u.slot == slot {
+		return u
+	}
+	created := &Upvalue{slot: slot, open: true, next: u}
+	if prev == nil {
+		vm.openUpvalues = created
+	} else {
+		prev.next = created
+	}
+	return created
+}
+
+func (vm *VM) closeUpvalues(last int) {
+	for vm.openUpvalues != nil && vm.openUpvalues.slot >= last {
+		u := vm.openUpvalues
+		u.closed = vm.stack[u.slot]
+		u.open = false
+		vm.openUpvalues = u.next
+	}
+}
+
+func (vm *VM) getUpvalue(u *Upvalue) value.Value {
+	if u.open {
+		return vm.stack[u.slot]
+	}
+	return u.closed
+}
+
+func (vm *VM) setUpvalue(u *Upvalue, v value.Value) {
+	if u.open {
+		vm.stack[u.slot] = v
+	} else {
+		u.closed = v
+	}
+}
+
+func (vm *VM) run() error {
+	for {
+		err := vm.execute()
+		if err == nil || !vm.unwind(err) {
+			return err
+		}
+	}
+}
+
+// unwind passes a runtime error to the innermost try handler, if there is one.
+func (vm *VM) unwind(err error) bool {
+	rerr, ok := err.(*value.RuntimeError)
+	if !ok || len(vm.handlers) == 0 {
+		return false
+	}
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	vm.closeUpvalues(h.stack)
+	vm.frames = vm.frames[:h.frame+1]
+	vm.stack = vm.stack[:h.stack]
+	vm.frames[h.frame].ip = h.ip
+	vm.push(&thrown{err: rerr})
+	return true
+}
+
+func (vm *VM) execute() error {
+	f := &vm.frames[len(vm.frames)-1]
+	code := f.closure.Fn.Chunk.Code
+	constants := f.closure.Fn.Chunk.Constants
+	globals := f.closure.globals
+
+	readU16 := func() int {
+		n := int(code[f.ip])<<8 | int(code[f.ip+1])
+		f.ip += 2
+		return n
+	}
+	reload := func() {
+		f = &vm.frames[len(vm.frames)-1]
+		code = f.closure.Fn.Chunk.Code
+		constants = f.closure.Fn.Chunk.Constants
+		globals = f.closure.globals
+	}
+
+	for {
+		op := compile.OpCode(code[f.ip])
+		f.ip++
+		switch op {
+		case compile.OpConstant:
+			vm.push(constants[readU16()])
+		case compile.OpNil:
+			vm.push(value.Nil)
+		case compile.OpTrue:
+			vm.push(value.Bool(true))
+		case compile.OpFalse:
+			vm.push(value.Bool(false))
+		case compile.OpPop:
+			vm.pop()
+		case compile.OpGetLocal:
+			slot := int(code[f.ip])
+			f.ip++
+			vm.push(vm.stack[f.base+slot])
+		case compile.OpSetLocal:
+			slot := int(code[f.ip])
+			f.ip++
+			vm.stack[f.base+slot] = vm.peek(0)
+		case compile.OpGetGlobal:
+			g := readU16()
+			v := globals.values[g]
+			if v == nil {
+				return vm.errorf("unbound variable: %s", globals.names.Names[g])
+			}
+			vm.push(v)
+		case compile.OpDefineGlobal:
+			globals.values[readU16()] = vm.pop()
+		case compile.OpSetGlobal:
+			g := readU16()
+			if globals.values[g] == nil {
+				return vm.errorf("cannot update unbound variable: %s", globals.names.Names[g])
+			}
+			globals.values[g] = vm.peek(0)
+		case compile.OpGetUpvalue:
+			slot := int(code[f.ip])
+			f.ip++
+			vm.push(vm.getUpvalue(f.closure.Upvalues[slot]))
+		case compile.OpSetUpvalue:
+			slot := int(code[f.ip])
+			f.ip++
+			vm.setUpvalue(f.closure.Upvalues[slot], vm.peek(0))
+		case compile.OpGetProperty:
+			name := string(constants[readU16()].(value.Str))
+			obj, ok := vm.peek(0).(value.Object)
+			if !ok {
+				return vm.errorf("target %s has no attributes", vm.peek(0))
+			}
+			v, err := obj.Get(name)
+			if err != nil {
+				return vm.errorf("%s", err)
+			}
+			vm.stack[len(vm.stack)-1] = v
+		case compile.OpSetProperty:
+			name := string(constants[readU16()].(value.Str))
+			obj, ok := vm.peek(1).(value.Object)
+			if !ok {
+				return vm.errorf("target %s has no attributes", vm.peek(1))
+			}
+			v := vm.pop()
+			if err := obj.Set(name, v); err != nil {
+				return vm.errorf("%s", err)
+			}
+			vm.stack[len(vm.stack)-1] = v
+		case compile.OpImport:
+			m := constants[readU16()].(compile.Module)
+			v, err := vm.importModule(m)
+			if err != nil {
+				return err
+			}
+			vm.push(v)
+		case compile.OpGetSuper:
+			name := string(constants[readU16()].(value.Str))
+			sc := vm.pop().(*Class)
+			m, ok := sc.FindMethod(name)
+			if !ok {
+				return vm.errorf("cannot find method %s on %s", name, sc)
+			}
+			vm.stack[len(vm.stack)-1] = &BoundMethod{Receiver: vm.peek(0), Method: m}
+		case compile.OpEqual:
+			r := vm.pop()
+			vm.stack[len(vm.stack)-1] = value.Bool(vm.peek(0) == r)
+		case compile.OpNotEqual:
+			r := vm.pop()
+			vm.stack[len(vm.stack)-1] = value.Bool(vm.peek(0) != r)
+		case compile.OpGreater, compile.OpGreaterEqual, compile.OpLess, compile.OpLessEqual,
+			compile.OpSubtract, compile.OpMultiply, compile.OpDivide:
+			l, okl := vm.peek(1).(value.Num)
+			r, okr := vm.peek(0).(value.Num)
+			if !okl || !okr {
+				return vm.errorf("Operands must be numbers.")
+			}
+			vm.pop()
+			vm.stack[len(vm.stack)-1] = arith(op, l, r)
+		case compile.OpModulo, compile.OpIntDivide:
+			l, okl := vm.peek(1).(value.Num)
+			r, okr := vm.peek(0).(value.Num)
+			if !okl || !okr {
+				return vm.errorf("Operands must be numbers.")
+			}
+			if r == 0 {
+				return vm.errorf("Division by zero.")
+			}
+			vm.pop()
+			if op == compile.OpModulo {
+				vm.stack[len(vm.stack)-1] = value.Mod(l, r)
+			} else {
+				vm.stack[len(vm.stack)-1] = value.Div(l, r)
+			}
+		case compile.OpAdd:
+			switch l := vm.peek(1).(type) {
+			case value.Num:
+				if r, ok := vm.peek(0).(value.Num); ok {
+					vm.pop()
+					vm.stack[len(vm.stack)-1] = l + r
+					continue
+				}
+			case value.Str:
+				if r, ok := vm.peek(0).(value.Str); ok {
+					vm.pop()
+					vm.stack[len(vm.stack)-1] = l + r
+					continue
+				}
+			}
+			return vm.errorf("Operands must be two numbers or two strings.")
+		case compile.OpNot:
+			vm.stack[len(vm.stack)-1] = value.Bool(!value.Truthful(vm.peek(0)))
+		case compile.OpNegate:
+			n, ok := vm.peek(0).(value.Num)
+			if !ok {
+				return vm.errorf("Operand must be a number.")
+			}
+			vm.stack[len(vm.stack)-1] = -n
+		case compile.OpPrint:
+			_, _ = fmt.Fprintln(vm.Out, vm.pop())
+		case compile.OpJump:
+			offset := readU16()
+			f.ip += offset
+		case compile.OpJumpIfFalse:
+			offset := readU16()
+			if !value.Truthful(vm.peek(0)) {
+				f.ip += offset
+			}
+		case compile.OpLoop:
+			offset := readU16()
+			f.ip -= offset
+		case compile.OpCall:
+			argc := int(code[f.ip])
+			f.ip++
+			if err := vm.callValue(vm.peek(argc), argc); err != nil {
+				return err
+			}
+			reload()
+		case compile.OpClosure:
+			fn := constants[readU16()].(*compile.Function)
+			cl := &Closure{Fn: fn, Upvalues: make([]*Upvalue, fn.UpvalueCount), globals: globals}
+			for i := range cl.Upvalues {
+				isLocal, index := code[f.ip], int(code[f.ip+1])
+				f.ip += 2
+				if isLocal == 1 {
+					cl.Upvalues[i] = vm.captureUpvalue(f.base + index)
+				} else {
+					cl.Upvalues[i] = f.closure.Upvalues[index]
+				}
+			}
+			vm.push(cl)
+		case compile.OpCloseUpvalue:
+			vm.closeUpvalues(len(vm.stack) - 1)
+			vm.pop()
+		case compile.OpReturn:
+			result := vm.pop()
+			vm.closeUpvalues(f.base)
+			base := f.base
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			vm.stack = vm.stack[:base]
+			if len(vm.frames) == 0 {
+				return nil
+			}
+			vm.push(result)
+			reload()
+		case compile.OpClass:
+			name := string(constants[readU16()].(value.Str))
+			vm.push(&Class{Name: name, Methods: make(map[string]*Closure)})
+		case compile.OpInherit:
+			sc, ok := vm.peek(1).(*Class)
+			if !ok {
+				return vm.errorf("%s is not a class", vm.peek(1))
+			}
+			vm.peek(0).(*Class).Superclass = sc
+		case compile.OpMethod:
+			name := string(constants[readU16()].(value.Str))
+			m := vm.pop().(*Closure)
+			vm.peek(0).(*Class).Methods[name] = m
+		case compile.OpList:
+			n := readU16()
+			elems := make([]value.Value, n)
+			copy(elems, vm.stack[len(vm.stack)-n:])
+			vm.stack = vm.stack[:len(vm.stack)-n]
+			vm.push(value.NewList(elems...))
+		case compile.OpInterpolate:
+			n := readU16()
+			buf := strings.Builder{}
+			for _, v := range vm.stack[len(vm.stack)-n:] {
+				buf.WriteString(v.String())
+			}
+			vm.stack = vm.stack[:len(vm.stack)-n]
+			vm.push(value.Str(buf.String()))
+		case compile.OpMap:
+			n := readU16()
+			entries := vm.stack[len(vm.stack)-2*n:]
+			m := value.NewMap()
+			for i := 0; i < n; i++ {
+				if err := m.Set(entries[2*i], entries[2*i+1]); err != nil {
+					return vm.errorf("%s", err)
+				}
+			}
+			vm.stack = vm.stack[:len(vm.stack)-2*n]
+			vm.push(m)
+		case compile.OpGetIndex:
+			i := vm.pop()
+			v, err := value.GetIndex(vm.peek(0), i)
+			if err != nil {
+				return vm.errorf("%s", err)
+			}
+			vm.stack[len(vm.stack)-1] = v
+		case compile.OpSetIndex:
+			v := vm.pop()
+			i := vm.pop()
+			if err := value.SetIndex(vm.peek(0), i, v); err != nil {
+				return vm.errorf("%s", err)
+			}
+			vm.stack[len(vm.stack)-1] = v
+		case compile.OpThrow:
+			v := vm.pop()
+			err := vm.errorf("uncaught exception: %s", v)
+			err.Thrown = v
+			return err
+		case compile.OpTry:
+			offset := readU16()
+			vm.handlers = append(vm.handlers, handler{frame: len(vm.frames) - 1, stack: len(vm.stack), ip: f.ip + offset})
+		case compile.OpPopTry:
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+		case compile.OpCaught:
+			vm.stack[len(vm.stack)-1] = caught(vm.peek(0).(*thrown).err)
+		case compile.OpRethrow:
+			return vm.pop().(*thrown).err
+		default:
+			return vm.errorf("unknown opcode %s", op)
+		}
+	}
+}
+
+func arith(op compile.OpCode, l, r value.Num) value.Value {
+	switch op {
+	case compile.OpGreater:
+		return value.Bool(l > r)
+	case compile.OpGreaterEqual:
+		return value.Bool(l >= r)
+	case compile.OpLess:
+		return value.Bool(l < r)
+	case compile.OpLessEqual:
+		return value.Bool(l <= r)
+	case compile.OpSubtract:
+		return l - r
+	case compile.OpMultiply:
+		return l * r
+	case compile.OpDivide:
+		return l / r
+	}
+	panic(fmt.Errorf("unhandled binary op %s", op))
+}
+
+func (vm *VM) importModule(m compile.Module) (value.Value, error) {
+	if vm.importer == nil {
+		return nil, vm.errorf("cannot import %q: modules are not available", m.Path)
+	}
+	v, err := vm.importer.Import(m.File, m.Path)
+	if err != nil {
+		rerr := vm.errorf("cannot import %q", m.Path)
+		rerr.Cause = err
+		return nil, rerr
+	}
+	return v, nil
+}